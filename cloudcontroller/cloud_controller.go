@@ -0,0 +1,120 @@
+package cloudcontroller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout limits how long each request to the Cloud Controller may
+// take, so that startup does not hang on an unresponsive API.
+const DefaultTimeout = 10 * time.Second
+
+// Endpoints are the Loggregator and UAA endpoints a foundation advertises.
+// Any of them can be empty if the Cloud Controller does not advertise it.
+type Endpoints struct {
+	// UAAURL is the token endpoint.
+	UAAURL string
+	// TrafficControllerURL is the doppler websocket endpoint.
+	TrafficControllerURL string
+	// RLPGatewayURL is the log stream endpoint.
+	RLPGatewayURL string
+}
+
+// Client discovers the endpoints of a foundation from its Cloud Controller
+// API, which does not require authentication.
+type Client struct {
+	url        string
+	httpClient *http.Client
+}
+
+type v2Info struct {
+	TokenEndpoint          string `json:"token_endpoint"`
+	DopplerLoggingEndpoint string `json:"doppler_logging_endpoint"`
+}
+
+type link struct {
+	Href string `json:"href"`
+}
+
+type v3Root struct {
+	Links struct {
+		UAA       *link `json:"uaa"`
+		Logging   *link `json:"logging"`
+		LogStream *link `json:"log_stream"`
+	} `json:"links"`
+}
+
+func New(cloudControllerURL string, transport http.RoundTripper) *Client {
+	return &Client{
+		url:        strings.TrimRight(cloudControllerURL, "/"),
+		httpClient: &http.Client{Transport: transport, Timeout: DefaultTimeout},
+	}
+}
+
+// SetTimeout limits how long a single request may take.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.httpClient.Timeout = timeout
+}
+
+// Endpoints reads /v2/info, and the links of the v3 root for the endpoints
+// /v2/info does not have, such as the log stream. Older Cloud Controllers
+// only serve /v2/info and newer ones may only serve the v3 root, so it only
+// fails if neither can be read.
+func (c *Client) Endpoints() (Endpoints, error) {
+	var endpoints Endpoints
+
+	var info v2Info
+	infoErr := c.get("/v2/info", &info)
+	if infoErr == nil {
+		endpoints.UAAURL = info.TokenEndpoint
+		endpoints.TrafficControllerURL = info.DopplerLoggingEndpoint
+	}
+
+	var root v3Root
+	if err := c.get("/", &root); err != nil {
+		if infoErr != nil {
+			return Endpoints{}, infoErr
+		}
+		return endpoints, nil
+	}
+	if endpoints.UAAURL == "" && root.Links.UAA != nil {
+		endpoints.UAAURL = root.Links.UAA.Href
+	}
+	if endpoints.TrafficControllerURL == "" && root.Links.Logging != nil {
+		endpoints.TrafficControllerURL = root.Links.Logging.Href
+	}
+	if root.Links.LogStream != nil {
+		endpoints.RLPGatewayURL = root.Links.LogStream.Href
+	}
+	return endpoints, nil
+}
+
+func (c *Client) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", c.url+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Cloud Controller returned HTTP response: %s", resp.Status)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("can not parse Cloud Controller response from %s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package cloudcontroller_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/cloudcontroller"
+	. "github.com/cloudfoundry-incubator/datadog-firehose-nozzle/testhelpers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		fakeCC *FakeCloudController
+		client *cloudcontroller.Client
+	)
+
+	BeforeEach(func() {
+		fakeCC = NewFakeCloudController(
+			"https://uaa.example.com",
+			"wss://doppler.example.com:443",
+			"https://log-stream.example.com",
+		)
+		fakeCC.Start()
+		client = cloudcontroller.New(fakeCC.URL()+"/", nil)
+	})
+
+	AfterEach(func() {
+		fakeCC.Close()
+	})
+
+	It("discovers the token, doppler and log stream endpoints", func() {
+		endpoints, err := client.Endpoints()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(endpoints).To(Equal(cloudcontroller.Endpoints{
+			UAAURL:               "https://uaa.example.com",
+			TrafficControllerURL: "wss://doppler.example.com:443",
+			RLPGatewayURL:        "https://log-stream.example.com",
+		}))
+	})
+
+	It("uses the v3 root links when /v2/info is not served", func() {
+		fakeCC.DisableV2Info()
+
+		endpoints, err := client.Endpoints()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(endpoints.UAAURL).To(Equal("https://uaa.example.com"))
+		Expect(endpoints.TrafficControllerURL).To(Equal("wss://doppler.example.com:443"))
+	})
+
+	It("uses /v2/info alone when the v3 root is not served", func() {
+		fakeCC.DisableV3Root()
+
+		endpoints, err := client.Endpoints()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(endpoints).To(Equal(cloudcontroller.Endpoints{
+			UAAURL:               "https://uaa.example.com",
+			TrafficControllerURL: "wss://doppler.example.com:443",
+		}))
+	})
+
+	It("returns an error when neither can be read", func() {
+		fakeCC.DisableV2Info()
+		fakeCC.DisableV3Root()
+
+		_, err := client.Endpoints()
+		Expect(err).To(MatchError(ContainSubstring("404")))
+	})
+
+	It("gives up on a Cloud Controller that does not answer", func() {
+		hung := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-hung
+		}))
+		defer server.Close()
+		defer close(hung)
+
+		client = cloudcontroller.New(server.URL, nil)
+		client.SetTimeout(50 * time.Millisecond)
+
+		_, err := client.Endpoints()
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,217 @@
+package datadogclient
+
+import "container/heap"
+
+const (
+	BufferPolicyDropOldest = "drop-oldest"
+	BufferPolicyDropNewest = "drop-newest"
+	BufferPolicyDownsample = "downsample"
+
+	// The buffer's size in bytes is an estimate of the JSON it will be
+	// posted as, not of its size in memory.
+	estimatedPointBytes  = 40
+	estimatedSeriesBytes = 64
+)
+
+type bufferLimits struct {
+	maxPoints uint32
+	maxBytes  uint32
+	policy    string
+}
+
+// SetBufferLimits caps the points and estimated bytes held between
+// flushes. A limit of 0 leaves that dimension unbounded. When a new point
+// would exceed a limit, policy decides whether the oldest buffered points
+// are evicted, the new point is dropped or every series is downsampled to
+// half its resolution.
+func (c *Client) SetBufferLimits(maxPoints, maxBytes uint32, policy string) {
+	c.limits = bufferLimits{
+		maxPoints: maxPoints,
+		maxBytes:  maxBytes,
+		policy:    policy,
+	}
+}
+
+// makeRoom evicts buffered points as the policy allows until a point for
+// key fits, and reports whether it does.
+func (c *Client) makeRoom(key MetricKey, tags []string) bool {
+	if c.limits.maxPoints == 0 && c.limits.maxBytes == 0 {
+		return true
+	}
+
+	for c.exceedsLimits(key, tags) {
+		switch c.limits.policy {
+		case BufferPolicyDropOldest:
+			if !c.evictOldest() {
+				return false
+			}
+		case BufferPolicyDownsample:
+			if !c.downsample() {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Client) exceedsLimits(key MetricKey, tags []string) bool {
+	needed := uint64(estimatedPointBytes)
+	if _, ok := c.metricPoints[key]; !ok {
+		needed += estimateSeriesBytes(key, tags)
+	}
+
+	if c.limits.maxPoints > 0 && c.bufferedPoints+1 > uint64(c.limits.maxPoints) {
+		return true
+	}
+	return c.limits.maxBytes > 0 && c.bufferedBytes+needed > uint64(c.limits.maxBytes)
+}
+
+// trackPoint accounts for a point that has just been buffered for key.
+func (c *Client) trackPoint(key MetricKey, tags []string, newSeries bool) {
+	c.bufferedPoints++
+	c.bufferedBytes += estimatedPointBytes
+	if newSeries {
+		c.bufferedBytes += estimateSeriesBytes(key, tags)
+		if c.limits.policy == BufferPolicyDropOldest {
+			heap.Push(&c.oldest, seriesAge{key: key, oldest: c.metricPoints[key].Points[0].Timestamp})
+		}
+	}
+}
+
+// evictOldest drops the first point of the series whose first point is the
+// oldest.
+func (c *Client) evictOldest() bool {
+	for len(c.oldest) > 0 {
+		key := c.oldest[0].key
+		mVal, ok := c.metricPoints[key]
+		if !ok || len(mVal.Points) == 0 {
+			heap.Pop(&c.oldest)
+			continue
+		}
+
+		mVal.Points = mVal.Points[1:]
+		c.bufferedPoints--
+		c.bufferedBytes -= estimatedPointBytes
+		c.droppedPoints++
+		if len(mVal.Points) == 0 {
+			delete(c.metricPoints, key)
+			c.bufferedBytes -= estimateSeriesBytes(key, mVal.Tags)
+			heap.Pop(&c.oldest)
+		} else {
+			c.metricPoints[key] = mVal
+			c.oldest[0].oldest = mVal.Points[0].Timestamp
+			heap.Fix(&c.oldest, 0)
+		}
+		return true
+	}
+	return false
+}
+
+// dropPosted removes the points of the first payloads of a flush from the
+// buffer, once Datadog accepted them but not the rest of the flush.
+func (c *Client) dropPosted(result formatted, payloads int) {
+	if payloads == 0 {
+		return
+	}
+
+	end := result.ends[payloads-1]
+	for i, key := range result.keys[:end.series+1] {
+		mVal := c.metricPoints[key]
+		posted := len(mVal.Points)
+		if i == end.series {
+			posted = end.point
+		}
+
+		// Internal metrics are set again at every flush and are not
+		// counted in the buffer.
+		tracked := key.EventType != 0
+		if tracked {
+			c.bufferedPoints -= uint64(posted)
+			c.bufferedBytes -= uint64(posted) * estimatedPointBytes
+		}
+		if posted < len(mVal.Points) {
+			mVal.Points = mVal.Points[posted:]
+			c.metricPoints[key] = mVal
+			continue
+		}
+		delete(c.metricPoints, key)
+		c.totalMetricsSent++
+		if tracked {
+			c.bufferedBytes -= estimateSeriesBytes(key, mVal.Tags)
+		}
+	}
+
+	for i := range c.oldest {
+		if mVal, ok := c.metricPoints[c.oldest[i].key]; ok && len(mVal.Points) > 0 {
+			c.oldest[i].oldest = mVal.Points[0].Timestamp
+		}
+	}
+	heap.Init(&c.oldest)
+}
+
+// seriesAge is a buffered series and the timestamp of its first point.
+type seriesAge struct {
+	key    MetricKey
+	oldest int64
+}
+
+// oldestSeries is a heap of the buffered series, oldest first, that the
+// drop-oldest policy keeps with one entry per series.
+type oldestSeries []seriesAge
+
+func (h oldestSeries) Len() int            { return len(h) }
+func (h oldestSeries) Less(i, j int) bool  { return h[i].oldest < h[j].oldest }
+func (h oldestSeries) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *oldestSeries) Push(x interface{}) { *h = append(*h, x.(seriesAge)) }
+
+func (h *oldestSeries) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// downsample keeps the later point of every consecutive pair in each
+// series, which is exact for counter totals and a sample for gauges.
+func (c *Client) downsample() bool {
+	var freed uint64
+	for key, mVal := range c.metricPoints {
+		if len(mVal.Points) < 2 {
+			continue
+		}
+
+		kept := make([]Point, 0, (len(mVal.Points)+1)/2)
+		for i := 1; i < len(mVal.Points); i += 2 {
+			kept = append(kept, mVal.Points[i])
+		}
+		if len(mVal.Points)%2 == 1 {
+			kept = append(kept, mVal.Points[len(mVal.Points)-1])
+		}
+
+		freed += uint64(len(mVal.Points) - len(kept))
+		mVal.Points = kept
+		c.metricPoints[key] = mVal
+	}
+
+	c.bufferedPoints -= freed
+	c.bufferedBytes -= freed * estimatedPointBytes
+	c.droppedPoints += freed
+	return freed > 0
+}
+
+func (c *Client) resetBuffer() {
+	c.metricPoints = make(map[MetricKey]MetricValue)
+	c.bufferedPoints = 0
+	c.bufferedBytes = 0
+	c.oldest = nil
+}
+
+func estimateSeriesBytes(key MetricKey, tags []string) uint64 {
+	size := uint64(estimatedSeriesBytes + len(key.Name))
+	for _, tag := range tags {
+		size += uint64(len(tag)) + 3
+	}
+	return size
+}
@@ -0,0 +1,158 @@
+package datadogclient_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Buffer limits", func() {
+	var (
+		ts *httptest.Server
+		c  *datadogclient.Client
+	)
+
+	BeforeEach(func() {
+		bodies = nil
+		reqs = make(chan *http.Request, 1000)
+		responseCode = http.StatusOK
+		ts = httptest.NewServer(http.HandlerFunc(handlePost))
+		c = datadogclient.New(
+			ts.URL,
+			"dummykey",
+			"datadog.nozzle.",
+			"test-deployment",
+			"dummy-ip",
+			time.Second,
+			10240,
+			nil,
+			logger.FromSteno(gosteno.NewLogger("datadogclient test")),
+		)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	addPoints := func(name string, timestamps ...int64) {
+		for _, timestamp := range timestamps {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(timestamp * int64(time.Second)),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(name),
+					Value: proto.Float64(float64(timestamp)),
+				},
+			})
+		}
+	}
+
+	flush := func() map[string]datadogclient.Metric {
+		Expect(c.PostMetrics()).To(Succeed())
+		series := seriesByName(postedSeries())
+		bodies = nil
+		return series
+	}
+
+	timestamps := func(metric datadogclient.Metric) []int64 {
+		var result []int64
+		for _, point := range metric.Points {
+			result = append(result, point.Timestamp)
+		}
+		return result
+	}
+
+	It("drops the newest points once full", func() {
+		c.SetBufferLimits(3, 0, datadogclient.BufferPolicyDropNewest)
+		addPoints("metric", 1, 2, 3, 4, 5)
+
+		series := flush()
+		Expect(timestamps(series["datadog.nozzle.origin.metric"])).To(Equal([]int64{1, 2, 3}))
+		Expect(series["datadog.nozzle.bufferDroppedPoints"].Points[0].Value).To(Equal(float64(2)))
+		Expect(series["datadog.nozzle.bufferedPoints"].Points[0].Value).To(Equal(float64(3)))
+	})
+
+	It("evicts the oldest points once full", func() {
+		c.SetBufferLimits(3, 0, datadogclient.BufferPolicyDropOldest)
+		addPoints("a", 1, 2)
+		addPoints("b", 3, 4, 5)
+
+		series := flush()
+		Expect(series).ToNot(HaveKey("datadog.nozzle.origin.a"))
+		Expect(timestamps(series["datadog.nozzle.origin.b"])).To(Equal([]int64{3, 4, 5}))
+		Expect(series["datadog.nozzle.bufferDroppedPoints"].Points[0].Value).To(Equal(float64(2)))
+	})
+
+	It("evicts the oldest point across series", func() {
+		c.SetBufferLimits(3, 0, datadogclient.BufferPolicyDropOldest)
+		addPoints("a", 1)
+		addPoints("b", 2)
+		addPoints("a", 3)
+		addPoints("b", 4)
+		addPoints("a", 5)
+
+		series := flush()
+		Expect(timestamps(series["datadog.nozzle.origin.a"])).To(Equal([]int64{3, 5}))
+		Expect(timestamps(series["datadog.nozzle.origin.b"])).To(Equal([]int64{4}))
+	})
+
+	It("downsamples every series once full", func() {
+		c.SetBufferLimits(4, 0, datadogclient.BufferPolicyDownsample)
+		addPoints("metric", 1, 2, 3, 4, 5)
+
+		series := flush()
+		Expect(timestamps(series["datadog.nozzle.origin.metric"])).To(Equal([]int64{2, 4, 5}))
+		Expect(series["datadog.nozzle.bufferDroppedPoints"].Points[0].Value).To(Equal(float64(2)))
+	})
+
+	It("falls back to dropping new points when downsampling frees nothing", func() {
+		c.SetBufferLimits(2, 0, datadogclient.BufferPolicyDownsample)
+		addPoints("a", 1)
+		addPoints("b", 2)
+		addPoints("c", 3)
+
+		series := flush()
+		Expect(series).To(HaveKey("datadog.nozzle.origin.a"))
+		Expect(series).To(HaveKey("datadog.nozzle.origin.b"))
+		Expect(series).ToNot(HaveKey("datadog.nozzle.origin.c"))
+	})
+
+	It("limits the estimated bytes held", func() {
+		c.SetBufferLimits(0, 512, datadogclient.BufferPolicyDropNewest)
+		for i := int64(1); i <= 100; i++ {
+			addPoints("metric", i)
+		}
+
+		series := flush()
+		kept := len(series["datadog.nozzle.origin.metric"].Points)
+		Expect(kept).To(BeNumerically(">", 0))
+		Expect(kept).To(BeNumerically("<", 100))
+		Expect(series["datadog.nozzle.bufferDroppedPoints"].Points[0].Value).To(Equal(float64(100 - kept)))
+	})
+
+	It("starts empty again after a flush", func() {
+		c.SetBufferLimits(2, 0, datadogclient.BufferPolicyDropNewest)
+		addPoints("metric", 1, 2, 3)
+		flush()
+
+		addPoints("metric", 4, 5)
+		series := flush()
+		Expect(timestamps(series["datadog.nozzle.origin.metric"])).To(Equal([]int64{4, 5}))
+		Expect(series["datadog.nozzle.bufferDroppedPoints"].Points[0].Value).To(Equal(float64(0)))
+	})
+
+	It("does not report buffer metrics without limits", func() {
+		addPoints("metric", 1)
+
+		Expect(flush()).ToNot(HaveKey("datadog.nozzle.bufferedPoints"))
+	})
+})
@@ -0,0 +1,71 @@
+package datadogclient
+
+import "time"
+
+const (
+	CardinalityPolicyDrop     = "drop"
+	CardinalityPolicyCollapse = "collapse"
+)
+
+// CardinalityLimiter caps how many unique tag sets a single metric name may
+// report within a window. The first maxSeries tag sets seen for a name are
+// kept; points for any further tag set are throttled until the window
+// rolls over.
+type CardinalityLimiter struct {
+	maxSeries uint32
+	window    time.Duration
+	policy    string
+
+	windowStart time.Time
+	seen        map[string]map[uint64]struct{}
+	throttled   map[string]uint64
+}
+
+func NewCardinalityLimiter(maxSeries uint32, window time.Duration, policy string) *CardinalityLimiter {
+	return &CardinalityLimiter{
+		maxSeries: maxSeries,
+		window:    window,
+		policy:    policy,
+		seen:      make(map[string]map[uint64]struct{}),
+		throttled: make(map[string]uint64),
+	}
+}
+
+// Allow reports whether a point for the series identified by name and
+// tagsHash is within the limit.
+func (l *CardinalityLimiter) Allow(name string, tagsHash uint64, now time.Time) bool {
+	if now.Sub(l.windowStart) >= l.window {
+		l.windowStart = now
+		l.seen = make(map[string]map[uint64]struct{})
+	}
+
+	series, ok := l.seen[name]
+	if !ok {
+		series = make(map[uint64]struct{})
+		l.seen[name] = series
+	}
+	if _, ok := series[tagsHash]; ok {
+		return true
+	}
+	if uint32(len(series)) < l.maxSeries {
+		series[tagsHash] = struct{}{}
+		return true
+	}
+
+	l.throttled[name]++
+	return false
+}
+
+// Collapse reports whether throttled points should be kept with reduced
+// tags rather than dropped.
+func (l *CardinalityLimiter) Collapse() bool {
+	return l.policy == CardinalityPolicyCollapse
+}
+
+// Throttled returns how many points were throttled for each metric name
+// since the last call.
+func (l *CardinalityLimiter) Throttled() map[string]uint64 {
+	throttled := l.throttled
+	l.throttled = make(map[string]uint64)
+	return throttled
+}
@@ -0,0 +1,54 @@
+package datadogclient_test
+
+import (
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CardinalityLimiter", func() {
+	var (
+		limiter *datadogclient.CardinalityLimiter
+		now     time.Time
+	)
+
+	BeforeEach(func() {
+		limiter = datadogclient.NewCardinalityLimiter(2, time.Minute, datadogclient.CardinalityPolicyDrop)
+		now = time.Unix(1000, 0)
+	})
+
+	It("allows up to the limit of tag sets per metric", func() {
+		Expect(limiter.Allow("metric", 1, now)).To(BeTrue())
+		Expect(limiter.Allow("metric", 2, now)).To(BeTrue())
+		Expect(limiter.Allow("metric", 3, now)).To(BeFalse())
+		Expect(limiter.Allow("other", 3, now)).To(BeTrue())
+	})
+
+	It("keeps allowing tag sets it has already seen", func() {
+		limiter.Allow("metric", 1, now)
+		limiter.Allow("metric", 2, now)
+
+		Expect(limiter.Allow("metric", 1, now)).To(BeTrue())
+		Expect(limiter.Allow("metric", 2, now)).To(BeTrue())
+	})
+
+	It("forgets tag sets once the window rolls over", func() {
+		limiter.Allow("metric", 1, now)
+		limiter.Allow("metric", 2, now)
+		Expect(limiter.Allow("metric", 3, now.Add(59*time.Second))).To(BeFalse())
+
+		Expect(limiter.Allow("metric", 3, now.Add(time.Minute))).To(BeTrue())
+	})
+
+	It("reports throttled points per metric once", func() {
+		limiter.Allow("metric", 1, now)
+		limiter.Allow("metric", 2, now)
+		limiter.Allow("metric", 3, now)
+		limiter.Allow("metric", 4, now)
+
+		Expect(limiter.Throttled()).To(Equal(map[string]uint64{"metric": 2}))
+		Expect(limiter.Throttled()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,98 @@
+package datadogclient
+
+import "time"
+
+type BreakerState int
+
+// The states are reported as the circuitBreakerState internal metric.
+const (
+	BreakerClosed   BreakerState = 0
+	BreakerHalfOpen BreakerState = 1
+	BreakerOpen     BreakerState = 2
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+type circuitBreaker struct {
+	maxFailures uint32
+	cooldown    time.Duration
+
+	state     BreakerState
+	failures  uint32
+	openUntil time.Time
+}
+
+// SetCircuitBreaker stops posting to Datadog for cooldown after maxFailures
+// consecutive requests have failed, rather than waiting for every request
+// of every flush to time out during an outage. Metrics, events and service
+// checks stay buffered in the meantime. After the cooldown, the next
+// request is a probe: it closes the breaker if it succeeds and opens it
+// again if it fails.
+//
+// With the breaker set, PostMetrics logs failed requests and retries them
+// at the next flush instead of returning an error. A maxFailures of 0
+// disables it.
+func (c *Client) SetCircuitBreaker(maxFailures uint32, cooldown time.Duration) {
+	c.breaker = circuitBreaker{
+		maxFailures: maxFailures,
+		cooldown:    cooldown,
+	}
+}
+
+func (b *circuitBreaker) enabled() bool {
+	return b.maxFailures > 0
+}
+
+// breakerAllows reports whether the client may post, moving an open
+// breaker whose cooldown has passed to half-open.
+func (c *Client) breakerAllows() bool {
+	if c.breaker.state != BreakerOpen {
+		return true
+	}
+	if time.Now().Before(c.breaker.openUntil) {
+		return false
+	}
+	c.breaker.state = BreakerHalfOpen
+	c.log.Info("Circuit breaker cooldown is over, probing the Datadog API")
+	return true
+}
+
+// breakerSucceeded records a request Datadog answered.
+func (c *Client) breakerSucceeded() {
+	if c.breaker.state != BreakerClosed {
+		c.log.Info("Datadog API is answering again, closing the circuit breaker")
+	}
+	c.breaker.state = BreakerClosed
+	c.breaker.failures = 0
+}
+
+// breakerFailed records a failed request, opening the breaker after too
+// many in a row or when a probe fails.
+func (c *Client) breakerFailed(err error) {
+	c.breaker.failures++
+	if c.breaker.state == BreakerClosed && c.breaker.failures < c.breaker.maxFailures {
+		c.log.Errorf("Error posting to Datadog (%d of %d consecutive failures before the circuit breaker opens), keeping metrics buffered: %s", c.breaker.failures, c.breaker.maxFailures, err)
+		return
+	}
+
+	c.breaker.state = BreakerOpen
+	c.breaker.openUntil = time.Now().Add(c.breaker.cooldown)
+	c.log.Errorf("Opening the circuit breaker after %d consecutive failures to post to Datadog, keeping metrics buffered for %s: %s", c.breaker.failures, c.breaker.cooldown, err)
+}
+
+func (c *Client) addBreakerMetrics() {
+	if !c.breaker.enabled() {
+		return
+	}
+	c.addInternalMetric("circuitBreakerState", uint64(c.breaker.state))
+	c.addInternalMetric("circuitBreakerFailures", uint64(c.breaker.failures))
+}
@@ -0,0 +1,140 @@
+package datadogclient_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Circuit breaker", func() {
+	const cooldown = 200 * time.Millisecond
+
+	var (
+		ts *httptest.Server
+		c  *datadogclient.Client
+	)
+
+	BeforeEach(func() {
+		bodies = nil
+		reqs = make(chan *http.Request, 1000)
+		responseCode = http.StatusServiceUnavailable
+		responseBody = nil
+		ts = httptest.NewServer(http.HandlerFunc(handlePost))
+		c = datadogclient.New(
+			ts.URL+"/api/v1/series",
+			"dummykey",
+			"datadog.nozzle.",
+			"test-deployment",
+			"dummy-ip",
+			time.Second,
+			1024,
+			nil,
+			logger.FromSteno(gosteno.NewLogger("datadogclient test")),
+		)
+		c.SetCircuitBreaker(2, cooldown)
+
+		// Enough series for several requests per flush.
+		for i := 0; i < 30; i++ {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(fmt.Sprintf("metric%d", i)),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	// seriesValue is the first posted value of the named series, or -1.
+	seriesValue := func(name string) float64 {
+		for _, metric := range postedSeries() {
+			if metric.Metric == "datadog.nozzle."+name {
+				return metric.Points[0].Value
+			}
+		}
+		return -1
+	}
+
+	openBreaker := func() {
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(reqs).To(HaveLen(2), "each failed flush stops at its first request")
+	}
+
+	It("stops posting once it opens", func() {
+		openBreaker()
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(reqs).To(HaveLen(2))
+	})
+
+	It("posts the buffered metrics when a probe succeeds after the cooldown", func() {
+		openBreaker()
+		time.Sleep(cooldown)
+		responseCode = http.StatusOK
+		bodies = nil
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(len(reqs)).To(BeNumerically(">", 3))
+		Expect(seriesValue("origin.metric29")).To(BeEquivalentTo(5))
+		Expect(seriesValue("circuitBreakerState")).To(BeEquivalentTo(datadogclient.BreakerHalfOpen))
+		Expect(seriesValue("circuitBreakerFailures")).To(BeEquivalentTo(2))
+
+		bodies = nil
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(seriesValue("circuitBreakerState")).To(BeEquivalentTo(datadogclient.BreakerClosed))
+		Expect(seriesValue("circuitBreakerFailures")).To(BeEquivalentTo(0))
+		Expect(seriesValue("origin.metric29")).To(BeEquivalentTo(-1))
+	})
+
+	It("opens again when a probe fails", func() {
+		openBreaker()
+		time.Sleep(cooldown)
+		bodies = nil
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(reqs).To(HaveLen(3), "the probe is the first request of the flush alone")
+		Expect(bodies).To(HaveLen(1))
+		Expect(len(bodies[0])).To(BeNumerically("<=", 1024))
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(reqs).To(HaveLen(3))
+	})
+
+	It("posts everything on a final flush while it is open", func() {
+		openBreaker()
+		responseCode = http.StatusOK
+		bodies = nil
+
+		Expect(c.Flush()).To(Succeed())
+		Expect(seriesValue("origin.metric29")).To(BeEquivalentTo(5))
+	})
+
+	It("returns the error of a final flush that fails", func() {
+		openBreaker()
+
+		Expect(c.Flush()).To(MatchError(ContainSubstring("503 Service Unavailable")))
+		Expect(reqs).To(HaveLen(3))
+	})
+
+	It("returns errors when it is disabled", func() {
+		c.SetCircuitBreaker(0, cooldown)
+
+		Expect(c.PostMetrics()).To(MatchError(ContainSubstring("503 Service Unavailable")))
+	})
+})
@@ -1,18 +1,13 @@
 package datadogclient
 
 import (
-	"bytes"
-	"crypto/sha1"
 	"fmt"
 	"net/http"
-	"sort"
 	"time"
 
 	"errors"
 
-	"io/ioutil"
-
-	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
@@ -23,21 +18,42 @@ type Client struct {
 	apiKey                string
 	metricPoints          map[MetricKey]MetricValue
 	prefix                string
+	customTags            []string
 	deployment            string
 	ip                    string
-	tagsHash              string
+	tagsHash              uint64
 	totalMessagesReceived uint64
 	totalMetricsSent      uint64
 	httpClient            *http.Client
 	maxPostBytes          uint32
-	log                   *gosteno.Logger
+	log                   logger.Logger
 	formatter             Formatter
+	cardinalityLimiter    *CardinalityLimiter
+	throttledPoints       map[string]uint64
+	interned              *interner
+
+	limits         bufferLimits
+	bufferedPoints uint64
+	bufferedBytes  uint64
+	droppedPoints  uint64
+	oldest         oldestSeries
+
+	oversizedPoints uint64
+	runtime         runtimeStats
+	dryRun          dryRun
+	serviceChecks   map[string]ServiceCheck
+	events          []Event
+	droppedEvents   uint64
+	rateLimit       rateLimit
+	breaker         circuitBreaker
 }
 
+// MetricKey identifies a series. TagsHash is a 64-bit hash of its sorted
+// tags, which the client keeps unique among the series it buffers.
 type MetricKey struct {
 	EventType events.Envelope_EventType
 	Name      string
-	TagsHash  string
+	TagsHash  uint64
 }
 
 type MetricValue struct {
@@ -70,7 +86,8 @@ func New(
 	ip string,
 	writeTimeout time.Duration,
 	maxPostBytes uint32,
-	log *gosteno.Logger,
+	transport http.RoundTripper,
+	log logger.Logger,
 ) *Client {
 	ourTags := []string{
 		"deployment:" + deployment,
@@ -78,7 +95,8 @@ func New(
 	}
 
 	httpClient := &http.Client{
-		Timeout: writeTimeout,
+		Timeout:   writeTimeout,
+		Transport: transport,
 	}
 
 	return &Client{
@@ -88,14 +106,31 @@ func New(
 		prefix:       prefix,
 		deployment:   deployment,
 		ip:           ip,
-		log:          log,
+		log:          log.With("destination", apiURL),
 		tagsHash:     hashTags(ourTags),
 		httpClient:   httpClient,
 		maxPostBytes: maxPostBytes,
 		formatter:    Formatter{},
+		interned:     newInterner(),
 	}
 }
 
+func (c *Client) SetAPIKey(apiKey string) {
+	c.apiKey = apiKey
+}
+
+func (c *Client) SetPrefix(prefix string) {
+	c.prefix = prefix
+}
+
+func (c *Client) SetCustomTags(tags []string) {
+	c.customTags = tags
+}
+
+func (c *Client) SetCardinalityLimiter(limiter *CardinalityLimiter) {
+	c.cardinalityLimiter = limiter
+}
+
 func (c *Client) AlertSlowConsumerError() {
 	c.addInternalMetric("slowConsumerAlert", uint64(1))
 }
@@ -106,14 +141,28 @@ func (c *Client) AddMetric(envelope *events.Envelope) {
 		return
 	}
 
-	tags := parseTags(envelope)
+	name := c.interned.name(envelope.GetOrigin(), getName(envelope))
+	tags, tagsHash := c.interned.tags(envelope, c.customTags)
+	if c.cardinalityLimiter != nil && !c.cardinalityLimiter.Allow(name, tagsHash, time.Now()) {
+		if !c.cardinalityLimiter.Collapse() {
+			return
+		}
+		tags = append(collapsedTags(envelope), c.customTags...)
+		tagsHash = c.interned.key(tags)
+	}
+
 	key := MetricKey{
 		EventType: envelope.GetEventType(),
-		Name:      getName(envelope),
-		TagsHash:  hashTags(tags),
+		Name:      name,
+		TagsHash:  tagsHash,
 	}
 
-	mVal := c.metricPoints[key]
+	if !c.makeRoom(key, tags) {
+		c.droppedPoints++
+		return
+	}
+
+	mVal, exists := c.metricPoints[key]
 	value := getValue(envelope)
 
 	mVal.Tags = tags
@@ -123,55 +172,136 @@ func (c *Client) AddMetric(envelope *events.Envelope) {
 	})
 
 	c.metricPoints[key] = mVal
+	c.trackPoint(key, tags, !exists)
 }
 
+// PostMetrics posts the buffered metrics, then the service checks and
+// events. While Datadog is rate limiting the client, or the circuit breaker
+// is open, it posts nothing and keeps everything buffered for a later
+// flush.
 func (c *Client) PostMetrics() error {
+	return c.post(false)
+}
+
+// Flush makes one last attempt to post everything buffered before the
+// nozzle exits, regardless of the rate limit and the circuit breaker.
+// Whatever it cannot post is dropped and counted in the log.
+func (c *Client) Flush() error {
+	return c.post(true)
+}
+
+func (c *Client) post(final bool) error {
+	if !final && c.dryRun.out == nil && c.throttled() {
+		c.log.Infof("Waiting for the Datadog rate limit to lift, keeping %d metrics buffered", len(c.metricPoints))
+		return nil
+	}
+	if !final && c.dryRun.out == nil && !c.breakerAllows() {
+		c.log.Infof("Circuit breaker is open, keeping %d metrics buffered", len(c.metricPoints))
+		return nil
+	}
+
 	c.populateInternalMetrics()
 	numMetrics := len(c.metricPoints)
 	c.log.Infof("Posting %d metrics", numMetrics)
 
-	c.totalMetricsSent += uint64(len(c.metricPoints))
-	seriesBytes := c.formatter.Format(c.prefix, c.maxPostBytes, c.metricPoints)
-	c.metricPoints = make(map[MetricKey]MetricValue)
+	result := c.formatter.format(c.prefix, c.maxPostBytes, c.metricPoints)
+	for name, series := range result.truncated {
+		c.log.Warnf("Truncated the tags of %d series of %s to fit in %d bytes", series, name, c.maxPostBytes)
+	}
 
-	for _, data := range seriesBytes {
-		if uint32(len(data)) > c.maxPostBytes {
-			c.log.Infof("Throwing out metric that exceeds %d bytes", c.maxPostBytes)
-			continue
-		}
+	if c.dryRun.out != nil {
+		c.flushed(numMetrics, result.oversized)
+		return c.writeDryRun(result.payloads)
+	}
 
+	// A half-open breaker is probed with the first request alone, and the
+	// rest of the flush is only posted once Datadog answers it.
+	for i, data := range result.payloads {
 		if err := c.postMetrics(data); err != nil {
+			c.dropPosted(result, i)
+			if final {
+				c.dropFinal(c.countPoints(), len(c.events), len(c.serviceChecks), err)
+				return err
+			}
+			if c.deferPost(err) {
+				return nil
+			}
+			c.flushed(numMetrics, result.oversized)
 			return err
 		}
 	}
-
+	c.flushed(numMetrics, result.oversized)
+
+	// The metrics are in, so a failed service check or event is only
+	// logged. Checks are posted again at every flush and events stay queued.
+	what := "service checks"
+	checks := len(c.serviceChecks)
+	err := c.postServiceChecks()
+	if err == nil {
+		what = "events"
+		checks = 0
+		err = c.postEvents()
+	}
+	if err == nil {
+		c.rateLimitLifted()
+	} else if final {
+		c.dropFinal(0, len(c.events), checks, err)
+		return err
+	} else if !c.deferPost(err) {
+		c.log.Errorf("Error posting %s: %s", what, err)
+	}
 	return nil
 }
 
-func (c *Client) postMetrics(seriesBytes []byte) error {
-	url := c.seriesURL()
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(seriesBytes))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return err
+// dropFinal logs what a failed Flush leaves unposted.
+func (c *Client) dropFinal(points, events, checks int, err error) {
+	c.log.Errorf("Could not post the final flush, dropping %d points, %d events and %d service checks: %s", points, events, checks, err)
+}
+
+func (c *Client) countPoints() int {
+	var points int
+	for _, mVal := range c.metricPoints {
+		points += len(mVal.Points)
 	}
-	defer resp.Body.Close()
+	return points
+}
 
-	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			body = []byte("failed to read body")
-		}
-		return fmt.Errorf("datadog request returned HTTP response: %s\nResponse Body: %s", resp.Status, body)
+// deferPost reports whether a failed request is retried at a later flush,
+// with everything not yet accepted kept buffered, instead of failing
+// PostMetrics.
+func (c *Client) deferPost(err error) bool {
+	if rateErr, ok := err.(*RateLimitError); ok {
+		c.breakerSucceeded()
+		c.rateLimited(rateErr)
+		return true
 	}
+	if c.breaker.enabled() {
+		c.breakerFailed(err)
+		return true
+	}
+	return false
+}
 
-	return nil
+// flushed empties the buffer once its metrics have been posted. The drop
+// counters went out with them, so they start again from zero. A deferred
+// flush keeps them, and the next one reports the total.
+func (c *Client) flushed(numMetrics int, oversized map[string]int) {
+	c.totalMetricsSent += uint64(numMetrics)
+	c.resetBuffer()
+	c.interned.reset()
+	c.oversizedPoints = 0
+	c.droppedEvents = 0
+	c.droppedPoints = 0
+	c.throttledPoints = nil
+
+	for name, points := range oversized {
+		c.log.Errorf("Dropping %d points of %s: a single point of the series does not fit in %d bytes", points, name, c.maxPostBytes)
+		c.oversizedPoints += uint64(points)
+	}
 }
 
-func (c *Client) seriesURL() string {
-	url := fmt.Sprintf("%s?api_key=%s", c.apiURL, c.apiKey)
-	return url
+func (c *Client) postMetrics(seriesBytes []byte) error {
+	return c.postJSON(c.apiURL, seriesBytes)
 }
 
 func (c *Client) populateInternalMetrics() {
@@ -181,6 +311,43 @@ func (c *Client) populateInternalMetrics() {
 	if !c.containsSlowConsumerAlert() {
 		c.addInternalMetric("slowConsumerAlert", uint64(0))
 	}
+
+	if c.runtime.enabled {
+		c.addRuntimeMetrics()
+	}
+
+	c.addThrottleMetric()
+	c.addBreakerMetrics()
+
+	if c.oversizedPoints > 0 {
+		c.addInternalMetric("oversizedPointsDropped", c.oversizedPoints)
+	}
+
+	if c.droppedEvents > 0 {
+		c.log.Warnf("Event queue is full, dropped the %d oldest events since the last flush", c.droppedEvents)
+		c.addInternalMetric("droppedEvents", c.droppedEvents)
+	}
+
+	if c.limits.maxPoints > 0 || c.limits.maxBytes > 0 {
+		if c.droppedPoints > 0 {
+			c.log.Warnf("Metric buffer is full, dropped %d points since the last flush with policy %s", c.droppedPoints, c.limits.policy)
+		}
+		c.addInternalMetric("bufferedPoints", c.bufferedPoints)
+		c.addInternalMetric("bufferDroppedPoints", c.droppedPoints)
+	}
+
+	if c.cardinalityLimiter != nil {
+		for name, points := range c.cardinalityLimiter.Throttled() {
+			c.log.Warnf("Metric %s%s has too many unique tag sets, throttled %d points", c.prefix, name, points)
+			if c.throttledPoints == nil {
+				c.throttledPoints = make(map[string]uint64)
+			}
+			c.throttledPoints[name] += points
+		}
+		for name, points := range c.throttledPoints {
+			c.addThrottledMetric(name, points)
+		}
+	}
 }
 
 func (c *Client) containsSlowConsumerAlert() bool {
@@ -204,22 +371,51 @@ func (c *Client) addInternalMetric(name string, value uint64) {
 	}
 
 	mValue := MetricValue{
-		Tags: []string{
-			fmt.Sprintf("ip:%s", c.ip),
-			fmt.Sprintf("deployment:%s", c.deployment),
-		},
+		Tags:   c.internalTags(),
 		Points: []Point{point},
 	}
 
 	c.metricPoints[key] = mValue
 }
 
+// SetInternalMetric reports value as an internal metric at the next flush,
+// with tags added to the internal tags. Setting it again before the flush
+// replaces the value.
+func (c *Client) SetInternalMetric(name string, value uint64, tags ...string) {
+	tags = append(c.internalTags(), tags...)
+	key := MetricKey{
+		Name:     name,
+		TagsHash: c.interned.key(tags),
+	}
+
+	c.metricPoints[key] = MetricValue{
+		Tags: tags,
+		Points: []Point{{
+			Timestamp: time.Now().Unix(),
+			Value:     float64(value),
+		}},
+	}
+}
+
+// addThrottledMetric reports the points the cardinality limiter throttled
+// for one metric, tagged with the name of that metric.
+func (c *Client) addThrottledMetric(metricName string, points uint64) {
+	c.SetInternalMetric("cardinalityThrottled", points, "metric:"+c.prefix+metricName)
+}
+
+func (c *Client) internalTags() []string {
+	return append([]string{
+		fmt.Sprintf("ip:%s", c.ip),
+		fmt.Sprintf("deployment:%s", c.deployment),
+	}, c.customTags...)
+}
+
 func getName(envelope *events.Envelope) string {
 	switch envelope.GetEventType() {
 	case events.Envelope_ValueMetric:
-		return envelope.GetOrigin() + "." + envelope.GetValueMetric().GetName()
+		return envelope.GetValueMetric().GetName()
 	case events.Envelope_CounterEvent:
-		return envelope.GetOrigin() + "." + envelope.GetCounterEvent().GetName()
+		return envelope.GetCounterEvent().GetName()
 	default:
 		panic("Unknown event type")
 	}
@@ -236,20 +432,17 @@ func getValue(envelope *events.Envelope) float64 {
 	}
 }
 
-func parseTags(envelope *events.Envelope) []string {
+// collapsedTags keeps only the low cardinality envelope tags, so that every
+// throttled series of a metric lands in one series per deployment and job.
+func collapsedTags(envelope *events.Envelope) []string {
 	tags := appendTagIfNotEmpty(nil, "deployment", envelope.GetDeployment())
 	tags = appendTagIfNotEmpty(tags, "job", envelope.GetJob())
-	tags = appendTagIfNotEmpty(tags, "index", envelope.GetIndex())
-	tags = appendTagIfNotEmpty(tags, "ip", envelope.GetIp())
-	for tname, tvalue := range envelope.GetTags() {
-		tags = appendTagIfNotEmpty(tags, tname, tvalue)
-	}
-	return tags
+	return append(tags, "cardinality_limited:true")
 }
 
 func appendTagIfNotEmpty(tags []string, key, value string) []string {
 	if value != "" {
-		tags = append(tags, fmt.Sprintf("%s:%s", key, value))
+		tags = append(tags, key+":"+value)
 	}
 	return tags
 }
@@ -275,13 +468,3 @@ func (p *Point) UnmarshalJSON(in []byte) error {
 
 	return nil
 }
-
-func hashTags(tags []string) string {
-	sort.Strings(tags)
-	hash := ""
-	for _, tag := range tags {
-		tagHash := sha1.Sum([]byte(tag))
-		hash += string(tagHash[:])
-	}
-	return hash
-}
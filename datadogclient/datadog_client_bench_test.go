@@ -0,0 +1,91 @@
+package datadogclient_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// Run with: go test ./datadogclient/ -run XXX -bench . -benchmem
+
+func benchmarkClient(b *testing.B, url string) *datadogclient.Client {
+	c := datadogclient.New(
+		url,
+		"dummykey",
+		"datadog.nozzle.",
+		"test-deployment",
+		"dummy-ip",
+		time.Second,
+		57671680,
+		nil,
+		logger.FromSteno(gosteno.NewLogger("datadogclient benchmark")),
+	)
+	c.SetCustomTags([]string{"env:prod", "foundation:us-east"})
+	return c
+}
+
+func benchmarkEnvelopes(series int) []*events.Envelope {
+	envelopes := make([]*events.Envelope, series)
+	for i := range envelopes {
+		envelopes[i] = &events.Envelope{
+			Origin:    proto.String("gorouter"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String(fmt.Sprintf("latency.%d", i%10)),
+				Value: proto.Float64(float64(i)),
+			},
+			Deployment: proto.String("cf"),
+			Job:        proto.String("router"),
+			Index:      proto.String(fmt.Sprint(i / 10)),
+			Ip:         proto.String("10.0.1.2"),
+			Tags:       map[string]string{"component": "route-emitter", "zone": "z1"},
+		}
+	}
+	return envelopes
+}
+
+func benchmarkAddMetric(b *testing.B, series int) {
+	c := benchmarkClient(b, "http://localhost")
+	envelopes := benchmarkEnvelopes(series)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.AddMetric(envelopes[i%len(envelopes)])
+	}
+}
+
+func BenchmarkAddMetricOneSeries(b *testing.B)    { benchmarkAddMetric(b, 1) }
+func BenchmarkAddMetric1000Series(b *testing.B)   { benchmarkAddMetric(b, 1000) }
+func BenchmarkAddMetric100000Series(b *testing.B) { benchmarkAddMetric(b, 100000) }
+
+func BenchmarkPostMetrics(b *testing.B) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	c := benchmarkClient(b, ts.URL)
+	envelopes := benchmarkEnvelopes(1000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, envelope := range envelopes {
+			c.AddMetric(envelope)
+		}
+		if err := c.PostMetrics(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
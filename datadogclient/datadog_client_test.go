@@ -1,13 +1,17 @@
 package datadogclient_test
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
 	"strings"
 	"time"
 
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
 	"github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gogo/protobuf/proto"
@@ -15,13 +19,15 @@ import (
 	. "github.com/onsi/gomega"
 
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/testhelpers"
 )
 
 var (
-	bodies       [][]byte
-	reqs         chan *http.Request
-	responseCode int
-	responseBody []byte
+	bodies          [][]byte
+	reqs            chan *http.Request
+	responseCode    int
+	responseBody    []byte
+	responseHeaders http.Header
 )
 
 var _ = Describe("DatadogClient", func() {
@@ -44,7 +50,8 @@ var _ = Describe("DatadogClient", func() {
 			"dummy-ip",
 			time.Second,
 			1024,
-			gosteno.NewLogger("datadogclient test"),
+			nil,
+			logger.FromSteno(gosteno.NewLogger("datadogclient test")),
 		)
 	})
 
@@ -62,7 +69,8 @@ var _ = Describe("DatadogClient", func() {
 				"dummy-ip",
 				time.Millisecond,
 				1024,
-				gosteno.NewLogger("datadogclient test"),
+				nil,
+				logger.FromSteno(gosteno.NewLogger("datadogclient test")),
 			)
 		})
 
@@ -87,6 +95,33 @@ var _ = Describe("DatadogClient", func() {
 		})
 	})
 
+	Context("datadog is served over TLS with a private CA", func() {
+		BeforeEach(func() {
+			ca := testhelpers.NewFakeCertificateAuthority()
+			ts = httptest.NewUnstartedServer(http.HandlerFunc(handlePost))
+			ts.TLS = ca.ServerTLSConfig()
+			ts.StartTLS()
+
+			c = datadogclient.New(
+				ts.URL,
+				"dummykey",
+				"datadog.nozzle.",
+				"test-deployment",
+				"dummy-ip",
+				time.Second,
+				1024,
+				&http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.CertPool()}},
+				logger.FromSteno(gosteno.NewLogger("datadogclient test")),
+			)
+		})
+
+		It("posts using the provided transport", func() {
+			err := c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(reqs).Should(Receive())
+		})
+	})
+
 	It("sets Content-Type header when making POST requests", func() {
 		c.AddMetric(&events.Envelope{
 			Origin:    proto.String("test-origin"),
@@ -148,6 +183,166 @@ var _ = Describe("DatadogClient", func() {
 		))
 	})
 
+	It("adds custom tags to every series", func() {
+		c.SetCustomTags([]string{"env:prod", "foundation:east"})
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("test-origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+			Deployment: proto.String("deployment-name"),
+		})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		var payload datadogclient.Payload
+		err = json.Unmarshal(bodies[0], &payload)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(payload.Series).To(ContainMetricWithTags(
+			"datadog.nozzle.test-origin.metricName",
+			"deployment:deployment-name",
+			"env:prod",
+			"foundation:east",
+		))
+		Expect(payload.Series).To(ContainMetricWithTags(
+			"datadog.nozzle.totalMessagesReceived",
+			"ip:dummy-ip",
+			"deployment:test-deployment",
+			"env:prod",
+			"foundation:east",
+		))
+	})
+
+	Context("with a cardinality limit", func() {
+		BeforeEach(func() {
+			c = datadogclient.New(
+				ts.URL,
+				"dummykey",
+				"datadog.nozzle.",
+				"test-deployment",
+				"dummy-ip",
+				time.Second,
+				10240,
+				nil,
+				logger.FromSteno(gosteno.NewLogger("datadogclient test")),
+			)
+		})
+
+		addRequest := func(requestID string) {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("gorouter"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("latency"),
+					Value: proto.Float64(5),
+				},
+				Deployment: proto.String("cf"),
+				Job:        proto.String("router"),
+				Index:      proto.String("0"),
+				Tags:       map[string]string{"request_id": requestID},
+			})
+		}
+
+		countSeries := func(series []datadogclient.Metric, name string) int {
+			count := 0
+			for _, metric := range series {
+				if metric.Metric == name {
+					count++
+				}
+			}
+			return count
+		}
+
+		It("collapses tag sets beyond the limit into one series", func() {
+			c.SetCardinalityLimiter(datadogclient.NewCardinalityLimiter(2, time.Hour, datadogclient.CardinalityPolicyCollapse))
+			for i := 0; i < 5; i++ {
+				addRequest(fmt.Sprintf("request-%d", i))
+			}
+
+			Expect(c.PostMetrics()).To(Succeed())
+			series := postedSeries()
+			Expect(countSeries(series, "datadog.nozzle.gorouter.latency")).To(Equal(3))
+
+			var collapsed datadogclient.Metric
+			for _, metric := range series {
+				if metric.Metric == "datadog.nozzle.gorouter.latency" && len(metric.Points) == 3 {
+					collapsed = metric
+				}
+			}
+			Expect(collapsed.Tags).To(ConsistOf("deployment:cf", "job:router", "cardinality_limited:true"))
+
+			Expect(series).To(ContainMetricWithTags(
+				"datadog.nozzle.cardinalityThrottled",
+				"ip:dummy-ip",
+				"deployment:test-deployment",
+				"metric:datadog.nozzle.gorouter.latency",
+			))
+		})
+
+		It("drops tag sets beyond the limit", func() {
+			c.SetCardinalityLimiter(datadogclient.NewCardinalityLimiter(2, time.Hour, datadogclient.CardinalityPolicyDrop))
+			for i := 0; i < 5; i++ {
+				addRequest(fmt.Sprintf("request-%d", i))
+			}
+
+			Expect(c.PostMetrics()).To(Succeed())
+			series := postedSeries()
+			Expect(countSeries(series, "datadog.nozzle.gorouter.latency")).To(Equal(2))
+
+			var throttled datadogclient.Metric
+			Expect(series).To(ContainMetric("datadog.nozzle.cardinalityThrottled", &throttled))
+			Expect(throttled.Points[0].Value).To(Equal(float64(3)))
+		})
+	})
+
+	It("uses the latest API key when posting", func() {
+		c.SetAPIKey("rotated-key")
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		var req *http.Request
+		Eventually(reqs).Should(Receive(&req))
+		Expect(req.Header.Get("DD-API-KEY")).To(Equal("rotated-key"))
+	})
+
+	It("keeps the API key out of the errors of failed requests", func() {
+		ts.Close()
+
+		err := c.PostMetrics()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).ToNot(ContainSubstring("dummykey"))
+	})
+
+	It("uses the latest prefix when posting", func() {
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("test-origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+		c.SetPrefix("new.prefix.")
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(bodies).Should(HaveLen(1))
+		var payload datadogclient.Payload
+		err = json.Unmarshal(bodies[0], &payload)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(payload.Series).To(ContainMetric("new.prefix.test-origin.metricName", nil))
+		Expect(payload.Series).ToNot(ContainMetric("datadog.nozzle.test-origin.metricName", nil))
+	})
+
 	It("uses tags as an identifier for batching purposes", func() {
 		c.AddMetric(&events.Envelope{
 			Origin:    proto.String("test-origin"),
@@ -377,11 +572,160 @@ var _ = Describe("DatadogClient", func() {
 		err := c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 
-		f := func() int {
-			return len(bodies)
+		var payload datadogclient.Payload
+		Expect(bodies).ToNot(BeEmpty())
+		for _, body := range bodies {
+			Expect(json.Unmarshal(body, &payload)).To(Succeed())
+			Expect(payload.Series).ToNot(ContainMetric("datadog.nozzle.origin."+strings.Repeat("some-big-name", 1000), nil))
 		}
 
-		Consistently(f).Should(Equal(0))
+		bodies = nil
+		err = c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		var dropped datadogclient.Metric
+		var series []datadogclient.Metric
+		for _, body := range bodies {
+			Expect(json.Unmarshal(body, &payload)).To(Succeed())
+			series = append(series, payload.Series...)
+		}
+		Expect(series).To(ContainMetric("datadog.nozzle.oversizedPointsDropped", &dropped))
+		Expect(dropped.Points[0].Value).To(Equal(1.0))
+	})
+
+	It("packs every series into payloads no larger than FlushMaxBytes", func() {
+		for i := 0; i < 100; i++ {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(fmt.Sprintf("metricName%d", i)),
+					Value: proto.Float64(5),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+			})
+		}
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		series := 0
+		for _, body := range bodies {
+			Expect(len(body)).To(BeNumerically("<=", 1024))
+
+			var payload datadogclient.Payload
+			Expect(json.Unmarshal(body, &payload)).To(Succeed())
+			for _, metric := range payload.Series {
+				if strings.HasPrefix(metric.Metric, "datadog.nozzle.origin.metricName") {
+					series++
+				}
+			}
+		}
+		Expect(series).To(Equal(100))
+	})
+
+	It("reports the nozzle's runtime stats only when enabled", func() {
+		posted := func() []datadogclient.Metric {
+			bodies = nil
+			Expect(c.PostMetrics()).To(Succeed())
+
+			var series []datadogclient.Metric
+			for _, body := range bodies {
+				var payload datadogclient.Payload
+				Expect(json.Unmarshal(body, &payload)).To(Succeed())
+				series = append(series, payload.Series...)
+			}
+			return series
+		}
+
+		Expect(posted()).ToNot(ContainMetric("datadog.nozzle.runtime.goroutines", nil))
+
+		c.SetRuntimeMetrics(true)
+		runtime.GC()
+
+		var goroutines, heap, numGC datadogclient.Metric
+		series := posted()
+		Expect(series).To(ContainMetric("datadog.nozzle.runtime.goroutines", &goroutines))
+		Expect(series).To(ContainMetric("datadog.nozzle.runtime.heapAlloc", &heap))
+		Expect(series).To(ContainMetric("datadog.nozzle.runtime.numGC", &numGC))
+		Expect(series).To(ContainMetric("datadog.nozzle.runtime.gcPauseMaxNs", nil))
+		Expect(goroutines.Points[0].Value).To(BeNumerically(">", 0))
+		Expect(heap.Points[0].Value).To(BeNumerically(">", 0))
+		Expect(numGC.Points[0].Value).To(BeNumerically(">=", 1))
+	})
+
+	It("reports internal metrics with extra tags, keeping the last value per tag set", func() {
+		c.SetInternalMetric("firehoseConnected", 0, "connection:0")
+		c.SetInternalMetric("firehoseConnected", 1, "connection:0")
+		c.SetInternalMetric("firehoseConnected", 1, "connection:1")
+		Expect(c.PostMetrics()).To(Succeed())
+
+		var payload datadogclient.Payload
+		Expect(json.Unmarshal(bodies[0], &payload)).To(Succeed())
+		Expect(payload.Series).To(ContainMetricWithTags("datadog.nozzle.firehoseConnected", "ip:dummy-ip", "deployment:test-deployment", "connection:0"))
+		connected := 0
+		for _, metric := range payload.Series {
+			if metric.Metric == "datadog.nozzle.firehoseConnected" {
+				connected++
+				Expect(metric.Points).To(HaveLen(1))
+				Expect(metric.Points[0].Value).To(Equal(float64(1)))
+			}
+		}
+		Expect(connected).To(Equal(2))
+	})
+
+	It("sorts envelope and custom tags together and groups points by tag set", func() {
+		c.SetCustomTags([]string{"env:prod"})
+		for i := 0; i < 2; i++ {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000 * int64(i+1)),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+				Tags:       map[string]string{"zone": "z1", "az": "a", "job-type": "web"},
+			})
+		}
+
+		for flush := 0; flush < 2; flush++ {
+			bodies = nil
+			if flush > 0 {
+				c.AddMetric(&events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(3000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String("metricName"),
+						Value: proto.Float64(5),
+					},
+					Deployment: proto.String("deployment-name"),
+					Job:        proto.String("doppler"),
+					Tags:       map[string]string{"az": "a", "job-type": "web", "zone": "z1"},
+				})
+			}
+			Expect(c.PostMetrics()).To(Succeed())
+
+			var payload datadogclient.Payload
+			Expect(json.Unmarshal(bodies[0], &payload)).To(Succeed())
+
+			var metric datadogclient.Metric
+			Expect(payload.Series).To(ContainMetric("datadog.nozzle.origin.metricName", &metric))
+			Expect(metric.Tags).To(Equal([]string{
+				"az:a",
+				"deployment:deployment-name",
+				"env:prod",
+				"job-type:web",
+				"job:doppler",
+				"zone:z1",
+			}))
+			Expect(metric.Points).To(HaveLen(2 - flush))
+		}
 	})
 
 	It("registers metrics with the same name but different tags as different", func() {
@@ -638,6 +982,9 @@ func handlePost(w http.ResponseWriter, r *http.Request) {
 
 	reqs <- r
 	bodies = append(bodies, body)
+	for name, values := range responseHeaders {
+		w.Header()[name] = values
+	}
 	w.WriteHeader(responseCode)
 	w.Write(responseBody)
 }
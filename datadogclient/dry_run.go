@@ -0,0 +1,103 @@
+package datadogclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	DryRunFormatJSON  = "json"
+	DryRunFormatTable = "table"
+)
+
+type dryRun struct {
+	out    io.Writer
+	format string
+}
+
+// SetDryRun makes PostMetrics write the payloads it would have posted to out
+// instead, either as indented JSON or as a table with one row per series,
+// followed by a summary of the flush. A nil out posts to Datadog again.
+func (c *Client) SetDryRun(out io.Writer, format string) {
+	c.dryRun = dryRun{out: out, format: format}
+}
+
+func (c *Client) writeDryRun(payloads [][]byte) error {
+	var series, points, totalBytes, largest int
+	var metrics []Metric
+	for _, data := range payloads {
+		var payload Payload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return err
+		}
+		metrics = append(metrics, payload.Series...)
+		series += len(payload.Series)
+		for _, metric := range payload.Series {
+			points += len(metric.Points)
+		}
+
+		totalBytes += len(data)
+		if len(data) > largest {
+			largest = len(data)
+		}
+	}
+
+	var err error
+	if c.dryRun.format == DryRunFormatTable {
+		err = writeTable(c.dryRun.out, metrics)
+	} else {
+		err = writeIndented(c.dryRun.out, payloads)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, check := range c.currentServiceChecks() {
+		if _, err := fmt.Fprintf(c.dryRun.out, "# service check %s: %s %s\n", check.Check, check.Status, check.Message); err != nil {
+			return err
+		}
+	}
+
+	for _, event := range c.events {
+		if _, err := fmt.Fprintf(c.dryRun.out, "# event %s: %s\n", event.AlertType, event.Title); err != nil {
+			return err
+		}
+	}
+	c.events = nil
+
+	_, err = fmt.Fprintf(c.dryRun.out, "# %s: %d series, %d points in %d payloads, %d bytes (largest %d bytes)\n",
+		time.Now().UTC().Format(time.RFC3339), series, points, len(payloads), totalBytes, largest)
+	return err
+}
+
+func writeIndented(out io.Writer, payloads [][]byte) error {
+	for _, data := range payloads {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, data, "", "  "); err != nil {
+			return err
+		}
+		indented.WriteByte('\n')
+		if _, err := indented.WriteTo(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTable(out io.Writer, metrics []Metric) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tPOINTS\tLAST VALUE\tTAGS")
+	for _, metric := range metrics {
+		var last float64
+		if len(metric.Points) > 0 {
+			last = metric.Points[len(metric.Points)-1].Value
+		}
+		fmt.Fprintf(w, "%s\t%d\t%g\t%s\n", metric.Metric, len(metric.Points), last, strings.Join(metric.Tags, ","))
+	}
+	return w.Flush()
+}
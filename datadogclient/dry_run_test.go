@@ -0,0 +1,89 @@
+package datadogclient_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dry run", func() {
+	var (
+		ts  *httptest.Server
+		c   *datadogclient.Client
+		out *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		bodies = nil
+		reqs = make(chan *http.Request, 1000)
+		responseCode = http.StatusOK
+		ts = httptest.NewServer(http.HandlerFunc(handlePost))
+		c = datadogclient.New(
+			ts.URL,
+			"dummykey",
+			"datadog.nozzle.",
+			"test-deployment",
+			"dummy-ip",
+			time.Second,
+			10240,
+			nil,
+			logger.FromSteno(gosteno.NewLogger("datadogclient test")),
+		)
+		out = new(bytes.Buffer)
+
+		for _, value := range []float64{1, 2.5} {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(value),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+			})
+		}
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("writes indented payloads instead of posting them", func() {
+		c.SetDryRun(out, datadogclient.DryRunFormatJSON)
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(reqs).ToNot(Receive())
+		Expect(out.String()).To(ContainSubstring(`
+      "metric": "datadog.nozzle.origin.metricName",`))
+		Expect(out.String()).To(MatchRegexp(`(?m)^# \S+: 4 series, 5 points in 1 payloads, \d+ bytes \(largest \d+ bytes\)$`))
+	})
+
+	It("writes a table with one row per series", func() {
+		c.SetDryRun(out, datadogclient.DryRunFormatTable)
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(reqs).ToNot(Receive())
+		Expect(out.String()).To(MatchRegexp(`(?m)^METRIC\s+POINTS\s+LAST VALUE\s+TAGS$`))
+		Expect(out.String()).To(MatchRegexp(`(?m)^datadog\.nozzle\.origin\.metricName\s+2\s+2\.5\s+deployment:deployment-name,job:doppler$`))
+	})
+
+	It("posts again once the dry run is turned off", func() {
+		c.SetDryRun(out, datadogclient.DryRunFormatTable)
+		c.SetDryRun(nil, "")
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(reqs).To(Receive())
+		Expect(out.Len()).To(Equal(0))
+	})
+})
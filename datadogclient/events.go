@@ -0,0 +1,125 @@
+package datadogclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	EventInfo    = "info"
+	EventWarning = "warning"
+	EventError   = "error"
+	EventSuccess = "success"
+)
+
+// Datadog rejects events with a longer title or text.
+const (
+	maxEventTitleLength = 100
+	maxEventTextLength  = 4000
+)
+
+// maxQueuedEvents caps the events kept while they can not be posted. The
+// oldest are dropped to make room.
+const maxQueuedEvents = 100
+
+type Event struct {
+	Title          string   `json:"title"`
+	Text           string   `json:"text"`
+	DateHappened   int64    `json:"date_happened"`
+	AlertType      string   `json:"alert_type"`
+	AggregationKey string   `json:"aggregation_key,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+}
+
+// AddEvent queues an event of alertType, one of the Event* constants, to be
+// posted after the metrics of the next flush. Long titles and texts are
+// truncated. Once maxQueuedEvents are queued, the oldest is dropped.
+func (c *Client) AddEvent(title, text, alertType string) {
+	if len(c.events) >= maxQueuedEvents {
+		c.events = c.events[1:]
+		c.droppedEvents++
+	}
+	c.events = append(c.events, Event{
+		Title:          truncate(title, maxEventTitleLength),
+		Text:           truncate(text, maxEventTextLength),
+		DateHappened:   time.Now().Unix(),
+		AlertType:      alertType,
+		AggregationKey: "datadog-firehose-nozzle",
+		Tags:           c.internalTags(),
+	})
+}
+
+// truncate shortens s to at most max bytes without splitting a character.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	s = s[:max]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+func (c *Client) postEvents() error {
+	for len(c.events) > 0 {
+		if err := c.postEvent(c.events[0]); err != nil {
+			return err
+		}
+		c.events = c.events[1:]
+	}
+	c.events = nil
+	return nil
+}
+
+func (c *Client) postEvent(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return c.postJSON(c.endpointURL("events"), body)
+}
+
+// postJSON posts body to url and turns a non 2xx response into an error, a
+// *RateLimitError for 429 Too Many Requests. The API key goes in a header
+// rather than the URL, which ends up in the errors of failed requests.
+func (c *Client) postJSON(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", c.apiKey)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			body = []byte("failed to read body")
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return rateLimitError(resp, body)
+		}
+		return fmt.Errorf("datadog request returned HTTP response: %s\nResponse Body: %s", resp.Status, body)
+	}
+	c.checkRateLimit(resp)
+	c.breakerSucceeded()
+	return nil
+}
+
+// endpointURL is the named API endpoint next to the series endpoint the
+// client was configured with.
+func (c *Client) endpointURL(name string) string {
+	base := strings.TrimSuffix(strings.TrimRight(c.apiURL, "/"), "/series")
+	return base + "/" + name
+}
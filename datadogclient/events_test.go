@@ -0,0 +1,139 @@
+package datadogclient_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+	"github.com/cloudfoundry/gosteno"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Events", func() {
+	var (
+		ts *httptest.Server
+		c  *datadogclient.Client
+	)
+
+	BeforeEach(func() {
+		bodies = nil
+		reqs = make(chan *http.Request, 1000)
+		responseCode = http.StatusOK
+		ts = httptest.NewServer(http.HandlerFunc(handlePost))
+		c = datadogclient.New(
+			ts.URL+"/api/v1/series",
+			"dummykey",
+			"datadog.nozzle.",
+			"test-deployment",
+			"dummy-ip",
+			time.Second,
+			10240,
+			nil,
+			logger.FromSteno(gosteno.NewLogger("datadogclient test")),
+		)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	postedEvents := func() []datadogclient.Event {
+		bodies = nil
+		Expect(c.PostMetrics()).To(Succeed())
+
+		var events []datadogclient.Event
+		for _, body := range bodies {
+			req := <-reqs
+			if req.URL.Path != "/api/v1/events" {
+				continue
+			}
+
+			Expect(req.Header.Get("DD-API-KEY")).To(Equal("dummykey"))
+			var event datadogclient.Event
+			Expect(json.Unmarshal(body, &event)).To(Succeed())
+			events = append(events, event)
+		}
+		return events
+	}
+
+	It("posts queued events once, in order, after the metrics", func() {
+		c.AddEvent("Nozzle started", "Version: 1.0", datadogclient.EventInfo)
+		c.AddEvent("Firehose connection closed", "code 1008", datadogclient.EventError)
+
+		events := postedEvents()
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Title).To(Equal("Nozzle started"))
+		Expect(events[0].Text).To(Equal("Version: 1.0"))
+		Expect(events[0].AlertType).To(Equal("info"))
+		Expect(events[0].DateHappened).To(BeNumerically("~", time.Now().Unix(), 5))
+		Expect(events[0].Tags).To(ContainElement("deployment:test-deployment"))
+		Expect(events[1].Title).To(Equal("Firehose connection closed"))
+		Expect(events[1].AlertType).To(Equal("error"))
+
+		Expect(postedEvents()).To(BeEmpty())
+	})
+
+	It("truncates titles and texts Datadog would reject", func() {
+		c.AddEvent(strings.Repeat("t", 150), strings.Repeat("é", 3000), datadogclient.EventInfo)
+
+		events := postedEvents()
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Title).To(HaveLen(100))
+		Expect(events[0].Text).To(Equal(strings.Repeat("é", 2000)))
+	})
+
+	It("drops the oldest events once too many are queued", func() {
+		for i := 0; i < 105; i++ {
+			c.AddEvent(fmt.Sprintf("event %d", i), "", datadogclient.EventInfo)
+		}
+
+		events := postedEvents()
+		Expect(events).To(HaveLen(100))
+		Expect(events[0].Title).To(Equal("event 5"))
+		Expect(events[99].Title).To(Equal("event 104"))
+
+		var payload datadogclient.Payload
+		Expect(json.Unmarshal(bodies[0], &payload)).To(Succeed())
+		var dropped datadogclient.Metric
+		Expect(payload.Series).To(ContainMetric("datadog.nozzle.droppedEvents", &dropped))
+		Expect(dropped.Points[0].Value).To(BeEquivalentTo(5))
+	})
+
+	It("keeps events that could not be posted for the next flush", func() {
+		c.AddEvent("Nozzle started", "", datadogclient.EventInfo)
+		responseCode = http.StatusInternalServerError
+		Expect(c.PostMetrics()).ToNot(Succeed())
+		Expect(reqs).To(Receive())
+
+		responseCode = http.StatusOK
+		Expect(postedEvents()).To(HaveLen(1))
+	})
+
+	It("does not fail the flush when only the events can not be posted", func() {
+		failEvents := true
+		ts.Close()
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if failEvents && r.URL.Path == "/api/v1/events" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			handlePost(w, r)
+		}))
+		c = datadogclient.New(ts.URL+"/api/v1/series", "dummykey", "datadog.nozzle.", "test-deployment", "dummy-ip", time.Second, 10240, nil, logger.FromSteno(gosteno.NewLogger("datadogclient test")))
+		c.AddEvent("Nozzle started", "", datadogclient.EventInfo)
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(reqs).To(Receive())
+
+		failEvents = false
+		events := postedEvents()
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Title).To(Equal("Nozzle started"))
+	})
+})
@@ -1,74 +1,291 @@
 package datadogclient
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	payloadHeader = `{"series":[`
+	payloadFooter = `]}`
+
+	// truncatedTag marks a series whose tags were cut to fit in a payload.
+	truncatedTag = "tags_truncated:true"
+)
 
 type Formatter struct{}
 
-func (f Formatter) Format(prefix string, maxPostBytes uint32, data map[MetricKey]MetricValue) [][]byte {
-	if len(data) == 0 {
-		return nil
-	}
+// buffers holds the payload buffers between flushes, so that a flush does
+// not grow a new one from scratch.
+var buffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
 
-	var result [][]byte
-	seriesBytes := formatMetrics(prefix, data)
-	if uint32(len(seriesBytes)) > maxPostBytes && canSplit(data) {
-		metricsA, metricsB := splitPoints(data)
-		result = append(result, f.Format(prefix, maxPostBytes, metricsA)...)
-		result = append(result, f.Format(prefix, maxPostBytes, metricsB)...)
+// Format encodes data as Datadog series payloads of at most maxPostBytes
+// each. Series are packed in order of metric name and tags, and a series
+// whose points do not fit in the current payload is continued in the next
+// one. A series that can not fit in a payload even with a single point
+// loses its longest tags until it does, is tagged tags_truncated:true and
+// counted in truncated. Series that still do not fit are left out and
+// returned in oversized, along with how many points they had.
+func (f Formatter) Format(prefix string, maxPostBytes uint32, data map[MetricKey]MetricValue) (payloads [][]byte, oversized, truncated map[string]int) {
+	result := f.format(prefix, maxPostBytes, data)
+	return result.payloads, result.oversized, result.truncated
+}
+
+// formatted is what Format returns, along with where each payload ends.
+type formatted struct {
+	payloads  [][]byte
+	oversized map[string]int
+	truncated map[string]int
+
+	// keys are the series in the order they were packed, and ends holds
+	// the position in keys just past the last point of each payload.
+	keys []MetricKey
+	ends []seriesPosition
+}
 
+type seriesPosition struct {
+	series int
+	point  int
+}
+
+func (f Formatter) format(prefix string, maxPostBytes uint32, data map[MetricKey]MetricValue) formatted {
+	var result formatted
+	if len(data) == 0 {
 		return result
 	}
 
-	result = append(result, seriesBytes)
+	current := buffers.Get().(*bytes.Buffer)
+	current.Reset()
+	defer buffers.Put(current)
+
+	p := &packer{maxBytes: int(maxPostBytes), current: current}
+	for _, series := range sortedSeries(prefix, data) {
+		metric := series.metric
+		if p.addSeries(series.key, metric) {
+			continue
+		}
+		if shortened, ok := p.truncateTags(metric); ok && p.addSeries(series.key, shortened) {
+			if result.truncated == nil {
+				result.truncated = make(map[string]int)
+			}
+			result.truncated[metric.Metric]++
+			continue
+		}
+		if result.oversized == nil {
+			result.oversized = make(map[string]int)
+		}
+		result.oversized[metric.Metric] += len(metric.Points)
+	}
+	result.payloads = p.finish()
+	result.keys = p.keys
+	result.ends = p.ends
 	return result
 }
 
-func formatMetrics(prefix string, data map[MetricKey]MetricValue) []byte {
-	metrics := []Metric{}
+type keyedMetric struct {
+	key    MetricKey
+	metric Metric
+}
+
+func sortedSeries(prefix string, data map[MetricKey]MetricValue) []keyedMetric {
+	metrics := make([]keyedMetric, 0, len(data))
 	for key, mVal := range data {
-		metrics = append(metrics, Metric{
-			Metric: prefix + key.Name,
-			Points: mVal.Points,
-			Type:   "gauge",
-			Tags:   mVal.Tags,
+		metrics = append(metrics, keyedMetric{
+			key: key,
+			metric: Metric{
+				Metric: prefix + key.Name,
+				Points: mVal.Points,
+				Type:   "gauge",
+				Tags:   mVal.Tags,
+			},
 		})
 	}
+	sort.Sort(bySeries(metrics))
+	return metrics
+}
+
+// packer fills payloads in a single pass over the series, encoding each
+// point once.
+type packer struct {
+	maxBytes int
+	payloads [][]byte
+	keys     []MetricKey
+	ends     []seriesPosition
+	next     seriesPosition
 
-	encodedMetric, _ := json.Marshal(Payload{Series: metrics})
-	return encodedMetric
+	current *bytes.Buffer
+	scratch []byte
 }
 
-func canSplit(data map[MetricKey]MetricValue) bool {
-	for _, v := range data {
-		if len(v.Points) > 1 {
-			return true
+func (p *packer) addSeries(key MetricKey, metric Metric) bool {
+	head, tail := seriesEnvelope(metric)
+	if !p.fitsAlone(head, tail, metric.Points) {
+		return false
+	}
+	p.keys = append(p.keys, key)
+
+	for i := 0; i < len(metric.Points); {
+		if !p.fits(head, tail, metric.Points[i]) {
+			p.flush()
 		}
+
+		p.openSeries(head)
+		for ; i < len(metric.Points); i++ {
+			p.scratch = encodePoint(p.scratch[:0], metric.Points[i])
+			if !p.pointFits(p.scratch, tail) {
+				break
+			}
+			if p.current.Bytes()[p.current.Len()-1] != '[' {
+				p.current.WriteByte(',')
+			}
+			p.current.Write(p.scratch)
+			p.next = seriesPosition{series: len(p.keys) - 1, point: i + 1}
+		}
+		p.current.WriteString(tail)
 	}
+	return true
+}
 
-	return false
+// fitsAlone reports whether a series fits in an empty payload with its
+// largest point.
+func (p *packer) fitsAlone(head, tail string, points []Point) bool {
+	return len(payloadHeader)+len(head)+len(tail)+len(payloadFooter)+p.maxPointBytes(points) <= p.maxBytes
 }
 
-func splitPoints(data map[MetricKey]MetricValue) (a, b map[MetricKey]MetricValue) {
-	a = make(map[MetricKey]MetricValue)
-	b = make(map[MetricKey]MetricValue)
-	for k, v := range data {
-		split := len(v.Points) / 2
-		if split == 0 {
-			a[k] = MetricValue{
-				Tags:   v.Tags,
-				Points: v.Points,
+// truncateTags drops the longest tags of metric until it fits in a payload
+// with truncatedTag added. It reports false if even that does not fit.
+func (p *packer) truncateTags(metric Metric) (Metric, bool) {
+	if len(metric.Tags) == 0 {
+		return metric, false
+	}
+
+	tags := append([]string(nil), metric.Tags...)
+	for len(tags) > 0 {
+		longest := 0
+		for i, tag := range tags {
+			if len(tag) > len(tags[longest]) {
+				longest = i
 			}
-			continue
 		}
+		tags = append(tags[:longest], tags[longest+1:]...)
 
-		a[k] = MetricValue{
-			Tags:   v.Tags,
-			Points: v.Points[:split],
+		shortened := metric
+		shortened.Tags = append(append([]string(nil), tags...), truncatedTag)
+
+		head, tail := seriesEnvelope(shortened)
+		if p.fitsAlone(head, tail, shortened.Points) {
+			return shortened, true
 		}
-		b[k] = MetricValue{
-			Tags:   v.Tags,
-			Points: v.Points[split:],
+	}
+	return metric, false
+}
+
+// fits reports whether a series opened in the current payload would have
+// room for at least one point.
+func (p *packer) fits(head, tail string, point Point) bool {
+	size := p.current.Len()
+	if size == 0 {
+		size = len(payloadHeader)
+	} else {
+		size++
+	}
+	p.scratch = encodePoint(p.scratch[:0], point)
+	return size+len(head)+len(p.scratch)+len(tail)+len(payloadFooter) <= p.maxBytes
+}
+
+func (p *packer) pointFits(point []byte, tail string) bool {
+	size := p.current.Len() + len(point) + len(tail) + len(payloadFooter)
+	if p.current.Bytes()[p.current.Len()-1] != '[' {
+		size++
+	}
+	return size <= p.maxBytes
+}
+
+func (p *packer) openSeries(head string) {
+	if p.current.Len() == 0 {
+		p.current.WriteString(payloadHeader)
+	} else {
+		p.current.WriteByte(',')
+	}
+	p.current.WriteString(head)
+}
+
+func (p *packer) flush() {
+	if p.current.Len() == 0 {
+		return
+	}
+	p.current.WriteString(payloadFooter)
+	payload := make([]byte, p.current.Len())
+	copy(payload, p.current.Bytes())
+	p.payloads = append(p.payloads, payload)
+	p.ends = append(p.ends, p.next)
+	p.current.Reset()
+}
+
+func (p *packer) finish() [][]byte {
+	p.flush()
+	return p.payloads
+}
+
+// seriesEnvelope returns the JSON of a series up to and after its points,
+// matching what encoding/json produces for Metric.
+func seriesEnvelope(metric Metric) (head, tail string) {
+	name, _ := json.Marshal(metric.Metric)
+	head = `{"metric":` + string(name) + `,"points":[`
+
+	tail = `],"type":"` + metric.Type + `"`
+	if metric.Host != "" {
+		host, _ := json.Marshal(metric.Host)
+		tail += `,"host":` + string(host)
+	}
+	if len(metric.Tags) > 0 {
+		tags, _ := json.Marshal(metric.Tags)
+		tail += `,"tags":` + string(tags)
+	}
+	return head, tail + "}"
+}
+
+func encodePoint(dst []byte, point Point) []byte {
+	dst = append(dst, '[')
+	dst = strconv.AppendInt(dst, point.Timestamp, 10)
+	dst = append(dst, ',')
+	dst = strconv.AppendFloat(dst, point.Value, 'f', 6, 64)
+	return append(dst, ']')
+}
+
+func (p *packer) maxPointBytes(points []Point) int {
+	max := 0
+	for _, point := range points {
+		p.scratch = encodePoint(p.scratch[:0], point)
+		if size := len(p.scratch); size > max {
+			max = size
+		}
+	}
+	return max
+}
+
+// bySeries orders series by metric name and then by tags, so that the same
+// data always encodes to the same payloads.
+type bySeries []keyedMetric
+
+func (s bySeries) Len() int      { return len(s) }
+func (s bySeries) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s bySeries) Less(i, j int) bool {
+	if s[i].metric.Metric != s[j].metric.Metric {
+		return s[i].metric.Metric < s[j].metric.Metric
+	}
+
+	a, b := s[i].metric.Tags, s[j].metric.Tags
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
 		}
 	}
-	return a, b
+	return len(a) < len(b)
 }
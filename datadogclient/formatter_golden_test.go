@@ -0,0 +1,114 @@
+package datadogclient_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata with the current output")
+
+var _ = Describe("Formatter golden files", func() {
+	var formatter datadogclient.Formatter
+
+	series := func(name string, points int, tags ...string) (datadogclient.MetricKey, datadogclient.MetricValue) {
+		value := datadogclient.MetricValue{Tags: tags}
+		for i := 0; i < points; i++ {
+			value.Points = append(value.Points, datadogclient.Point{
+				Timestamp: int64(1500000000 + i),
+				Value:     float64(i) + 0.5,
+			})
+		}
+		hash := fnv.New64a()
+		fmt.Fprint(hash, tags)
+		return datadogclient.MetricKey{Name: name, TagsHash: hash.Sum64()}, value
+	}
+
+	build := func(specs ...func() (datadogclient.MetricKey, datadogclient.MetricValue)) map[datadogclient.MetricKey]datadogclient.MetricValue {
+		data := make(map[datadogclient.MetricKey]datadogclient.MetricValue)
+		for _, spec := range specs {
+			key, value := spec()
+			data[key] = value
+		}
+		return data
+	}
+
+	seriesOf := func(name string, points int, tags ...string) func() (datadogclient.MetricKey, datadogclient.MetricValue) {
+		return func() (datadogclient.MetricKey, datadogclient.MetricValue) {
+			return series(name, points, tags...)
+		}
+	}
+
+	matchGolden := func(name string, payloads [][]byte) {
+		actual := append(bytes.Join(payloads, []byte("\n")), '\n')
+		path := filepath.Join("testdata", name+".golden")
+		if *updateGolden {
+			Expect(ioutil.WriteFile(path, actual, 0644)).To(Succeed())
+		}
+
+		expected, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred(), "run go test with -update to create %s", path)
+		Expect(string(actual)).To(Equal(string(expected)))
+	}
+
+	It("sorts series by name and tags", func() {
+		data := build(
+			seriesOf("router.latency", 1, "deployment:cf", "job:router"),
+			seriesOf("doppler.received", 2, "deployment:cf", "index:1"),
+			seriesOf("doppler.received", 2, "deployment:cf", "index:0"),
+			seriesOf("api.requests", 1),
+			seriesOf("doppler.received", 1, "deployment:cf"),
+		)
+
+		payloads, _, _ := formatter.Format("cf.", 1<<20, data)
+		matchGolden("sorted", payloads)
+	})
+
+	It("splits points across payloads", func() {
+		data := build(
+			seriesOf("router.latency", 8, "deployment:cf", "job:router"),
+			seriesOf("doppler.received", 4, "deployment:cf", "job:doppler"),
+			seriesOf("api.requests", 1, "deployment:cf"),
+		)
+
+		payloads, oversized, _ := formatter.Format("cf.", 400, data)
+		Expect(oversized).To(BeEmpty())
+		for _, payload := range payloads {
+			Expect(len(payload)).To(BeNumerically("<=", 400))
+		}
+		matchGolden("split_points", payloads)
+	})
+
+	It("starts a new payload for each series when only one fits", func() {
+		data := build(
+			seriesOf("router.latency", 1, "deployment:cf", "job:router", "index:0"),
+			seriesOf("router.latency", 1, "deployment:cf", "job:router", "index:1"),
+		)
+
+		payloads, _, _ := formatter.Format("cf.", 150, data)
+		Expect(payloads).To(HaveLen(2))
+		matchGolden("one_series_per_payload", payloads)
+	})
+
+	It("encodes the same data identically every time", func() {
+		data := build(
+			seriesOf("a", 3, "x:1"),
+			seriesOf("a", 3, "x:2"),
+			seriesOf("b", 5),
+			seriesOf("c", 1, "y:1", "z:1"),
+		)
+
+		first, _, _ := formatter.Format("", 200, data)
+		for i := 0; i < 20; i++ {
+			payloads, _, _ := formatter.Format("", 200, data)
+			Expect(payloads).To(Equal(first))
+		}
+	})
+})
@@ -1,6 +1,10 @@
 package datadogclient_test
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
 
 	. "github.com/onsi/ginkgo"
@@ -17,19 +21,94 @@ var _ = Describe("Formatter", func() {
 	})
 
 	It("does not return empty data", func() {
-		result := formatter.Format("some-prefix", 1024, nil)
+		result, oversized, _ := formatter.Format("some-prefix", 1024, nil)
 		Expect(result).To(HaveLen(0))
+		Expect(oversized).To(BeEmpty())
 	})
 
-	It("does not 'delete' points when trying to split", func() {
+	It("reports series that do not fit in a payload instead of dropping them silently", func() {
 		m := make(map[datadogclient.MetricKey]datadogclient.MetricValue)
 		m[datadogclient.MetricKey{Name: "a"}] = datadogclient.MetricValue{
 			Points: []datadogclient.Point{{
 				Value: 9,
 			}},
 		}
-		result := formatter.Format("some-prefix", 1, m)
+		result, oversized, _ := formatter.Format("some-prefix", 1, m)
+
+		Expect(result).To(HaveLen(0))
+		Expect(oversized).To(Equal(map[string]int{"some-prefixa": 1}))
+	})
 
+	It("drops the longest tags of a series that does not fit in a payload", func() {
+		m := make(map[datadogclient.MetricKey]datadogclient.MetricValue)
+		m[datadogclient.MetricKey{Name: "a"}] = datadogclient.MetricValue{
+			Points: []datadogclient.Point{{Timestamp: 1, Value: 9}},
+			Tags:   []string{"deployment:cf", "request_id:" + strings.Repeat("x", 300), "job:router"},
+		}
+		result, oversized, truncated := formatter.Format("cf.", 200, m)
+
+		Expect(oversized).To(BeEmpty())
+		Expect(truncated).To(Equal(map[string]int{"cf.a": 1}))
 		Expect(result).To(HaveLen(1))
+		var payload datadogclient.Payload
+		Expect(json.Unmarshal(result[0], &payload)).To(Succeed())
+		Expect(payload.Series).To(HaveLen(1))
+		Expect(payload.Series[0].Tags).To(Equal([]string{"deployment:cf", "job:router", "tags_truncated:true"}))
+		Expect(payload.Series[0].Points).To(HaveLen(1))
+	})
+
+	It("keeps every point and stays within maxPostBytes", func() {
+		m := make(map[datadogclient.MetricKey]datadogclient.MetricValue)
+		for i := 0; i < 50; i++ {
+			var points []datadogclient.Point
+			for j := 0; j <= i%7; j++ {
+				points = append(points, datadogclient.Point{Timestamp: int64(1500000000 + j), Value: float64(i * j)})
+			}
+			m[datadogclient.MetricKey{Name: fmt.Sprintf("metric-%d", i%5), TagsHash: uint64(i)}] = datadogclient.MetricValue{
+				Points: points,
+				Tags:   []string{fmt.Sprintf("index:%d", i), "deployment:cf"},
+			}
+		}
+
+		result, oversized, _ := formatter.Format("cf.", 300, m)
+		Expect(oversized).To(BeEmpty())
+
+		points := make(map[string]int)
+		for _, data := range result {
+			Expect(len(data)).To(BeNumerically("<=", 300))
+
+			var payload datadogclient.Payload
+			Expect(json.Unmarshal(data, &payload)).To(Succeed())
+			for _, metric := range payload.Series {
+				Expect(metric.Points).ToNot(BeEmpty())
+				points[metric.Metric+fmt.Sprint(metric.Tags)] += len(metric.Points)
+			}
+		}
+
+		Expect(points).To(HaveLen(50))
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("cf.metric-%d[index:%d deployment:cf]", i%5, i)
+			Expect(points[key]).To(Equal(i%7+1), key)
+		}
+	})
+
+	It("encodes series the same way as encoding/json", func() {
+		m := make(map[datadogclient.MetricKey]datadogclient.MetricValue)
+		m[datadogclient.MetricKey{Name: "a<b>"}] = datadogclient.MetricValue{
+			Points: []datadogclient.Point{{Timestamp: 1, Value: 0.25}, {Timestamp: 2, Value: -3}},
+			Tags:   []string{"quote:\"", "amp:&"},
+		}
+
+		result, _, _ := formatter.Format("", 1024, m)
+		Expect(result).To(HaveLen(1))
+
+		expected, err := json.Marshal(datadogclient.Payload{Series: []datadogclient.Metric{{
+			Metric: "a<b>",
+			Points: m[datadogclient.MetricKey{Name: "a<b>"}].Points,
+			Type:   "gauge",
+			Tags:   []string{"quote:\"", "amp:&"},
+		}}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result[0]).To(MatchJSON(expected))
 	})
 })
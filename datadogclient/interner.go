@@ -0,0 +1,240 @@
+package datadogclient
+
+import (
+	"sort"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	// tagSeparator joins the sorted tags of a series when they are hashed
+	// into the key that identifies it. Tags are not expected to contain it.
+	tagSeparator = '\x00'
+
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+type tagPair struct {
+	key string
+	// value is empty for custom tags, which are already in key:value form.
+	value string
+}
+
+// interner returns the names and tag sets of series without allocating for
+// ones it has already seen since the last reset. What it returns is shared
+// between series and must not be modified.
+//
+// It also keys tag sets by hash. Tag sets whose hashes collide take the next
+// free key, so that until the next reset a key stands for one tag set only.
+type interner struct {
+	names   map[string]string
+	tagSets map[uint64][]string
+
+	scratch []byte
+	pairs   []tagPair
+}
+
+func newInterner() *interner {
+	return &interner{
+		names:   make(map[string]string),
+		tagSets: make(map[uint64][]string),
+	}
+}
+
+// reset forgets everything interned so far, so that series which stop
+// reporting do not hold on to memory.
+func (in *interner) reset() {
+	in.names = make(map[string]string, len(in.names))
+	in.tagSets = make(map[uint64][]string, len(in.tagSets))
+}
+
+func (in *interner) name(origin, name string) string {
+	in.scratch = append(in.scratch[:0], origin...)
+	in.scratch = append(in.scratch, '.')
+	in.scratch = append(in.scratch, name...)
+
+	if interned, ok := in.names[string(in.scratch)]; ok {
+		return interned
+	}
+	interned := string(in.scratch)
+	in.names[interned] = interned
+	return interned
+}
+
+// tags returns the sorted tags of envelope and custom together with the key
+// of that tag set.
+func (in *interner) tags(envelope *events.Envelope, custom []string) ([]string, uint64) {
+	pairs := appendPair(in.pairs[:0], "deployment", envelope.GetDeployment())
+	pairs = appendPair(pairs, "job", envelope.GetJob())
+	pairs = appendPair(pairs, "index", envelope.GetIndex())
+	pairs = appendPair(pairs, "ip", envelope.GetIp())
+	for name, value := range envelope.GetTags() {
+		pairs = appendPair(pairs, name, value)
+	}
+	for _, tag := range custom {
+		pairs = append(pairs, tagPair{key: tag})
+	}
+	sortPairs(pairs)
+	in.pairs = pairs
+
+	hash := uint64(fnvOffset64)
+	for i, pair := range pairs {
+		if i > 0 {
+			hash = hashByte(hash, tagSeparator)
+		}
+		hash = hashString(hash, pair.key)
+		if pair.value != "" {
+			hash = hashByte(hash, ':')
+			hash = hashString(hash, pair.value)
+		}
+	}
+
+	for {
+		tags, ok := in.tagSets[hash]
+		if !ok {
+			break
+		}
+		if pairsEqual(tags, pairs) {
+			return tags, hash
+		}
+		hash++
+	}
+
+	tags := make([]string, len(pairs))
+	for i, pair := range pairs {
+		tags[i] = pair.String()
+	}
+	in.tagSets[hash] = tags
+	return tags, hash
+}
+
+// key sorts tags and returns the key of that tag set.
+func (in *interner) key(tags []string) uint64 {
+	hash := hashTags(tags)
+	for {
+		interned, ok := in.tagSets[hash]
+		if !ok {
+			break
+		}
+		if stringsEqual(interned, tags) {
+			return hash
+		}
+		hash++
+	}
+	in.tagSets[hash] = tags
+	return hash
+}
+
+// hashTags sorts tags and returns their 64-bit FNV-1a hash, the same as
+// the interner computes for the same tags before resolving collisions.
+func hashTags(tags []string) uint64 {
+	sort.Strings(tags)
+	hash := uint64(fnvOffset64)
+	for i, tag := range tags {
+		if i > 0 {
+			hash = hashByte(hash, tagSeparator)
+		}
+		hash = hashString(hash, tag)
+	}
+	return hash
+}
+
+func hashString(hash uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		hash = hashByte(hash, s[i])
+	}
+	return hash
+}
+
+func hashByte(hash uint64, b byte) uint64 {
+	return (hash ^ uint64(b)) * fnvPrime64
+}
+
+func pairsEqual(tags []string, pairs []tagPair) bool {
+	if len(tags) != len(pairs) {
+		return false
+	}
+	for i, pair := range pairs {
+		if !pair.equal(tags[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func appendPair(pairs []tagPair, key, value string) []tagPair {
+	if value == "" {
+		return pairs
+	}
+	return append(pairs, tagPair{key: key, value: value})
+}
+
+func (p tagPair) String() string {
+	if p.value == "" {
+		return p.key
+	}
+	return p.key + ":" + p.value
+}
+
+// equal reports whether tag is the String form of p, without building it.
+func (p tagPair) equal(tag string) bool {
+	if p.value == "" {
+		return tag == p.key
+	}
+	return len(tag) == p.len() &&
+		tag[:len(p.key)] == p.key &&
+		tag[len(p.key)] == ':' &&
+		tag[len(p.key)+1:] == p.value
+}
+
+func (p tagPair) len() int {
+	if p.value == "" {
+		return len(p.key)
+	}
+	return len(p.key) + 1 + len(p.value)
+}
+
+func (p tagPair) at(i int) byte {
+	switch {
+	case i < len(p.key):
+		return p.key[i]
+	case i == len(p.key):
+		return ':'
+	default:
+		return p.value[i-len(p.key)-1]
+	}
+}
+
+// less orders pairs as their String forms would sort, without building them.
+func (p tagPair) less(q tagPair) bool {
+	pl, ql := p.len(), q.len()
+	for i := 0; i < pl && i < ql; i++ {
+		if a, b := p.at(i), q.at(i); a != b {
+			return a < b
+		}
+	}
+	return pl < ql
+}
+
+// sortPairs is an insertion sort: envelopes carry a handful of tags, and
+// unlike sort.Sort it does not allocate.
+func sortPairs(pairs []tagPair) {
+	for i := 1; i < len(pairs); i++ {
+		for j := i; j > 0 && pairs[j].less(pairs[j-1]); j-- {
+			pairs[j], pairs[j-1] = pairs[j-1], pairs[j]
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package datadogclient_test
+
+import (
+	"encoding/json"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
+)
+
+// postedSeries decodes the series of every payload the fake Datadog API has
+// received, in the order they were posted. Bodies that are not series
+// payloads are skipped.
+func postedSeries() []datadogclient.Metric {
+	var series []datadogclient.Metric
+	for _, body := range bodies {
+		var payload datadogclient.Payload
+		if json.Unmarshal(body, &payload) != nil {
+			continue
+		}
+		series = append(series, payload.Series...)
+	}
+	return series
+}
+
+// seriesByName indexes series by metric name, keeping the last posted
+// series of each name.
+func seriesByName(series []datadogclient.Metric) map[string]datadogclient.Metric {
+	byName := make(map[string]datadogclient.Metric, len(series))
+	for _, metric := range series {
+		byName[metric.Metric] = metric
+	}
+	return byName
+}
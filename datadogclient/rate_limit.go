@@ -0,0 +1,131 @@
+package datadogclient
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Without a Retry-After or reset header, a rate limited client waits
+	// minThrottle, doubling on every consecutive 429 up to maxThrottle.
+	minThrottle = 10 * time.Second
+	maxThrottle = 5 * time.Minute
+)
+
+// RateLimitError is a request Datadog refused with 429 Too Many Requests.
+type RateLimitError struct {
+	// RetryAfter is how long Datadog asked the client to wait, or 0 if it
+	// did not say.
+	RetryAfter time.Duration
+	Limit      int
+	Period     time.Duration
+	Body       string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("datadog request was rate limited, retry after %s\nResponse Body: %s", e.RetryAfter, e.Body)
+}
+
+type rateLimit struct {
+	until   time.Time
+	since   time.Time
+	backoff time.Duration
+}
+
+// rateLimitError reads the rate limit headers of a 429 response.
+func rateLimitError(resp *http.Response, body []byte) *RateLimitError {
+	err := &RateLimitError{Body: string(body)}
+	err.RetryAfter = retryAfter(resp.Header, time.Now())
+	if reset := headerSeconds(resp.Header, "X-RateLimit-Reset"); reset > err.RetryAfter {
+		err.RetryAfter = reset
+	}
+	err.Limit, _ = strconv.Atoi(resp.Header.Get("X-RateLimit-Limit"))
+	err.Period = headerSeconds(resp.Header, "X-RateLimit-Period")
+	return err
+}
+
+// retryAfter parses Retry-After, which is either a number of seconds or an
+// HTTP date.
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+func headerSeconds(header http.Header, name string) time.Duration {
+	seconds, err := strconv.Atoi(header.Get(name))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// checkRateLimit holds off the next flush when a successful response says
+// no requests are left in the current period.
+func (c *Client) checkRateLimit(resp *http.Response) {
+	if resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		return
+	}
+	if reset := headerSeconds(resp.Header, "X-RateLimit-Reset"); reset > 0 {
+		c.log.Infof("Used up the Datadog rate limit, holding off for %s", reset)
+		c.throttle(reset)
+	}
+}
+
+// rateLimited backs off after a 429 response.
+func (c *Client) rateLimited(err *RateLimitError) {
+	wait := err.RetryAfter
+	if wait == 0 {
+		wait = c.rateLimit.backoff
+		if wait == 0 {
+			wait = minThrottle
+		}
+		c.rateLimit.backoff = wait * 2
+		if c.rateLimit.backoff > maxThrottle {
+			c.rateLimit.backoff = maxThrottle
+		}
+	}
+	c.log.Warnf("Datadog is rate limiting the nozzle, keeping metrics buffered for %s", wait)
+	c.throttle(wait)
+}
+
+func (c *Client) throttle(wait time.Duration) {
+	now := time.Now()
+	if c.rateLimit.since.IsZero() {
+		c.rateLimit.since = now
+	}
+	c.rateLimit.until = now.Add(wait)
+}
+
+// throttled reports whether the client is waiting out a rate limit.
+func (c *Client) throttled() bool {
+	return time.Now().Before(c.rateLimit.until)
+}
+
+// addThrottleMetric reports how long metrics were held back by rate limits
+// before this flush.
+func (c *Client) addThrottleMetric() {
+	if c.rateLimit.since.IsZero() {
+		return
+	}
+	c.addInternalMetric("datadogThrottledSeconds", uint64(time.Since(c.rateLimit.since).Seconds()))
+}
+
+// rateLimitLifted forgets the rate limit once a flush has been posted.
+func (c *Client) rateLimitLifted() {
+	if c.throttled() {
+		return
+	}
+	c.rateLimit.since = time.Time{}
+	c.rateLimit.backoff = 0
+}
@@ -0,0 +1,208 @@
+package datadogclient_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate limiting", func() {
+	var (
+		ts *httptest.Server
+		c  *datadogclient.Client
+	)
+
+	BeforeEach(func() {
+		bodies = nil
+		reqs = make(chan *http.Request, 1000)
+		responseCode = http.StatusOK
+		responseBody = nil
+		ts = httptest.NewServer(http.HandlerFunc(handlePost))
+		c = datadogclient.New(
+			ts.URL+"/api/v1/series",
+			"dummykey",
+			"datadog.nozzle.",
+			"test-deployment",
+			"dummy-ip",
+			time.Second,
+			10240,
+			nil,
+			logger.FromSteno(gosteno.NewLogger("datadogclient test")),
+		)
+		c.AddMetric(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("metricName"),
+				Value: proto.Float64(5),
+			},
+		})
+	})
+
+	AfterEach(func() {
+		responseHeaders = nil
+		ts.Close()
+	})
+
+	It("keeps metrics buffered until Retry-After has passed", func() {
+		responseCode = http.StatusTooManyRequests
+		responseHeaders = http.Header{"Retry-After": {"1"}}
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(reqs).To(HaveLen(1))
+
+		responseCode = http.StatusOK
+		responseHeaders = nil
+		bodies = nil
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(reqs).To(HaveLen(1))
+
+		time.Sleep(1100 * time.Millisecond)
+		Expect(c.PostMetrics()).To(Succeed())
+		series := seriesByName(postedSeries())
+		Expect(series).To(HaveKey("datadog.nozzle.origin.metricName"))
+		Expect(series["datadog.nozzle.datadogThrottledSeconds"].Points[0].Value).To(BeNumerically(">=", 1))
+
+		bodies = nil
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(seriesByName(postedSeries())).ToNot(HaveKey("datadog.nozzle.datadogThrottledSeconds"))
+	})
+
+	It("does not post the payloads accepted before a 429 again", func() {
+		for i := 0; i < 300; i++ {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(fmt.Sprintf("metric%03d", i)),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+		requests := 0
+		ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 2 {
+				responseCode = http.StatusTooManyRequests
+				responseHeaders = http.Header{"Retry-After": {"1"}}
+			}
+			handlePost(w, r)
+			responseCode = http.StatusOK
+			responseHeaders = nil
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(reqs).To(HaveLen(2))
+		var accepted datadogclient.Payload
+		Expect(json.Unmarshal(bodies[0], &accepted)).To(Succeed())
+
+		bodies = nil
+		time.Sleep(1100 * time.Millisecond)
+		Expect(c.PostMetrics()).To(Succeed())
+		series := seriesByName(postedSeries())
+		for _, metric := range accepted.Series {
+			if strings.HasPrefix(metric.Metric, "datadog.nozzle.origin.") {
+				Expect(series).ToNot(HaveKey(metric.Metric))
+			}
+		}
+		Expect(len(series)).To(BeNumerically(">", 301-len(accepted.Series)))
+		Expect(series).To(HaveKey("datadog.nozzle.origin.metric299"))
+	})
+
+	It("reports the points dropped before a rate limited flush at the next one", func() {
+		dropMetric := func() {
+			c.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("otherMetric"),
+					Value: proto.Float64(5),
+				},
+			})
+		}
+		c.SetBufferLimits(1, 0, datadogclient.BufferPolicyDropNewest)
+		dropMetric()
+		responseCode = http.StatusTooManyRequests
+		responseHeaders = http.Header{"Retry-After": {"1"}}
+		Expect(c.PostMetrics()).To(Succeed())
+
+		dropMetric()
+		responseCode = http.StatusOK
+		responseHeaders = nil
+		bodies = nil
+		time.Sleep(1100 * time.Millisecond)
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(seriesByName(postedSeries())["datadog.nozzle.bufferDroppedPoints"].Points[0].Value).To(BeEquivalentTo(2))
+
+		bodies = nil
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(seriesByName(postedSeries())["datadog.nozzle.bufferDroppedPoints"].Points[0].Value).To(BeEquivalentTo(0))
+	})
+
+	It("waits for the rate limit to reset when a response has no requests left", func() {
+		responseHeaders = http.Header{
+			"X-Ratelimit-Limit":     {"100"},
+			"X-Ratelimit-Remaining": {"0"},
+			"X-Ratelimit-Reset":     {"1"},
+		}
+
+		Expect(c.PostMetrics()).To(Succeed())
+		sent := len(reqs)
+		Expect(seriesByName(postedSeries())).To(HaveKey("datadog.nozzle.origin.metricName"))
+
+		responseHeaders = nil
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(reqs).To(HaveLen(sent))
+
+		time.Sleep(1100 * time.Millisecond)
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(len(reqs)).To(BeNumerically(">", sent))
+	})
+
+	It("backs off when Datadog does not say how long to wait", func() {
+		responseCode = http.StatusTooManyRequests
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(reqs).To(HaveLen(1))
+	})
+
+	It("keeps events queued when they are rate limited", func() {
+		c.AddEvent("title", "text", datadogclient.EventInfo)
+		responseHeaders = http.Header{"Retry-After": {"1"}}
+		ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/v1/events" {
+				responseCode = http.StatusTooManyRequests
+			}
+			handlePost(w, r)
+			responseCode = http.StatusOK
+		})
+
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(reqs).To(HaveLen(2))
+
+		ts.Config.Handler = http.HandlerFunc(handlePost)
+		responseHeaders = nil
+		time.Sleep(1100 * time.Millisecond)
+		Expect(c.PostMetrics()).To(Succeed())
+		var paths []string
+		for len(reqs) > 0 {
+			paths = append(paths, (<-reqs).URL.Path)
+		}
+		Expect(paths).To(ContainElement("/api/v1/events"))
+	})
+})
@@ -0,0 +1,45 @@
+package datadogclient
+
+import "runtime"
+
+// runtimeStats remembers the cumulative GC counters at the last flush, so
+// that each flush reports the collections that happened since.
+type runtimeStats struct {
+	enabled     bool
+	lastNumGC   uint32
+	lastPauseNs uint64
+}
+
+// SetRuntimeMetrics enables reporting the nozzle's own goroutine count,
+// heap size and GC pauses as internal metrics under runtime.
+func (c *Client) SetRuntimeMetrics(enabled bool) {
+	c.runtime.enabled = enabled
+}
+
+func (c *Client) addRuntimeMetrics() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	c.addInternalMetric("runtime.goroutines", uint64(runtime.NumGoroutine()))
+	c.addInternalMetric("runtime.heapAlloc", mem.HeapAlloc)
+	c.addInternalMetric("runtime.heapSys", mem.HeapSys)
+	c.addInternalMetric("runtime.heapObjects", mem.HeapObjects)
+	c.addInternalMetric("runtime.numGC", uint64(mem.NumGC-c.runtime.lastNumGC))
+	c.addInternalMetric("runtime.gcPauseNs", mem.PauseTotalNs-c.runtime.lastPauseNs)
+	c.addInternalMetric("runtime.gcPauseMaxNs", maxPauseSince(&mem, c.runtime.lastNumGC))
+
+	c.runtime.lastNumGC = mem.NumGC
+	c.runtime.lastPauseNs = mem.PauseTotalNs
+}
+
+// maxPauseSince returns the longest GC pause after the first lastNumGC
+// collections, as far back as MemStats keeps individual pauses.
+func maxPauseSince(mem *runtime.MemStats, lastNumGC uint32) uint64 {
+	var max uint64
+	for n := mem.NumGC; n > lastNumGC && mem.NumGC-n < uint32(len(mem.PauseNs)); n-- {
+		if pause := mem.PauseNs[(n+uint32(len(mem.PauseNs))-1)%uint32(len(mem.PauseNs))]; pause > max {
+			max = pause
+		}
+	}
+	return max
+}
@@ -0,0 +1,99 @@
+package datadogclient
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+type ServiceCheckStatus int
+
+const (
+	ServiceCheckOK       ServiceCheckStatus = 0
+	ServiceCheckWarning  ServiceCheckStatus = 1
+	ServiceCheckCritical ServiceCheckStatus = 2
+	ServiceCheckUnknown  ServiceCheckStatus = 3
+)
+
+func (s ServiceCheckStatus) String() string {
+	switch s {
+	case ServiceCheckOK:
+		return "OK"
+	case ServiceCheckWarning:
+		return "WARNING"
+	case ServiceCheckCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+type ServiceCheck struct {
+	Check     string             `json:"check"`
+	Status    ServiceCheckStatus `json:"status"`
+	Timestamp int64              `json:"timestamp"`
+	HostName  string             `json:"host_name,omitempty"`
+	Message   string             `json:"message,omitempty"`
+	Tags      []string           `json:"tags,omitempty"`
+}
+
+// SetServiceCheck records the current status of the named check. Every
+// check is submitted, with its latest status, after the metrics of each
+// flush, so that Datadog does not consider it stale.
+func (c *Client) SetServiceCheck(name string, status ServiceCheckStatus, message string) {
+	if c.serviceChecks == nil {
+		c.serviceChecks = make(map[string]ServiceCheck)
+	}
+	c.serviceChecks[name] = ServiceCheck{
+		Check:   name,
+		Status:  status,
+		Message: message,
+	}
+}
+
+func (c *Client) postServiceChecks() error {
+	for _, check := range c.currentServiceChecks() {
+		if err := c.postServiceCheck(check); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentServiceChecks returns the checks to submit, ordered by name.
+func (c *Client) currentServiceChecks() []ServiceCheck {
+	names := make([]string, 0, len(c.serviceChecks))
+	for name := range c.serviceChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := time.Now().Unix()
+	checks := make([]ServiceCheck, len(names))
+	for i, name := range names {
+		check := c.serviceChecks[name]
+		check.Check = c.prefix + name
+		check.Timestamp = now
+		check.HostName = c.hostName()
+		check.Tags = c.internalTags()
+		checks[i] = check
+	}
+	return checks
+}
+
+// hostName is the host checks are reported for: the nozzle's IP, or its
+// deployment when the IP is not known.
+func (c *Client) hostName() string {
+	if c.ip != "" {
+		return c.ip
+	}
+	return c.deployment
+}
+
+func (c *Client) postServiceCheck(check ServiceCheck) error {
+	body, err := json.Marshal(check)
+	if err != nil {
+		return err
+	}
+	return c.postJSON(c.endpointURL("check_run"), body)
+}
@@ -0,0 +1,112 @@
+package datadogclient_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+	"github.com/cloudfoundry/gosteno"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Service checks", func() {
+	var (
+		ts *httptest.Server
+		c  *datadogclient.Client
+	)
+
+	BeforeEach(func() {
+		bodies = nil
+		reqs = make(chan *http.Request, 1000)
+		responseCode = http.StatusOK
+		ts = httptest.NewServer(http.HandlerFunc(handlePost))
+		c = datadogclient.New(
+			ts.URL+"/api/v1/series",
+			"dummykey",
+			"datadog.nozzle.",
+			"test-deployment",
+			"dummy-ip",
+			time.Second,
+			10240,
+			nil,
+			logger.FromSteno(gosteno.NewLogger("datadogclient test")),
+		)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	postedChecks := func() []datadogclient.ServiceCheck {
+		bodies = nil
+		Expect(c.PostMetrics()).To(Succeed())
+
+		var checks []datadogclient.ServiceCheck
+		for _, body := range bodies {
+			req := <-reqs
+			if req.URL.Path == "/api/v1/series" {
+				continue
+			}
+
+			Expect(req.URL.Path).To(Equal("/api/v1/check_run"))
+			Expect(req.Header.Get("DD-API-KEY")).To(Equal("dummykey"))
+			var check datadogclient.ServiceCheck
+			Expect(json.Unmarshal(body, &check)).To(Succeed())
+			checks = append(checks, check)
+		}
+		return checks
+	}
+
+	It("does not submit checks until one is set", func() {
+		Expect(postedChecks()).To(BeEmpty())
+	})
+
+	It("submits every check with its latest status after the metrics", func() {
+		c.SetServiceCheck("firehose.connection", datadogclient.ServiceCheckOK, "connected")
+		c.SetServiceCheck("uaa.auth", datadogclient.ServiceCheckOK, "fetched a token")
+		c.SetServiceCheck("firehose.connection", datadogclient.ServiceCheckCritical, "disconnected")
+
+		checks := postedChecks()
+		Expect(checks).To(HaveLen(2))
+		Expect(checks[0].Check).To(Equal("datadog.nozzle.firehose.connection"))
+		Expect(checks[0].Status).To(Equal(datadogclient.ServiceCheckCritical))
+		Expect(checks[0].Message).To(Equal("disconnected"))
+		Expect(checks[0].Tags).To(ContainElement("deployment:test-deployment"))
+		Expect(checks[0].HostName).To(Equal("dummy-ip"))
+		Expect(checks[0].Timestamp).To(BeNumerically("~", time.Now().Unix(), 5))
+		Expect(checks[1].Check).To(Equal("datadog.nozzle.uaa.auth"))
+
+		Expect(postedChecks()).To(HaveLen(2))
+	})
+
+	It("does not fail the flush when a check can not be posted", func() {
+		ts.Close()
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/v1/check_run" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			handlePost(w, r)
+		}))
+		c = datadogclient.New(ts.URL+"/api/v1/series", "dummykey", "datadog.nozzle.", "test-deployment", "", time.Second, 10240, nil, logger.FromSteno(gosteno.NewLogger("datadogclient test")))
+		c.SetServiceCheck("uaa.auth", datadogclient.ServiceCheckOK, "fetched a token")
+
+		Expect(c.PostMetrics()).To(Succeed())
+		var req *http.Request
+		Expect(reqs).To(Receive(&req))
+		Expect(req.URL.Path).To(Equal("/api/v1/series"))
+	})
+
+	It("reports checks for the deployment when the IP is not known", func() {
+		c = datadogclient.New(ts.URL+"/api/v1/series", "dummykey", "datadog.nozzle.", "test-deployment", "", time.Second, 10240, nil, logger.FromSteno(gosteno.NewLogger("datadogclient test")))
+		c.SetServiceCheck("uaa.auth", datadogclient.ServiceCheckOK, "fetched a token")
+
+		checks := postedChecks()
+		Expect(checks).To(HaveLen(1))
+		Expect(checks[0].HostName).To(Equal("test-deployment"))
+	})
+})
@@ -1,62 +1,198 @@
 package datadogfirehosenozzle
 
 import (
-	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/localip"
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/envelopefile"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/nozzleconfig"
-	"github.com/cloudfoundry/gosteno"
-	"github.com/cloudfoundry/noaa/consumer"
-	noaaerrors "github.com/cloudfoundry/noaa/errors"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/transportconfig"
 	"github.com/cloudfoundry/sonde-go/events"
-	"github.com/gorilla/websocket"
 )
 
 type DatadogFirehoseNozzle struct {
 	config           *nozzleconfig.NozzleConfig
-	errs             <-chan error
-	messages         <-chan *events.Envelope
 	authTokenFetcher AuthTokenFetcher
-	consumer         *consumer.Consumer
+	source           EnvelopeSource
 	client           *datadogclient.Client
-	log              *gosteno.Logger
+	log              logger.Logger
+	reloads          chan reloadRequest
+	stop             chan struct{}
+	stopOnce         sync.Once
+	stopped          chan struct{}
+	version          string
+	recorder         *envelopefile.Writer
+	dryRunOut        io.Writer
+	dryRunFormat     string
+	discoverer       nozzleconfig.EndpointDiscoverer
+
+	receiving             bool
+	slowConsumerReported  bool
+	envelopeEvents        uint64
+	envelopeEventsDropped uint64
+}
+
+// Names of the service checks the nozzle reports, under the metric prefix.
+const (
+	firehoseCheck     = "firehose.connection"
+	slowConsumerCheck = "firehose.slow_consumer"
+	uaaCheck          = "uaa.auth"
+)
+
+// maxEnvelopeEvents is how many v2 Event envelopes from the RLP gateway are
+// posted as Datadog events per flush. Further ones are dropped and counted
+// in the envelopeEventsDropped internal metric.
+const maxEnvelopeEvents = 10
+
+type reloadRequest struct {
+	config *nozzleconfig.NozzleConfig
+	result chan error
 }
 
 type AuthTokenFetcher interface {
-	FetchAuthToken() string
+	FetchAuthToken() (string, error)
 }
 
-func NewDatadogFirehoseNozzle(config *nozzleconfig.NozzleConfig, tokenFetcher AuthTokenFetcher, log *gosteno.Logger) *DatadogFirehoseNozzle {
+func NewDatadogFirehoseNozzle(config *nozzleconfig.NozzleConfig, tokenFetcher AuthTokenFetcher, log logger.Logger) *DatadogFirehoseNozzle {
 	return &DatadogFirehoseNozzle{
 		config:           config,
 		authTokenFetcher: tokenFetcher,
-		log:              log,
+		log:              log.With("subscription_id", config.FirehoseSubscriptionID),
+		reloads:          make(chan reloadRequest),
+		stop:             make(chan struct{}),
+		stopped:          make(chan struct{}),
 	}
 }
 
+// SetRecorder writes every envelope received, before any filtering, to
+// recorder. It is flushed whenever metrics are posted.
+func (d *DatadogFirehoseNozzle) SetRecorder(recorder *envelopefile.Writer) {
+	d.recorder = recorder
+}
+
+// SetSource makes Start read envelopes from source instead of the firehose
+// or RLP gateway picked by EnvelopeSource.
+func (d *DatadogFirehoseNozzle) SetSource(source EnvelopeSource) {
+	d.source = source
+}
+
+// SetReplay makes Start read envelopes from replay instead of connecting to
+// the firehose, and return once they have all been posted.
+func (d *DatadogFirehoseNozzle) SetReplay(replay *envelopefile.Reader) {
+	d.SetSource(newReplaySource(replay))
+}
+
+// SetDryRun writes the metrics to out in format instead of posting them to
+// Datadog. See datadogclient.Client.SetDryRun.
+func (d *DatadogFirehoseNozzle) SetDryRun(out io.Writer, format string) {
+	d.dryRunOut = out
+	d.dryRunFormat = format
+}
+
+// SetRLPGatewayDiscoverer makes the RLP gateway source look up the gateway
+// URL with discoverer before every reconnect, for a URL that was discovered
+// rather than configured.
+func (d *DatadogFirehoseNozzle) SetRLPGatewayDiscoverer(discoverer nozzleconfig.EndpointDiscoverer) {
+	d.discoverer = discoverer
+}
+
+// SetVersion sets the version reported in the startup event.
+func (d *DatadogFirehoseNozzle) SetVersion(version string) {
+	d.version = version
+}
+
+// Stop makes Start post what is buffered and return. It does not wait for
+// Start to return.
+func (d *DatadogFirehoseNozzle) Stop() {
+	d.stopOnce.Do(func() { close(d.stop) })
+}
+
 func (d *DatadogFirehoseNozzle) Start() error {
 	var authToken string
 
-	if !d.config.DisableAccessControl {
-		authToken = d.authTokenFetcher.FetchAuthToken()
+	if d.source == nil {
+		d.source = d.newSource()
 	}
 
 	d.log.Info("Starting DataDog Firehose Nozzle...")
-	d.createClient()
-	d.consumeFirehose(authToken)
-	err := d.postToDatadog()
+	err := d.createClient()
+	if err != nil {
+		d.log.Errorf("Error creating datadog client: %s", err)
+		return err
+	}
+	// Each foundation has its own UAA, which the source fetches tokens from.
+	if !d.config.DisableAccessControl && d.source.Remote() && len(d.config.Foundations) == 0 {
+		authToken, err = d.authTokenFetcher.FetchAuthToken()
+		if err != nil {
+			d.failToStart(err)
+			return err
+		}
+		d.client.SetServiceCheck(uaaCheck, datadogclient.ServiceCheckOK, "Fetched a token from UAA")
+	}
+	if d.source.Remote() {
+		d.client.AddEvent("DataDog Firehose Nozzle started", d.startupSummary(), datadogclient.EventInfo)
+	}
+	err = d.source.Start(authToken)
+	if err != nil {
+		d.log.Errorf("Error connecting to %s: %s", d.source, err)
+		return err
+	}
+	err = d.postToDatadog()
+	close(d.stopped)
 	d.log.Info("DataDog Firehose Nozzle shutting down...")
 	return err
 }
 
-func (d *DatadogFirehoseNozzle) createClient() {
+// failToStart reports a nozzle that could not get a UAA token.
+func (d *DatadogFirehoseNozzle) failToStart(err error) {
+	message := fmt.Sprintf("Error getting oauth token: %s", err)
+	d.log.Errorf("%s. Please check the UAA settings and credentials.", message)
+	d.client.SetServiceCheck(uaaCheck, datadogclient.ServiceCheckCritical, message)
+	d.client.AddEvent("DataDog Firehose Nozzle failed to start", message, datadogclient.EventError)
+	d.client.Flush()
+}
+
+// Reload swaps in the reloadable settings of config, such as filters, the
+// metric prefix, tags and the flush interval, without reconnecting to the
+// firehose or dropping buffered metrics. The running config is left
+// untouched if config changes a setting that requires a restart.
+func (d *DatadogFirehoseNozzle) Reload(config *nozzleconfig.NozzleConfig) error {
+	req := reloadRequest{
+		config: config,
+		result: make(chan error, 1),
+	}
+
+	select {
+	case d.reloads <- req:
+		return <-req.result
+	case <-d.stopped:
+		return errors.New("nozzle is not running")
+	}
+}
+
+func (d *DatadogFirehoseNozzle) createClient() error {
 	ipAddress, err := localip.LocalIP()
 	if err != nil {
 		panic(err)
 	}
 
+	tlsConfig, err := transportconfig.NewTLSConfig(
+		d.config.DataDogCACertPath,
+		d.config.DataDogClientCertPath,
+		d.config.DataDogClientKeyPath,
+		false,
+	)
+	if err != nil {
+		return err
+	}
+
 	d.client = datadogclient.New(
 		d.config.DataDogURL,
 		d.config.DataDogAPIKey,
@@ -65,71 +201,248 @@ func (d *DatadogFirehoseNozzle) createClient() {
 		ipAddress,
 		time.Duration(d.config.DataDogTimeoutSeconds)*time.Second,
 		d.config.FlushMaxBytes,
+		transportconfig.NewTransport(tlsConfig, d.proxy()),
 		d.log,
 	)
+	d.client.SetCustomTags(d.config.CustomTags)
+	d.client.SetBufferLimits(d.config.MaxBufferedPoints, d.config.MaxBufferedBytes, d.config.BufferEvictionPolicy)
+	d.client.SetRuntimeMetrics(d.config.ReportRuntimeMetrics)
+	if d.config.CircuitBreakerFailures > 0 && !d.config.DisableCircuitBreaker {
+		d.client.SetCircuitBreaker(
+			d.config.CircuitBreakerFailures,
+			time.Duration(d.config.CircuitBreakerCooldownSeconds)*time.Second,
+		)
+		if d.config.MaxBufferedPoints == 0 && d.config.MaxBufferedBytes == 0 {
+			d.log.Warn("The circuit breaker keeps metrics buffered while Datadog is down, but neither MaxBufferedPoints nor MaxBufferedBytes is set, so the buffer can grow without bound")
+		}
+	}
+	if d.dryRunOut != nil {
+		d.client.SetDryRun(d.dryRunOut, d.dryRunFormat)
+	}
+	if d.config.MaxSeriesPerMetric > 0 {
+		d.client.SetCardinalityLimiter(datadogclient.NewCardinalityLimiter(
+			d.config.MaxSeriesPerMetric,
+			time.Duration(d.config.CardinalityWindowSeconds)*time.Second,
+			d.config.CardinalityPolicy,
+		))
+	}
+	return nil
 }
 
-func (d *DatadogFirehoseNozzle) consumeFirehose(authToken string) {
-	d.consumer = consumer.New(
-		d.config.TrafficControllerURL,
-		&tls.Config{InsecureSkipVerify: d.config.InsecureSSLSkipVerify},
-		nil)
-	d.consumer.SetIdleTimeout(time.Duration(d.config.IdleTimeoutSeconds) * time.Second)
-	d.messages, d.errs = d.consumer.Firehose(d.config.FirehoseSubscriptionID, authToken)
+func (d *DatadogFirehoseNozzle) newSource() EnvelopeSource {
+	if len(d.config.Foundations) > 0 {
+		return newFoundationsSource(d.config, d.proxy(), d.log)
+	}
+	if d.config.EnvelopeSource == nozzleconfig.EnvelopeSourceRLP {
+		return newRLPSource(d.config, d.proxy(), d.discoverer, d.log)
+	}
+	return newFirehoseSource(d.config, d.proxy(), d.log)
+}
+
+func (d *DatadogFirehoseNozzle) proxy() transportconfig.ProxyFunc {
+	return transportconfig.NewProxyFunc(d.config.HTTPProxy, d.config.HTTPSProxy, d.config.NoProxy)
 }
 
 func (d *DatadogFirehoseNozzle) postToDatadog() error {
-	ticker := time.NewTicker(time.Duration(d.config.FlushDurationSeconds) * time.Second)
+	messages, errs := d.source.Stream()
+	ticker := time.NewTicker(d.flushInterval())
+	defer func() { ticker.Stop() }()
 	for {
 		select {
 		case <-ticker.C:
 			d.postMetrics()
-		case envelope := <-d.messages:
+		case <-d.stop:
+			d.log.Info("Stopping DataDog Firehose Nozzle")
+			d.client.AddEvent("DataDog Firehose Nozzle stopped", "The nozzle was asked to stop.", datadogclient.EventInfo)
+			d.source.Close()
+			d.finalFlush()
+			return nil
+		case req := <-d.reloads:
+			flushInterval := d.flushInterval()
+			err := d.applyReload(req.config)
+			if err == nil && d.flushInterval() != flushInterval {
+				ticker.Stop()
+				ticker = time.NewTicker(d.flushInterval())
+			}
+			req.result <- err
+		case envelope := <-messages:
+			d.record(envelope)
+			if !d.receiving && d.source.Remote() {
+				d.receiving = true
+				d.client.SetServiceCheck(firehoseCheck, datadogclient.ServiceCheckOK, "Receiving envelopes from "+d.source.String())
+			}
 			if !d.keepMessage(envelope) {
 				continue
 			}
 
 			d.handleMessage(envelope)
 			d.client.AddMetric(envelope)
-		case err := <-d.errs:
-			d.handleError(err)
+		case err := <-errs:
+			sourceErr := d.source.Classify(err)
+			if sourceErr.Kind == SourceFinished {
+				d.log.Info(sourceErr.Message)
+				d.source.Close()
+				d.finalFlush()
+				return nil
+			}
+			d.handleError(err, sourceErr)
 			return err
 		}
 	}
 }
 
+func (d *DatadogFirehoseNozzle) startupSummary() string {
+	version := d.version
+	if version == "" {
+		version = "unknown"
+	}
+	filter := d.config.DeploymentFilter
+	if filter == "" {
+		filter = "none"
+	}
+
+	return fmt.Sprintf("Version: %s\nSubscription ID: %s\nSource: %s\nDatadog: %s\nMetric prefix: %s\nDeployment filter: %s\nFlush interval: %s",
+		version,
+		d.config.FirehoseSubscriptionID,
+		d.source,
+		d.config.DataDogURL,
+		d.config.MetricPrefix,
+		filter,
+		d.flushInterval(),
+	)
+}
+
+func (d *DatadogFirehoseNozzle) flushInterval() time.Duration {
+	return time.Duration(d.config.FlushDurationSeconds) * time.Second
+}
+
+func (d *DatadogFirehoseNozzle) applyReload(config *nozzleconfig.NozzleConfig) error {
+	changes, err := nozzleconfig.ReloadChanges(d.config, config)
+	if err != nil {
+		d.log.Errorf("Rejected config reload: %s", err)
+		return err
+	}
+	if len(changes) == 0 {
+		d.log.Debug("Reloaded config, nothing changed")
+		return nil
+	}
+
+	d.config = config
+	if foundations, ok := d.source.(*foundationsSource); ok {
+		foundations.SetSecrets(config.Foundations)
+	}
+	d.client.SetAPIKey(config.DataDogAPIKey)
+	d.client.SetPrefix(config.MetricPrefix)
+	d.client.SetCustomTags(config.CustomTags)
+	d.log.Infof("Reloaded config: %s", strings.Join(changes, ", "))
+	return nil
+}
+
+func (d *DatadogFirehoseNozzle) record(envelope *events.Envelope) {
+	if d.recorder == nil {
+		return
+	}
+	if err := d.recorder.Write(envelope); err != nil {
+		d.log.Errorf("Error recording envelope: %s", err)
+	}
+}
+
 func (d *DatadogFirehoseNozzle) postMetrics() {
+	d.prepareFlush()
 	err := d.client.PostMetrics()
 	if err != nil {
 		d.log.Fatalf("FATAL ERROR: %s\n\n", err)
 	}
 }
 
-func (d *DatadogFirehoseNozzle) handleError(err error) {
-	if retryErr, ok := err.(noaaerrors.RetryError); ok {
-		err = retryErr.Err
+// finalFlush posts what is left before the nozzle exits, even while the
+// circuit breaker is open or Datadog is rate limiting the nozzle. The
+// client logs whatever it has to drop.
+func (d *DatadogFirehoseNozzle) finalFlush() {
+	d.prepareFlush()
+	d.client.Flush()
+}
+
+// prepareFlush sets the internal metrics and service checks reported at
+// every flush.
+func (d *DatadogFirehoseNozzle) prepareFlush() {
+	if d.recorder != nil {
+		if err := d.recorder.Flush(); err != nil {
+			d.log.Errorf("Error flushing recorded envelopes: %s", err)
+		}
+	}
+
+	d.reportConnections()
+	if !d.slowConsumerReported {
+		d.client.SetServiceCheck(slowConsumerCheck, datadogclient.ServiceCheckOK, "The nozzle is keeping up with the firehose")
+	}
+	d.slowConsumerReported = false
+
+	if d.config.EnvelopeSource == nozzleconfig.EnvelopeSourceRLP {
+		if d.envelopeEventsDropped > 0 {
+			d.log.Warnf("Dropped %d events from the RLP gateway over the limit of %d per flush", d.envelopeEventsDropped, maxEnvelopeEvents)
+		}
+		d.client.SetInternalMetric("envelopeEventsDropped", d.envelopeEventsDropped)
+		d.envelopeEvents = 0
+		d.envelopeEventsDropped = 0
 	}
+}
 
-	switch closeErr := err.(type) {
-	case *websocket.CloseError:
-		switch closeErr.Code {
-		case websocket.CloseNormalClosure:
-		// no op
-		case websocket.ClosePolicyViolation:
-			d.log.Errorf("Error while reading from the firehose: %v", err)
-			d.log.Errorf("Disconnected because nozzle couldn't keep up. Please try scaling up the nozzle.")
-			d.client.AlertSlowConsumerError()
-		default:
-			d.log.Errorf("Error while reading from the firehose: %v", err)
+// reportConnections sets internal metrics for each connection of sources
+// that hold several or read from several foundations. The firehose service
+// check already covers a single connection.
+func (d *DatadogFirehoseNozzle) reportConnections() {
+	reporter, ok := d.source.(connectionReporter)
+	if !ok {
+		return
+	}
+	connections := reporter.Connections()
+	if len(connections) == 1 && connections[0].Foundation == "" {
+		return
+	}
+	for _, conn := range connections {
+		tags := []string{fmt.Sprintf("connection:%d", conn.ID)}
+		if conn.Foundation != "" {
+			tags = append(tags, "foundation:"+conn.Foundation)
 		}
+		var connected uint64
+		if conn.Connected {
+			connected = 1
+		}
+		d.client.SetInternalMetric("firehoseConnected", connected, tags...)
+		d.client.SetInternalMetric("firehoseReconnects", conn.Reconnects, tags...)
+		d.client.SetInternalMetric("firehoseEnvelopesReceived", conn.Envelopes, tags...)
+	}
+}
+
+func (d *DatadogFirehoseNozzle) handleError(err error, sourceErr SourceError) {
+	firehoseStatus := datadogclient.ServiceCheckCritical
+	switch sourceErr.Kind {
+	case SourceClosed:
+		firehoseStatus = datadogclient.ServiceCheckWarning
+		d.client.AddEvent("Firehose connection closed", sourceErr.Message, datadogclient.EventInfo)
+	case SourceSlowConsumer:
+		d.log.Errorf("Error while reading from the firehose: %v", err)
+		d.log.Errorf("Disconnected because nozzle couldn't keep up. Please try scaling up the nozzle.")
+		d.client.AddEvent("Firehose connection closed", sourceErr.Message, datadogclient.EventError)
+		d.alertSlowConsumer(datadogclient.ServiceCheckCritical, fmt.Sprintf("%s disconnected the nozzle because it could not keep up", d.source))
+	case SourceUnauthorized:
+		d.log.Errorf("Error while reading from the firehose: %v", err)
+		d.client.SetServiceCheck(uaaCheck, datadogclient.ServiceCheckCritical, sourceErr.Message)
+		d.client.AddEvent("Firehose connection failed", sourceErr.Message, datadogclient.EventError)
 	default:
 		d.log.Errorf("Error while reading from the firehose: %v", err)
-
+		d.client.AddEvent("Firehose connection failed", sourceErr.Message, datadogclient.EventError)
 	}
+	d.client.AddEvent("DataDog Firehose Nozzle shutting down", "The nozzle lost its firehose connection and is shutting down.", datadogclient.EventWarning)
 
-	d.log.Infof("Closing connection with traffic controller due to %v", err)
-	d.consumer.Close()
-	d.postMetrics()
+	if d.source.Remote() {
+		d.receiving = false
+		d.client.SetServiceCheck(firehoseCheck, firehoseStatus, fmt.Sprintf("Disconnected from the firehose: %v", err))
+		d.log.Infof("Closing connection with %s due to %v", d.source, err)
+	}
+	d.source.Close()
+	d.finalFlush()
 }
 
 func (d *DatadogFirehoseNozzle) keepMessage(envelope *events.Envelope) bool {
@@ -139,6 +452,32 @@ func (d *DatadogFirehoseNozzle) keepMessage(envelope *events.Envelope) bool {
 func (d *DatadogFirehoseNozzle) handleMessage(envelope *events.Envelope) {
 	if envelope.GetEventType() == events.Envelope_CounterEvent && envelope.CounterEvent.GetName() == "TruncatingBuffer.DroppedMessages" && envelope.GetOrigin() == "doppler" {
 		d.log.Infof("We've intercepted an upstream message which indicates that the nozzle or the TrafficController is not keeping up. Please try scaling up the nozzle.")
-		d.client.AlertSlowConsumerError()
+		d.alertSlowConsumer(datadogclient.ServiceCheckWarning, "Doppler dropped messages because the nozzle or Traffic Controller is not keeping up")
+	}
+	if envelope.GetEventType() == events.Envelope_Error && d.config.EnvelopeSource == nozzleconfig.EnvelopeSourceRLP {
+		d.addEnvelopeEvent(envelope)
+	}
+}
+
+// addEnvelopeEvent posts a converted v2 Event envelope as a Datadog event,
+// up to maxEnvelopeEvents per flush. Error envelopes from the v1 firehose
+// are not turned into events.
+func (d *DatadogFirehoseNozzle) addEnvelopeEvent(envelope *events.Envelope) {
+	if d.envelopeEvents >= maxEnvelopeEvents {
+		d.envelopeEventsDropped++
+		return
+	}
+	d.envelopeEvents++
+	d.client.AddEvent(envelope.GetError().GetSource(), envelope.GetError().GetMessage(), datadogclient.EventInfo)
+}
+
+// alertSlowConsumer sets slowConsumerAlert and the slow consumer service
+// check until the next flush.
+func (d *DatadogFirehoseNozzle) alertSlowConsumer(status datadogclient.ServiceCheckStatus, message string) {
+	if !d.slowConsumerReported {
+		d.client.AddEvent("Nozzle is not keeping up with the firehose", message, datadogclient.EventWarning)
 	}
+	d.client.AlertSlowConsumerError()
+	d.client.SetServiceCheck(slowConsumerCheck, status, message)
+	d.slowConsumerReported = true
 }
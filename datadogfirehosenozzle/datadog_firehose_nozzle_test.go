@@ -2,6 +2,14 @@ package datadogfirehosenozzle_test
 
 import (
 	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 
 	. "github.com/cloudfoundry-incubator/datadog-firehose-nozzle/testhelpers"
 	. "github.com/onsi/ginkgo"
@@ -14,7 +22,10 @@ import (
 
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogfirehosenozzle"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/envelopefile"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/nozzleconfig"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/rlpgateway"
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/uaatokenfetcher"
 	"github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/sonde-go/events"
@@ -29,7 +40,7 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 		fakeDatadogAPI *FakeDatadogAPI
 		config         *nozzleconfig.NozzleConfig
 		nozzle         *datadogfirehosenozzle.DatadogFirehoseNozzle
-		log            *gosteno.Logger
+		log            logger.Logger
 		logContent     *bytes.Buffer
 		fakeBuffer     *FakeBufferSink
 	)
@@ -62,11 +73,11 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 			},
 		}
 		gosteno.Init(c)
-		log = gosteno.NewLogger("test")
+		log = logger.FromSteno(gosteno.NewLogger("test"))
 	})
 
 	JustBeforeEach(func() {
-		tokenFetcher := uaatokenfetcher.New(fakeUAA.URL(), "un", "pwd", true, log)
+		tokenFetcher := uaatokenfetcher.New(fakeUAA.URL(), "un", "pwd", nil, log)
 		nozzle = datadogfirehosenozzle.NewDatadogFirehoseNozzle(config, tokenFetcher, log)
 	})
 
@@ -148,6 +159,90 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 		Expect(logOutput).To(ContainSubstring("Disconnected because nozzle couldn't keep up."))
 	}, 2)
 
+	It("does not post Error envelopes from the firehose as events", func() {
+		fakeFirehose.AddEvent(events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_Error.Enum(),
+			Error: &events.Error{
+				Source:  proto.String("cell"),
+				Code:    proto.Int32(1),
+				Message: proto.String("container failed"),
+			},
+		})
+
+		go nozzle.Start()
+
+		var titles []string
+		Eventually(func() []string {
+			var contents []byte
+			if len(fakeDatadogAPI.ReceivedEvents) > 0 {
+				contents = <-fakeDatadogAPI.ReceivedEvents
+				var event datadogclient.Event
+				Expect(json.Unmarshal(contents, &event)).To(Succeed())
+				titles = append(titles, event.Title)
+			}
+			return titles
+		}, 2).Should(ContainElement("DataDog Firehose Nozzle shutting down"))
+		Expect(titles).NotTo(ContainElement("cell"))
+	})
+
+	It("reports the firehose, slow consumer and UAA service checks", func(done Done) {
+		defer close(done)
+		fakeFirehose.AddEvent(events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+		})
+		fakeFirehose.SetCloseMessage(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Client did not respond to ping before keep-alive timeout expired."))
+
+		go nozzle.Start()
+
+		checks := make(map[string]datadogclient.ServiceCheck)
+		for len(checks) < 3 {
+			var contents []byte
+			Eventually(fakeDatadogAPI.ReceivedChecks).Should(Receive(&contents))
+
+			var check datadogclient.ServiceCheck
+			Expect(json.Unmarshal(contents, &check)).To(Succeed())
+			checks[check.Check] = check
+		}
+
+		Expect(checks["datadog.nozzle.firehose.connection"].Status).To(Equal(datadogclient.ServiceCheckCritical))
+		Expect(checks["datadog.nozzle.firehose.connection"].Message).To(ContainSubstring("Disconnected from the firehose"))
+		Expect(checks["datadog.nozzle.firehose.slow_consumer"].Status).To(Equal(datadogclient.ServiceCheckCritical))
+		Expect(checks["datadog.nozzle.uaa.auth"].Status).To(Equal(datadogclient.ServiceCheckOK))
+	}, 2)
+
+	It("posts events for startup, the disconnect and shutdown", func(done Done) {
+		defer close(done)
+		fakeFirehose.SetCloseMessage(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Client did not respond to ping before keep-alive timeout expired."))
+
+		nozzle.SetVersion("1.2.3")
+		go nozzle.Start()
+
+		var events []datadogclient.Event
+		for len(events) < 4 {
+			var contents []byte
+			Eventually(fakeDatadogAPI.ReceivedEvents).Should(Receive(&contents))
+
+			var event datadogclient.Event
+			Expect(json.Unmarshal(contents, &event)).To(Succeed())
+			events = append(events, event)
+		}
+
+		titles := make(map[string]datadogclient.Event)
+		for _, event := range events {
+			titles[event.Title] = event
+		}
+		Expect(titles).To(HaveKey("DataDog Firehose Nozzle started"))
+		Expect(titles["DataDog Firehose Nozzle started"].Text).To(ContainSubstring("Version: 1.2.3"))
+		Expect(titles["DataDog Firehose Nozzle started"].Text).To(ContainSubstring("Metric prefix: datadog.nozzle."))
+		Expect(titles["Firehose connection closed"].Text).To(Equal("Traffic Controller closed the connection with code 1008: Client did not respond to ping before keep-alive timeout expired."))
+		Expect(titles["Firehose connection closed"].AlertType).To(Equal("error"))
+		Expect(titles).To(HaveKey("Nozzle is not keeping up with the firehose"))
+		Expect(titles).To(HaveKey("DataDog Firehose Nozzle shutting down"))
+	}, 2)
+
 	It("does not report slow consumer error when closed for other reasons", func(done Done) {
 		defer close(done)
 
@@ -286,6 +381,656 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 		})
 	})
 
+	Context("when the traffic controller CA file can not be read", func() {
+		BeforeEach(func() {
+			config.TrafficControllerCACertPath = "/does/not/exist.pem"
+		})
+
+		It("Start returns an error", func() {
+			err := nozzle.Start()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Can not read CA certificate file"))
+			Expect(fakeFirehose.Requested()).To(BeFalse())
+		})
+	})
+
+	Context("when the traffic controller requires client certificates", func() {
+		var (
+			tlsFirehose *FakeFirehose
+			certDir     string
+		)
+
+		BeforeEach(func() {
+			var err error
+			certDir, err = ioutil.TempDir("", "nozzle-certs")
+			Expect(err).ToNot(HaveOccurred())
+
+			ca := NewFakeCertificateAuthority()
+			certPEM, keyPEM := ca.IssueCertificate("nozzle")
+			writeFile := func(name string, contents []byte) string {
+				path := filepath.Join(certDir, name)
+				Expect(ioutil.WriteFile(path, contents, 0600)).To(Succeed())
+				return path
+			}
+
+			serverTLS := ca.ServerTLSConfig()
+			serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+			serverTLS.ClientCAs = ca.CertPool()
+			tlsFirehose = NewFakeFirehose(fakeUAA.AuthToken())
+			tlsFirehose.StartTLS(serverTLS)
+
+			config.TrafficControllerURL = strings.Replace(tlsFirehose.URL(), "https:", "wss:", 1)
+			config.TrafficControllerCACertPath = writeFile("ca.pem", ca.CertPEM())
+			config.TrafficControllerClientCertPath = writeFile("client.pem", certPEM)
+			config.TrafficControllerClientKeyPath = writeFile("client.key", keyPEM)
+		})
+
+		AfterEach(func() {
+			tlsFirehose.Close()
+			os.RemoveAll(certDir)
+		})
+
+		It("connects with the client certificate", func() {
+			go nozzle.Start()
+			Eventually(tlsFirehose.Requested).Should(BeTrue())
+		})
+	})
+
+	Context("when the config is reloaded", func() {
+		var (
+			idleFirehose *FakeIdleFirehose
+			stopped      chan error
+		)
+
+		BeforeEach(func() {
+			idleFirehose = NewFakeIdleFirehose(10 * time.Second)
+			idleFirehose.Start()
+			config.TrafficControllerURL = strings.Replace(idleFirehose.URL(), "http:", "ws:", 1)
+		})
+
+		JustBeforeEach(func() {
+			stopped = make(chan error, 1)
+			go func() { stopped <- nozzle.Start() }()
+		})
+
+		AfterEach(func() {
+			idleFirehose.Close()
+			Eventually(stopped).Should(Receive())
+		})
+
+		It("applies the new prefix, tags and flush interval", func() {
+			reloaded := *config
+			reloaded.MetricPrefix = "reloaded."
+			reloaded.CustomTags = []string{"env:prod"}
+			reloaded.FlushDurationSeconds = 1
+			Expect(nozzle.Reload(&reloaded)).To(Succeed())
+
+			var contents []byte
+			Eventually(fakeDatadogAPI.ReceivedContents, 2).Should(Receive(&contents))
+
+			var payload datadogclient.Payload
+			Expect(json.Unmarshal(contents, &payload)).To(Succeed())
+			Expect(payload.Series).ToNot(BeEmpty())
+			for _, metric := range payload.Series {
+				Expect(metric.Metric).To(HavePrefix("reloaded."))
+				Expect(metric.Tags).To(ContainElement("env:prod"))
+			}
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring(`MetricPrefix: \"datadog.nozzle.\"`))
+		})
+
+		It("posts buffered metrics and a stop event when stopped", func() {
+			nozzle.Stop()
+			Eventually(stopped).Should(Receive(BeNil()))
+			stopped <- nil
+
+			Eventually(fakeDatadogAPI.ReceivedContents).Should(Receive())
+			var titles []string
+			for i := 0; i < 2; i++ {
+				var contents []byte
+				Eventually(fakeDatadogAPI.ReceivedEvents).Should(Receive(&contents))
+
+				var event datadogclient.Event
+				Expect(json.Unmarshal(contents, &event)).To(Succeed())
+				titles = append(titles, event.Title)
+			}
+			Expect(titles).To(ConsistOf("DataDog Firehose Nozzle started", "DataDog Firehose Nozzle stopped"))
+		})
+
+		It("rejects changes that need a restart", func() {
+			reloaded := *config
+			reloaded.MetricPrefix = "reloaded."
+			reloaded.Deployment = "other-deployment"
+
+			err := nozzle.Reload(&reloaded)
+			Expect(err).To(MatchError("Deployment can not be changed without a restart"))
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("Rejected config reload"))
+		})
+	})
+
+	Context("with several firehose connections", func() {
+		var (
+			idleFirehose *FakeIdleFirehose
+			stopped      chan error
+		)
+
+		BeforeEach(func() {
+			idleFirehose = NewFakeIdleFirehose(10 * time.Second)
+			idleFirehose.Start()
+			config.TrafficControllerURL = strings.Replace(idleFirehose.URL(), "http:", "ws:", 1)
+			config.FirehoseConnections = 3
+			config.FlushDurationSeconds = 1
+		})
+
+		JustBeforeEach(func() {
+			stopped = make(chan error, 1)
+			go func() { stopped <- nozzle.Start() }()
+		})
+
+		AfterEach(func() {
+			nozzle.Stop()
+			Eventually(stopped).Should(Receive())
+			idleFirehose.Close()
+		})
+
+		It("reports the health of each connection", func() {
+			connected := make(map[string]float64)
+			Eventually(func() map[string]float64 {
+				var contents []byte
+				Eventually(fakeDatadogAPI.ReceivedContents, 2).Should(Receive(&contents))
+
+				var payload datadogclient.Payload
+				Expect(json.Unmarshal(contents, &payload)).To(Succeed())
+				for _, metric := range payload.Series {
+					if metric.Metric != "datadog.nozzle.firehoseConnected" {
+						continue
+					}
+					for _, tag := range metric.Tags {
+						if strings.HasPrefix(tag, "connection:") {
+							connected[tag] = metric.Points[0].Value
+						}
+					}
+				}
+				return connected
+			}, 5).Should(Equal(map[string]float64{
+				"connection:0": 1,
+				"connection:1": 1,
+				"connection:2": 1,
+			}))
+		})
+	})
+
+	Context("with several foundations", func() {
+		var (
+			eastFirehose, westFirehose *FakeFirehose
+			stopped                    chan error
+		)
+
+		envelope := func(name string) events.Envelope {
+			return events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(name),
+					Value: proto.Float64(1),
+				},
+			}
+		}
+
+		BeforeEach(func() {
+			eastFirehose = NewFakeFirehose(fakeUAA.AuthToken())
+			eastFirehose.AddEvent(envelope("east-metric"))
+			eastFirehose.SetHoldOpen()
+			eastFirehose.Start()
+			westFirehose = NewFakeFirehose(fakeUAA.AuthToken())
+			westFirehose.AddEvent(envelope("west-metric"))
+			westFirehose.SetHoldOpen()
+			westFirehose.Start()
+
+			config.UAAURL = ""
+			config.TrafficControllerURL = ""
+			config.FlushDurationSeconds = 1
+			config.Foundations = []nozzleconfig.FoundationConfig{
+				{Name: "east", UAAURL: fakeUAA.URL(), Client: "nozzle", ClientSecret: "secret", TrafficControllerURL: strings.Replace(eastFirehose.URL(), "http:", "ws:", 1)},
+				{Name: "west", UAAURL: fakeUAA.URL(), Client: "nozzle", ClientSecret: "secret", TrafficControllerURL: strings.Replace(westFirehose.URL(), "http:", "ws:", 1)},
+			}
+		})
+
+		JustBeforeEach(func() {
+			stopped = make(chan error, 1)
+			go func() { stopped <- nozzle.Start() }()
+		})
+
+		AfterEach(func() {
+			nozzle.Stop()
+			Eventually(stopped).Should(Receive())
+			eastFirehose.Close()
+			westFirehose.Close()
+		})
+
+		It("tags every series with its foundation and reports each connection", func() {
+			tags := make(map[string][]string)
+			connected := make(map[string]float64)
+			Eventually(func() int {
+				var contents []byte
+				Eventually(fakeDatadogAPI.ReceivedContents, 2).Should(Receive(&contents))
+
+				var payload datadogclient.Payload
+				Expect(json.Unmarshal(contents, &payload)).To(Succeed())
+				for _, metric := range payload.Series {
+					switch metric.Metric {
+					case "datadog.nozzle.origin.east-metric", "datadog.nozzle.origin.west-metric":
+						tags[metric.Metric] = metric.Tags
+					case "datadog.nozzle.firehoseConnected":
+						for _, tag := range metric.Tags {
+							if strings.HasPrefix(tag, "foundation:") {
+								connected[tag] = metric.Points[0].Value
+							}
+						}
+					}
+				}
+				return len(tags) + len(connected)
+			}, 5).Should(Equal(4))
+
+			Expect(tags["datadog.nozzle.origin.east-metric"]).To(ContainElement("foundation:east"))
+			Expect(tags["datadog.nozzle.origin.west-metric"]).To(ContainElement("foundation:west"))
+			Expect(connected).To(Equal(map[string]float64{"foundation:east": 1, "foundation:west": 1}))
+			Expect(eastFirehose.LastAuthorization()).To(Equal(fakeUAA.AuthToken()))
+		})
+
+		It("accepts rotated foundation secrets on reload", func() {
+			Eventually(fakeDatadogAPI.ReceivedContents, 2).Should(Receive())
+
+			reloaded := *config
+			reloaded.Foundations = append([]nozzleconfig.FoundationConfig(nil), config.Foundations...)
+			reloaded.Foundations[1].ClientSecret = "rotated"
+			Expect(nozzle.Reload(&reloaded)).To(Succeed())
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("Foundations secrets changed"))
+			Expect(fakeBuffer.GetContent()).NotTo(ContainSubstring("rotated"))
+		})
+
+		Context("when doppler reports dropped messages", func() {
+			BeforeEach(func() {
+				westFirehose.AddEvent(events.Envelope{
+					Origin:    proto.String("doppler"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_CounterEvent.Enum(),
+					CounterEvent: &events.CounterEvent{
+						Name:  proto.String("TruncatingBuffer.DroppedMessages"),
+						Delta: proto.Uint64(1),
+						Total: proto.Uint64(1),
+					},
+				})
+			})
+
+			It("counts every envelope received by the connection", func() {
+				var received float64
+				Eventually(func() float64 {
+					var contents []byte
+					Eventually(fakeDatadogAPI.ReceivedContents, 2).Should(Receive(&contents))
+
+					var payload datadogclient.Payload
+					Expect(json.Unmarshal(contents, &payload)).To(Succeed())
+					for _, metric := range payload.Series {
+						if metric.Metric != "datadog.nozzle.firehoseEnvelopesReceived" {
+							continue
+						}
+						for _, tag := range metric.Tags {
+							if tag == "foundation:west" {
+								received += metric.Points[0].Value
+							}
+						}
+					}
+					return received
+				}, 5).Should(BeEquivalentTo(2))
+			})
+		})
+	})
+
+	Context("with an envelope source set", func() {
+		var (
+			source  *FakeEnvelopeSource
+			stopped chan error
+		)
+
+		BeforeEach(func() {
+			source = NewFakeEnvelopeSource()
+			config.FlushDurationSeconds = 1
+		})
+
+		JustBeforeEach(func() {
+			nozzle.SetSource(source)
+			stopped = make(chan error, 1)
+			go func() { stopped <- nozzle.Start() }()
+		})
+
+		It("starts it with a token and posts what it streams", func() {
+			source.Envelopes <- &events.Envelope{
+				Origin:    proto.String("origin"),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("synthetic"),
+					Value: proto.Float64(1),
+				},
+			}
+
+			var contents []byte
+			Eventually(fakeDatadogAPI.ReceivedContents, 2).Should(Receive(&contents))
+			Expect(string(contents)).To(ContainSubstring("datadog.nozzle.origin.synthetic"))
+			Expect(source.AuthToken()).To(Equal(fakeUAA.AuthToken()))
+
+			nozzle.Stop()
+			Eventually(stopped).Should(Receive(BeNil()))
+			Expect(source.Closed()).To(BeTrue())
+		})
+
+		It("reports errors the way the source classifies them", func() {
+			source.Classification = datadogfirehosenozzle.SourceError{
+				Kind:    datadogfirehosenozzle.SourceSlowConsumer,
+				Message: "fell behind",
+			}
+			source.Errors <- errors.New("disconnected")
+
+			Eventually(stopped).Should(Receive(MatchError("disconnected")))
+			Expect(source.Closed()).To(BeTrue())
+
+			var contents []byte
+			Eventually(fakeDatadogAPI.ReceivedContents).Should(Receive(&contents))
+			var payload datadogclient.Payload
+			Expect(json.Unmarshal(contents, &payload)).To(Succeed())
+			Expect(findSlowConsumerMetric(payload).Points[0].Value).To(BeEquivalentTo(1))
+		})
+
+		It("stops without an error when the source is finished", func() {
+			source.Classification = datadogfirehosenozzle.SourceError{Kind: datadogfirehosenozzle.SourceFinished}
+			source.Errors <- errors.New("done")
+
+			Eventually(stopped).Should(Receive(BeNil()))
+			Eventually(fakeDatadogAPI.ReceivedContents).Should(Receive())
+		})
+	})
+
+	Context("reading from the RLP gateway", func() {
+		var (
+			gateway *FakeRLPGateway
+			stopped chan error
+		)
+
+		BeforeEach(func() {
+			gateway = NewFakeRLPGateway()
+			gateway.Start()
+			config.EnvelopeSource = nozzleconfig.EnvelopeSourceRLP
+			config.RLPGatewayURL = gateway.URL()
+			config.RLPShardID = "datadog-nozzle"
+			config.RLPSelectors = []string{"gauge", "event"}
+			config.FlushDurationSeconds = 1
+		})
+
+		JustBeforeEach(func() {
+			stopped = make(chan error, 1)
+			go func() { stopped <- nozzle.Start() }()
+		})
+
+		AfterEach(func() {
+			gateway.Close()
+		})
+
+		It("posts the converted metrics and events", func() {
+			gateway.AddBatch(`{"batch":[{"source_id":"doppler","tags":{"deployment":"cf","job":"doppler"},"gauge":{"metrics":{"ingress":{"value":5},"egress":{"value":3}}}},{"source_id":"cc","event":{"title":"app crashed","body":"exit status 1"}}]}`)
+
+			Eventually(gateway.Requests).Should(HaveLen(1))
+			req := gateway.Requests()[0]
+			Expect(req.URL.RawQuery).To(Equal("shard_id=datadog-nozzle&gauge&event"))
+			Expect(req.Header.Get("Authorization")).To(Equal(fakeUAA.AuthToken()))
+
+			var contents []byte
+			Eventually(fakeDatadogAPI.ReceivedContents, 2).Should(Receive(&contents))
+			var payload datadogclient.Payload
+			Expect(json.Unmarshal(contents, &payload)).To(Succeed())
+			var names []string
+			for _, metric := range payload.Series {
+				names = append(names, metric.Metric)
+			}
+			Expect(names).To(ContainElement("datadog.nozzle.doppler.ingress"))
+			Expect(names).To(ContainElement("datadog.nozzle.doppler.egress"))
+
+			titles := make(map[string]datadogclient.Event)
+			for len(titles) < 2 {
+				Eventually(fakeDatadogAPI.ReceivedEvents).Should(Receive(&contents))
+				var event datadogclient.Event
+				Expect(json.Unmarshal(contents, &event)).To(Succeed())
+				titles[event.Title] = event
+			}
+			Expect(titles["DataDog Firehose Nozzle started"].Text).To(ContainSubstring("Source: RLP gateway " + gateway.URL()))
+			Expect(titles["app crashed"].Text).To(Equal("exit status 1"))
+
+			nozzle.Stop()
+			Eventually(stopped).Should(Receive(BeNil()))
+		})
+
+		It("posts a limited number of events per flush", func() {
+			var batch []string
+			for i := 0; i < 12; i++ {
+				batch = append(batch, fmt.Sprintf(`{"source_id":"cc","event":{"title":"app crashed %d","body":"exit status 1"}}`, i))
+			}
+			gateway.AddBatch(`{"batch":[` + strings.Join(batch, ",") + `]}`)
+
+			var contents []byte
+			Eventually(func() float64 {
+				Eventually(fakeDatadogAPI.ReceivedContents, 2).Should(Receive(&contents))
+				var payload datadogclient.Payload
+				Expect(json.Unmarshal(contents, &payload)).To(Succeed())
+				for _, metric := range payload.Series {
+					if metric.Metric == "datadog.nozzle.envelopeEventsDropped" {
+						return metric.Points[0].Value
+					}
+				}
+				return -1
+			}, 5).Should(BeEquivalentTo(2))
+
+			crashes := 0
+			for crashes < 10 {
+				Eventually(fakeDatadogAPI.ReceivedEvents).Should(Receive(&contents))
+				var event datadogclient.Event
+				Expect(json.Unmarshal(contents, &event)).To(Succeed())
+				if strings.HasPrefix(event.Title, "app crashed") {
+					crashes++
+				}
+			}
+			Consistently(fakeDatadogAPI.ReceivedEvents, 0.5).ShouldNot(Receive())
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("Dropped 2 events from the RLP gateway"))
+
+			nozzle.Stop()
+			Eventually(stopped).Should(Receive(BeNil()))
+		})
+
+		Context("when the gateway rejects the token", func() {
+			BeforeEach(func() {
+				gateway.SetStatusCode(http.StatusUnauthorized)
+			})
+
+			It("returns the error and reports the UAA check as critical", func() {
+				var err error
+				Eventually(stopped).Should(Receive(&err))
+				Expect(err).To(BeAssignableToTypeOf(&rlpgateway.StatusError{}))
+
+				checks := make(map[string]datadogclient.ServiceCheck)
+				for len(checks) < 3 {
+					var contents []byte
+					Eventually(fakeDatadogAPI.ReceivedChecks).Should(Receive(&contents))
+					var check datadogclient.ServiceCheck
+					Expect(json.Unmarshal(contents, &check)).To(Succeed())
+					checks[check.Check] = check
+				}
+				Expect(checks["datadog.nozzle.uaa.auth"].Status).To(Equal(datadogclient.ServiceCheckCritical))
+				Expect(checks["datadog.nozzle.firehose.connection"].Status).To(Equal(datadogclient.ServiceCheckCritical))
+			})
+		})
+	})
+
+	Context("when Datadog is down and the circuit breaker is enabled", func() {
+		var stopped chan error
+
+		BeforeEach(func() {
+			down := httptest.NewServer(http.NotFoundHandler())
+			down.Close()
+			config.DataDogURL = down.URL
+			config.FlushDurationSeconds = 1
+			config.CircuitBreakerFailures = 1
+			fakeFirehose.SetHoldOpen()
+		})
+
+		JustBeforeEach(func() {
+			stopped = make(chan error, 1)
+			go func() { stopped <- nozzle.Start() }()
+		})
+
+		It("keeps reading from the firehose instead of exiting", func() {
+			Consistently(stopped, 2500*time.Millisecond).ShouldNot(Receive())
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("Opening the circuit breaker"))
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("neither MaxBufferedPoints nor MaxBufferedBytes is set"))
+
+			nozzle.Stop()
+			Eventually(stopped).Should(Receive(BeNil()))
+		})
+
+		It("tries once more and logs what it drops when stopped", func() {
+			Consistently(stopped, 1500*time.Millisecond).ShouldNot(Receive())
+
+			nozzle.Stop()
+			Eventually(stopped).Should(Receive(BeNil()))
+			Expect(fakeBuffer.GetContent()).To(MatchRegexp(`Could not post the final flush, dropping \d+ points, \d+ events and \d+ service checks`))
+		})
+
+		Context("and the buffer is limited", func() {
+			BeforeEach(func() {
+				config.MaxBufferedPoints = 1000
+			})
+
+			It("does not warn about the buffer", func() {
+				Consistently(stopped, 1500*time.Millisecond).ShouldNot(Receive())
+				Expect(fakeBuffer.GetContent()).NotTo(ContainSubstring("neither MaxBufferedPoints nor MaxBufferedBytes is set"))
+
+				nozzle.Stop()
+				Eventually(stopped).Should(Receive(BeNil()))
+			})
+		})
+	})
+
+	Context("when the UAA rejects the credentials", func() {
+		BeforeEach(func() {
+			fakeUAA.Fail(1, http.StatusUnauthorized)
+		})
+
+		It("returns the error and reports the UAA check as critical", func() {
+			err := nozzle.Start()
+			Expect(err).To(MatchError(ContainSubstring("Bad credentials")))
+			Expect(fakeFirehose.Requested()).To(BeFalse())
+
+			var contents []byte
+			Eventually(fakeDatadogAPI.ReceivedChecks).Should(Receive(&contents))
+			var check datadogclient.ServiceCheck
+			Expect(json.Unmarshal(contents, &check)).To(Succeed())
+			Expect(check.Check).To(Equal("datadog.nozzle.uaa.auth"))
+			Expect(check.Status).To(Equal(datadogclient.ServiceCheckCritical))
+
+			Eventually(fakeDatadogAPI.ReceivedEvents).Should(Receive(&contents))
+			var event datadogclient.Event
+			Expect(json.Unmarshal(contents, &event)).To(Succeed())
+			Expect(event.Title).To(Equal("DataDog Firehose Nozzle failed to start"))
+		})
+	})
+
+	Context("recording envelopes", func() {
+		It("writes every envelope received, including filtered ones", func() {
+			config.DeploymentFilter = "deployment-name"
+			for _, deployment := range []string{"deployment-name", "other-deployment"} {
+				fakeFirehose.AddEvent(events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String("metricName"),
+						Value: proto.Float64(5),
+					},
+					Deployment: proto.String(deployment),
+				})
+			}
+
+			var recorded bytes.Buffer
+			nozzle.SetRecorder(envelopefile.NewWriter(&recorded))
+
+			stopped := make(chan error, 1)
+			go func() { stopped <- nozzle.Start() }()
+			Eventually(stopped, 2).Should(Receive())
+
+			reader := envelopefile.NewReader(&recorded)
+			var deployments []string
+			for {
+				envelope, err := reader.Read()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+				deployments = append(deployments, envelope.GetDeployment())
+			}
+			Expect(deployments).To(Equal([]string{"deployment-name", "other-deployment"}))
+		})
+	})
+
+	Context("replaying recorded envelopes", func() {
+		var recorded *bytes.Buffer
+
+		BeforeEach(func() {
+			config.TrafficControllerURL = "ws://localhost:1"
+			recorded = new(bytes.Buffer)
+			writer := envelopefile.NewWriter(recorded)
+			for i := 0; i < 3; i++ {
+				Expect(writer.Write(&events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String(fmt.Sprintf("metricName-%d", i)),
+						Value: proto.Float64(float64(i)),
+					},
+					Deployment: proto.String("deployment-name"),
+				})).To(Succeed())
+			}
+			Expect(writer.Flush()).To(Succeed())
+		})
+
+		It("posts the envelopes through the usual pipeline and returns", func() {
+			nozzle.SetReplay(envelopefile.NewReader(recorded))
+			Expect(nozzle.Start()).To(Succeed())
+
+			var contents []byte
+			Eventually(fakeDatadogAPI.ReceivedContents).Should(Receive(&contents))
+
+			var payload datadogclient.Payload
+			Expect(json.Unmarshal(contents, &payload)).To(Succeed())
+			for i := 0; i < 3; i++ {
+				Expect(payload.Series).To(ContainElement(HaveField("Metric", fmt.Sprintf("datadog.nozzle.origin.metricName-%d", i))))
+			}
+			Expect(fakeUAA.Requested()).To(BeFalse())
+		})
+
+		It("writes the metrics instead of posting them in a dry run", func() {
+			var out bytes.Buffer
+			nozzle.SetReplay(envelopefile.NewReader(recorded))
+			nozzle.SetDryRun(&out, datadogclient.DryRunFormatTable)
+			Expect(nozzle.Start()).To(Succeed())
+
+			Expect(out.String()).To(ContainSubstring("datadog.nozzle.origin.metricName-2"))
+			Consistently(fakeDatadogAPI.ReceivedContents).ShouldNot(Receive())
+		})
+
+		It("returns the error when the file is corrupt", func() {
+			nozzle.SetReplay(envelopefile.NewReader(bytes.NewReader(recorded.Bytes()[:recorded.Len()-2])))
+			Expect(nozzle.Start()).To(MatchError(ContainSubstring("reading envelope")))
+		})
+	})
+
 	Context("with DeploymentFilter provided", func() {
 		BeforeEach(func() {
 			config.DeploymentFilter = "good-deployment-name"
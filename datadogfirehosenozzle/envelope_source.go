@@ -0,0 +1,44 @@
+package datadogfirehosenozzle
+
+import "github.com/cloudfoundry/sonde-go/events"
+
+// EnvelopeSource is where the nozzle reads envelopes from, such as the
+// firehose, the RLP gateway or a recorded file.
+type EnvelopeSource interface {
+	// Start connects to the source. authToken is empty when the source is
+	// not Remote or access control is disabled.
+	Start(authToken string) error
+	// Stream returns the envelopes read after Start, and a channel that
+	// receives an error when the source stops.
+	Stream() (<-chan *events.Envelope, <-chan error)
+	Close()
+	// Classify tells the nozzle how to report an error from Stream.
+	Classify(err error) SourceError
+	// Remote reports whether the source connects to Loggregator, in which
+	// case the nozzle fetches a UAA token for it and reports the connection
+	// as a service check.
+	Remote() bool
+	String() string
+}
+
+type SourceErrorKind int
+
+const (
+	// SourceFailed is a lost or refused connection.
+	SourceFailed SourceErrorKind = iota
+	// SourceClosed is a connection the other end closed normally.
+	SourceClosed
+	// SourceSlowConsumer is a disconnect because the nozzle fell behind.
+	SourceSlowConsumer
+	// SourceUnauthorized is a rejected UAA token.
+	SourceUnauthorized
+	// SourceFinished means there are no more envelopes, like at the end of
+	// a replayed file. It is not reported as an error.
+	SourceFinished
+)
+
+type SourceError struct {
+	Kind SourceErrorKind
+	// Message describes the error for events and service checks.
+	Message string
+}
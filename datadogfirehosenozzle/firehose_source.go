@@ -0,0 +1,213 @@
+package datadogfirehosenozzle
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/nozzleconfig"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/transportconfig"
+	"github.com/cloudfoundry/noaa/consumer"
+	noaaerrors "github.com/cloudfoundry/noaa/errors"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gorilla/websocket"
+)
+
+// ConnectionStats describes one connection of a source.
+type ConnectionStats struct {
+	ID int
+	// Foundation is set when the source reads from several foundations.
+	Foundation string
+	Connected  bool
+	// Reconnects counts the connections made after the first one.
+	Reconnects uint64
+	// Envelopes counts the envelopes received since the last call to
+	// Connections.
+	Envelopes uint64
+}
+
+// connectionReporter is implemented by sources that can report on each of
+// their connections.
+type connectionReporter interface {
+	Connections() []ConnectionStats
+}
+
+// firehoseSource reads v1 envelopes from the Traffic Controller with noaa,
+// over FirehoseConnections websockets sharing one subscription ID. The
+// Traffic Controller balances the subscription across them.
+type firehoseSource struct {
+	config      *nozzleconfig.NozzleConfig
+	proxy       transportconfig.ProxyFunc
+	log         logger.Logger
+	connections []*firehoseConnection
+	messages    chan *events.Envelope
+	errs        chan error
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+type firehoseConnection struct {
+	// Updated from the noaa and fan-in goroutines. The 64 bit counters come
+	// first to keep them aligned for atomic access on 32 bit platforms.
+	connects  uint64
+	envelopes uint64
+	connected int32
+
+	id       int
+	consumer *consumer.Consumer
+}
+
+func newFirehoseSource(config *nozzleconfig.NozzleConfig, proxy transportconfig.ProxyFunc, log logger.Logger) *firehoseSource {
+	count := int(config.FirehoseConnections)
+	if count < 1 {
+		count = 1
+	}
+
+	return &firehoseSource{
+		config:      config,
+		proxy:       proxy,
+		log:         log,
+		connections: make([]*firehoseConnection, count),
+		messages:    make(chan *events.Envelope),
+		errs:        make(chan error, count),
+		done:        make(chan struct{}),
+	}
+}
+
+func (f *firehoseSource) Start(authToken string) error {
+	tlsConfig, err := transportconfig.NewTLSConfig(
+		f.config.TrafficControllerCACertPath,
+		f.config.TrafficControllerClientCertPath,
+		f.config.TrafficControllerClientKeyPath,
+		f.config.InsecureSSLSkipVerify,
+	)
+	if err != nil {
+		return err
+	}
+
+	for i := range f.connections {
+		conn := &firehoseConnection{id: i}
+		conn.consumer = consumer.New(
+			f.config.TrafficControllerURL,
+			tlsConfig,
+			f.proxy)
+		conn.consumer.SetIdleTimeout(time.Duration(f.config.IdleTimeoutSeconds) * time.Second)
+		conn.consumer.SetOnConnectCallback(f.onConnect(conn))
+		f.connections[i] = conn
+
+		messages, errs := conn.consumer.Firehose(f.config.FirehoseSubscriptionID, authToken)
+		go f.forward(conn, messages, errs)
+	}
+	return nil
+}
+
+func (f *firehoseSource) onConnect(conn *firehoseConnection) func() {
+	return func() {
+		atomic.StoreInt32(&conn.connected, 1)
+		if atomic.AddUint64(&conn.connects, 1) > 1 {
+			f.log.Infof("Firehose connection %d reconnected", conn.id)
+		}
+	}
+}
+
+// forward fans the envelopes of one connection into the shared channel,
+// until the connection fails or the source is closed.
+func (f *firehoseSource) forward(conn *firehoseConnection, messages <-chan *events.Envelope, errs <-chan error) {
+	for {
+		select {
+		case envelope, ok := <-messages:
+			if !ok {
+				messages = nil
+				continue
+			}
+			atomic.AddUint64(&conn.envelopes, 1)
+			select {
+			case f.messages <- envelope:
+			case <-f.done:
+				return
+			}
+		case err, ok := <-errs:
+			if !ok {
+				return
+			}
+			atomic.StoreInt32(&conn.connected, 0)
+			if len(f.connections) > 1 {
+				f.log.Errorf("Firehose connection %d failed: %v", conn.id, err)
+			}
+			f.errs <- err
+			return
+		case <-f.done:
+			return
+		}
+	}
+}
+
+func (f *firehoseSource) Stream() (<-chan *events.Envelope, <-chan error) {
+	return f.messages, f.errs
+}
+
+func (f *firehoseSource) Close() {
+	f.closeOnce.Do(func() { close(f.done) })
+	for _, conn := range f.connections {
+		if conn != nil {
+			conn.consumer.Close()
+		}
+	}
+}
+
+func (f *firehoseSource) Connections() []ConnectionStats {
+	stats := make([]ConnectionStats, 0, len(f.connections))
+	for _, conn := range f.connections {
+		if conn == nil {
+			continue
+		}
+		var reconnects uint64
+		if connects := atomic.LoadUint64(&conn.connects); connects > 1 {
+			reconnects = connects - 1
+		}
+		stats = append(stats, ConnectionStats{
+			ID:         conn.id,
+			Connected:  atomic.LoadInt32(&conn.connected) == 1,
+			Reconnects: reconnects,
+			Envelopes:  atomic.SwapUint64(&conn.envelopes, 0),
+		})
+	}
+	return stats
+}
+
+func (f *firehoseSource) Classify(err error) SourceError {
+	switch wrapped := err.(type) {
+	case noaaerrors.RetryError:
+		err = wrapped.Err
+	case noaaerrors.NonRetryError:
+		err = wrapped.Err
+	}
+
+	switch typed := err.(type) {
+	case *websocket.CloseError:
+		message := fmt.Sprintf("Traffic Controller closed the connection with code %d: %s", typed.Code, typed.Text)
+		switch typed.Code {
+		case websocket.CloseNormalClosure:
+			return SourceError{Kind: SourceClosed, Message: message}
+		case websocket.ClosePolicyViolation:
+			return SourceError{Kind: SourceSlowConsumer, Message: message}
+		}
+		return SourceError{Kind: SourceFailed, Message: message}
+	case *noaaerrors.UnauthorizedError:
+		return SourceError{Kind: SourceUnauthorized, Message: fmt.Sprintf("Traffic Controller rejected the UAA token: %v", err)}
+	}
+	return SourceError{Kind: SourceFailed, Message: err.Error()}
+}
+
+func (f *firehoseSource) Remote() bool {
+	return true
+}
+
+func (f *firehoseSource) String() string {
+	if len(f.connections) > 1 {
+		return fmt.Sprintf("Traffic Controller %s (%d connections)", f.config.TrafficControllerURL, len(f.connections))
+	}
+	return "Traffic Controller " + f.config.TrafficControllerURL
+}
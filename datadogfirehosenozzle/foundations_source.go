@@ -0,0 +1,193 @@
+package datadogfirehosenozzle
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/nozzleconfig"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/transportconfig"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/uaatokenfetcher"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// foundationsSource reads the firehoses of every foundation in Foundations,
+// with a UAA token from each foundation's own UAA, and tags every envelope
+// with the name of its foundation. Like a single firehose, it stops when
+// any of them fails.
+type foundationsSource struct {
+	config      *nozzleconfig.NozzleConfig
+	proxy       transportconfig.ProxyFunc
+	log         logger.Logger
+	foundations []*foundation
+	messages    chan *events.Envelope
+	errs        chan error
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+type foundation struct {
+	name         string
+	source       *firehoseSource
+	tokenFetcher *uaatokenfetcher.UAATokenFetcher
+}
+
+// foundationError is an error from the firehose of one foundation.
+type foundationError struct {
+	foundation *foundation
+	err        error
+}
+
+func (e *foundationError) Error() string {
+	return fmt.Sprintf("foundation %s: %v", e.foundation.name, e.err)
+}
+
+func newFoundationsSource(config *nozzleconfig.NozzleConfig, proxy transportconfig.ProxyFunc, log logger.Logger) *foundationsSource {
+	return &foundationsSource{
+		config:   config,
+		proxy:    proxy,
+		log:      log,
+		messages: make(chan *events.Envelope),
+		errs:     make(chan error, len(config.Foundations)),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start ignores authToken and fetches a token for each foundation instead.
+func (s *foundationsSource) Start(authToken string) error {
+	uaaTLSConfig, err := transportconfig.NewTLSConfig(
+		s.config.UAACACertPath,
+		s.config.UAAClientCertPath,
+		s.config.UAAClientKeyPath,
+		s.config.InsecureSSLSkipVerify,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, foundationConfig := range s.config.Foundations {
+		config := *s.config
+		config.UAAURL = foundationConfig.UAAURL
+		config.Client = foundationConfig.Client
+		config.ClientSecret = foundationConfig.ClientSecret
+		config.TrafficControllerURL = foundationConfig.TrafficControllerURL
+		config.FirehoseSubscriptionID = foundationConfig.FirehoseSubscriptionID
+
+		log := s.log.With("foundation", foundationConfig.Name)
+		var token string
+		var tokenFetcher *uaatokenfetcher.UAATokenFetcher
+		if !config.DisableAccessControl {
+			tokenFetcher = uaatokenfetcher.New(
+				config.UAAURL,
+				config.Client,
+				config.ClientSecret,
+				transportconfig.NewTransport(uaaTLSConfig, s.proxy),
+				log,
+			)
+			tokenFetcher.SetTimeout(time.Duration(config.UAATimeoutSeconds) * time.Second)
+			tokenFetcher.SetRetries(int(config.UAARetries), uaatokenfetcher.DefaultBackoff)
+			token, err = tokenFetcher.FetchAuthToken()
+			if err != nil {
+				s.Close()
+				return fmt.Errorf("foundation %s: %s", foundationConfig.Name, err)
+			}
+		}
+
+		f := &foundation{
+			name:         foundationConfig.Name,
+			source:       newFirehoseSource(&config, s.proxy, log),
+			tokenFetcher: tokenFetcher,
+		}
+		if err := f.source.Start(token); err != nil {
+			s.Close()
+			return fmt.Errorf("foundation %s: %s", f.name, err)
+		}
+		s.foundations = append(s.foundations, f)
+		go s.forward(f)
+	}
+	return nil
+}
+
+// SetSecrets passes the client secrets of foundations, after they have been
+// rotated, to the token fetchers of the running foundations.
+func (s *foundationsSource) SetSecrets(foundations []nozzleconfig.FoundationConfig) {
+	for _, f := range s.foundations {
+		if f.tokenFetcher == nil {
+			continue
+		}
+		for _, foundationConfig := range foundations {
+			if foundationConfig.Name == f.name {
+				f.tokenFetcher.SetPassword(foundationConfig.ClientSecret)
+			}
+		}
+	}
+}
+
+func (s *foundationsSource) forward(f *foundation) {
+	messages, errs := f.source.Stream()
+	for {
+		select {
+		case envelope := <-messages:
+			if envelope.Tags == nil {
+				envelope.Tags = make(map[string]string, 1)
+			}
+			envelope.Tags["foundation"] = f.name
+			select {
+			case s.messages <- envelope:
+			case <-s.done:
+				return
+			}
+		case err := <-errs:
+			s.errs <- &foundationError{foundation: f, err: err}
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *foundationsSource) Stream() (<-chan *events.Envelope, <-chan error) {
+	return s.messages, s.errs
+}
+
+func (s *foundationsSource) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	for _, f := range s.foundations {
+		f.source.Close()
+	}
+}
+
+func (s *foundationsSource) Connections() []ConnectionStats {
+	var stats []ConnectionStats
+	for _, f := range s.foundations {
+		for _, conn := range f.source.Connections() {
+			conn.Foundation = f.name
+			stats = append(stats, conn)
+		}
+	}
+	return stats
+}
+
+func (s *foundationsSource) Classify(err error) SourceError {
+	fErr, ok := err.(*foundationError)
+	if !ok {
+		return SourceError{Kind: SourceFailed, Message: err.Error()}
+	}
+	sourceErr := fErr.foundation.source.Classify(fErr.err)
+	sourceErr.Message = fmt.Sprintf("Foundation %s: %s", fErr.foundation.name, sourceErr.Message)
+	return sourceErr
+}
+
+func (s *foundationsSource) Remote() bool {
+	return true
+}
+
+func (s *foundationsSource) String() string {
+	names := make([]string, len(s.config.Foundations))
+	for i, f := range s.config.Foundations {
+		names[i] = f.Name
+	}
+	return fmt.Sprintf("foundations %s", strings.Join(names, ", "))
+}
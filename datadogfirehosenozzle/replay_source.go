@@ -0,0 +1,77 @@
+package datadogfirehosenozzle
+
+import (
+	"errors"
+	"io"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/envelopefile"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var errReplayDone = errors.New("replay finished")
+
+// replaySource reads envelopes recorded with SetRecorder.
+type replaySource struct {
+	reader   *envelopefile.Reader
+	messages chan *events.Envelope
+	errs     chan error
+	done     chan struct{}
+}
+
+func newReplaySource(reader *envelopefile.Reader) *replaySource {
+	return &replaySource{
+		reader:   reader,
+		messages: make(chan *events.Envelope),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (r *replaySource) Start(string) error {
+	go func() {
+		for {
+			envelope, err := r.reader.Read()
+			if err == io.EOF {
+				r.errs <- errReplayDone
+				return
+			}
+			if err != nil {
+				r.errs <- err
+				return
+			}
+			select {
+			case r.messages <- envelope:
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *replaySource) Stream() (<-chan *events.Envelope, <-chan error) {
+	return r.messages, r.errs
+}
+
+func (r *replaySource) Close() {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+}
+
+func (r *replaySource) Classify(err error) SourceError {
+	if err == errReplayDone {
+		return SourceError{Kind: SourceFinished, Message: "Finished replaying envelopes"}
+	}
+	return SourceError{Kind: SourceFailed, Message: err.Error()}
+}
+
+func (r *replaySource) Remote() bool {
+	return false
+}
+
+func (r *replaySource) String() string {
+	return "replay file"
+}
@@ -0,0 +1,93 @@
+package datadogfirehosenozzle
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/nozzleconfig"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/rlpgateway"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/transportconfig"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// rlpSource reads v2 envelopes from the RLP gateway.
+type rlpSource struct {
+	config     *nozzleconfig.NozzleConfig
+	proxy      transportconfig.ProxyFunc
+	log        logger.Logger
+	discoverer nozzleconfig.EndpointDiscoverer
+	client     *rlpgateway.Client
+	messages   <-chan *events.Envelope
+	errs       <-chan error
+}
+
+// newRLPSource reads from the RLP gateway of config. When discoverer is not
+// nil, the gateway URL is looked up with it again before every reconnect.
+func newRLPSource(config *nozzleconfig.NozzleConfig, proxy transportconfig.ProxyFunc, discoverer nozzleconfig.EndpointDiscoverer, log logger.Logger) *rlpSource {
+	return &rlpSource{config: config, proxy: proxy, discoverer: discoverer, log: log}
+}
+
+func (r *rlpSource) Start(authToken string) error {
+	tlsConfig, err := transportconfig.NewTLSConfig(
+		r.config.TrafficControllerCACertPath,
+		r.config.TrafficControllerClientCertPath,
+		r.config.TrafficControllerClientKeyPath,
+		r.config.InsecureSSLSkipVerify,
+	)
+	if err != nil {
+		return err
+	}
+
+	r.client = rlpgateway.New(
+		r.config.RLPGatewayURL,
+		r.config.RLPShardID,
+		r.config.RLPSelectors,
+		transportconfig.NewTransport(tlsConfig, r.proxy),
+		r.log,
+	)
+	if r.discoverer != nil {
+		r.client.SetURLResolver(r.discoverGateway)
+	}
+	r.messages, r.errs = r.client.Stream(authToken)
+	return nil
+}
+
+func (r *rlpSource) discoverGateway() (string, error) {
+	endpoints, err := r.discoverer.Endpoints()
+	if err != nil {
+		return "", err
+	}
+	if endpoints.RLPGatewayURL == "" {
+		return "", errors.New("the Cloud Controller no longer advertises it")
+	}
+	return endpoints.RLPGatewayURL, nil
+}
+
+func (r *rlpSource) Stream() (<-chan *events.Envelope, <-chan error) {
+	return r.messages, r.errs
+}
+
+func (r *rlpSource) Close() {
+	if r.client != nil {
+		r.client.Close()
+	}
+}
+
+func (r *rlpSource) Classify(err error) SourceError {
+	if statusErr, ok := err.(*rlpgateway.StatusError); ok {
+		if statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden {
+			return SourceError{Kind: SourceUnauthorized, Message: fmt.Sprintf("RLP gateway rejected the UAA token: %v", err)}
+		}
+	}
+	return SourceError{Kind: SourceFailed, Message: err.Error()}
+}
+
+func (r *rlpSource) Remote() bool {
+	return true
+}
+
+func (r *rlpSource) String() string {
+	return "RLP gateway " + r.config.RLPGatewayURL
+}
@@ -0,0 +1,73 @@
+package debugserver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+)
+
+// Server serves the pprof handlers under /debug/pprof/ and a JSON snapshot
+// of the Go runtime under /debug/runtime. It exposes the internals of the
+// process and should only listen on a loopback or otherwise private address.
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+type RuntimeStats struct {
+	Goroutines int              `json:"goroutines"`
+	MemStats   runtime.MemStats `json:"memstats"`
+}
+
+// Start listens on address and serves in the background until Close is
+// called.
+func Start(address string, log logger.Logger) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: listener,
+		server:   &http.Server{Handler: NewHandler()},
+	}
+
+	log.Infof("Serving debug endpoints on %s", listener.Addr())
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Debug server stopped: %s", err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+func NewHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", serveRuntimeStats)
+	return mux
+}
+
+func serveRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	stats := RuntimeStats{Goroutines: runtime.NumGoroutine()}
+	runtime.ReadMemStats(&stats.MemStats)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,67 @@
+package debugserver_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/debugserver"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/testhelpers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DebugServer", func() {
+	var server *debugserver.Server
+
+	BeforeEach(func() {
+		var err error
+		server, err = debugserver.Start("127.0.0.1:0", testhelpers.Logger())
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get("http://" + server.Addr() + path)
+		Expect(err).ToNot(HaveOccurred())
+		return resp
+	}
+
+	It("serves the pprof profiles", func() {
+		resp := get("/debug/pprof/goroutine?debug=1")
+		defer resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring("goroutine profile"))
+	})
+
+	It("serves runtime memstats and the goroutine count", func() {
+		resp := get("/debug/runtime")
+		defer resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+
+		var stats debugserver.RuntimeStats
+		Expect(json.NewDecoder(resp.Body).Decode(&stats)).To(Succeed())
+		Expect(stats.Goroutines).To(BeNumerically(">", 0))
+		Expect(stats.MemStats.HeapAlloc).To(BeNumerically(">", 0))
+	})
+
+	It("does not serve anything else", func() {
+		resp := get("/")
+		resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("fails to start on an address that is in use", func() {
+		_, err := debugserver.Start(server.Addr(), testhelpers.Logger())
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,13 @@
+package debugserver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDebugServer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "DebugServer Suite")
+}
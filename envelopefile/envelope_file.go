@@ -0,0 +1,79 @@
+package envelopefile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// maxEnvelopeBytes guards against reading a corrupt length and allocating
+// that much.
+const maxEnvelopeBytes = 16 << 20
+
+// Writer writes envelopes as a stream of protobufs, each prefixed with its
+// length as a varint, which Reader reads back.
+type Writer struct {
+	w      *bufio.Writer
+	header [binary.MaxVarintLen64]byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Write buffers envelope; call Flush to make sure it reaches the underlying
+// writer.
+func (w *Writer) Write(envelope *events.Envelope) error {
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	n := binary.PutUvarint(w.header[:], uint64(len(data)))
+	if _, err := w.w.Write(w.header[:n]); err != nil {
+		return err
+	}
+	_, err = w.w.Write(data)
+	return err
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next envelope, or io.EOF once the stream ends cleanly.
+func (r *Reader) Read() (*events.Envelope, error) {
+	size, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("reading envelope length: %s", err)
+	}
+	if size > maxEnvelopeBytes {
+		return nil, fmt.Errorf("envelope of %d bytes exceeds the limit of %d", size, maxEnvelopeBytes)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, fmt.Errorf("reading envelope: %s", err)
+	}
+
+	envelope := &events.Envelope{}
+	if err := proto.Unmarshal(data, envelope); err != nil {
+		return nil, fmt.Errorf("decoding envelope: %s", err)
+	}
+	return envelope, nil
+}
@@ -0,0 +1,76 @@
+package envelopefile_test
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/envelopefile"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EnvelopeFile", func() {
+	envelope := func(name string, value float64) *events.Envelope {
+		return &events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String(name),
+				Value: proto.Float64(value),
+			},
+			Deployment: proto.String("deployment-name"),
+			Tags:       map[string]string{"zone": "z1"},
+		}
+	}
+
+	It("reads back what was written, in order", func() {
+		var buf bytes.Buffer
+		w := envelopefile.NewWriter(&buf)
+		Expect(w.Write(envelope("a", 1))).To(Succeed())
+		Expect(w.Write(envelope("b", 2))).To(Succeed())
+		Expect(w.Flush()).To(Succeed())
+
+		r := envelopefile.NewReader(&buf)
+		first, err := r.Read()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(first).To(Equal(envelope("a", 1)))
+
+		second, err := r.Read()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(second).To(Equal(envelope("b", 2)))
+
+		_, err = r.Read()
+		Expect(err).To(Equal(io.EOF))
+	})
+
+	It("only writes envelopes through on Flush", func() {
+		var buf bytes.Buffer
+		w := envelopefile.NewWriter(&buf)
+		Expect(w.Write(envelope("a", 1))).To(Succeed())
+		Expect(buf.Len()).To(Equal(0))
+
+		Expect(w.Flush()).To(Succeed())
+		Expect(buf.Len()).To(BeNumerically(">", 0))
+	})
+
+	It("reports a truncated file", func() {
+		var buf bytes.Buffer
+		w := envelopefile.NewWriter(&buf)
+		Expect(w.Write(envelope("a", 1))).To(Succeed())
+		Expect(w.Flush()).To(Succeed())
+
+		r := envelopefile.NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+		_, err := r.Read()
+		Expect(err).To(HaveOccurred())
+		Expect(err).ToNot(Equal(io.EOF))
+	})
+
+	It("rejects implausible lengths", func() {
+		r := envelopefile.NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0x0f}))
+		_, err := r.Read()
+		Expect(err).To(MatchError(ContainSubstring("exceeds the limit")))
+	})
+})
@@ -159,6 +159,8 @@ var _ = Describe("DatadogFirehoseNozzle", func() {
 				Expect(metric.Points[0].Value).To(Equal(0.0))
 			} else if metric.Metric == "slowConsumerAlert" {
 
+			} else if metric.Metric == "circuitBreakerState" || metric.Metric == "circuitBreakerFailures" {
+				Expect(metric.Points[0].Value).To(Equal(0.0))
 			} else {
 				panic("Unknown metric " + metric.Metric)
 			}
@@ -0,0 +1,52 @@
+package integration_test
+
+import (
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("-validate-config", func() {
+	run := func(configPath string) *gexec.Session {
+		command := exec.Command(pathToNozzleExecutable, "-validate-config", "-config", configPath)
+		command.Env = []string{}
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		return session.Wait("5s")
+	}
+
+	It("exits successfully for a valid config", func() {
+		session := run("fixtures/test-config.json")
+		Expect(session).To(gexec.Exit(0))
+		Expect(session.Out).To(gbytes.Say("config is valid"))
+	})
+
+	It("reports every problem and exits with an error for an invalid config", func() {
+		session := run("fixtures/invalid-config.json")
+		Expect(session).To(gexec.Exit(1))
+		Expect(session.Err).To(gbytes.Say("Client is required"))
+		Expect(session.Err).To(gbytes.Say("TrafficControllerURL must use one of the schemes ws, wss"))
+		Expect(session.Err).To(gbytes.Say("DataDogAPIKey, DataDogAPIKeyFile or DataDogAPIKeyRef is required"))
+		Expect(session.Err).To(gbytes.Say("FlushMaxBytes is too low"))
+	})
+})
+
+var _ = Describe("-print-config", func() {
+	It("prints the merged config with secrets redacted", func() {
+		command := exec.Command(pathToNozzleExecutable, "-print-config", "-config", "fixtures/test-config.json", "-MetricPrefix", "flag-prefix")
+		command.Env = []string{"NOZZLE_DEPLOYMENT=env-deployment"}
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session, "5s").Should(gexec.Exit(0))
+
+		output := string(session.Out.Contents())
+		Expect(output).To(ContainSubstring(`"MetricPrefix": "flag-prefix"`))
+		Expect(output).To(ContainSubstring(`"Deployment": "env-deployment"`))
+		Expect(output).To(ContainSubstring(`"DataDogAPIKey": "REDACTED"`))
+		Expect(output).To(ContainSubstring(`"ClientSecret": "REDACTED"`))
+		Expect(output).ToNot(ContainSubstring("some-key"))
+	})
+})
@@ -1,38 +1,203 @@
 package logger
 
 import (
+	"fmt"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/cloudfoundry/gosteno"
 )
 
-func NewLogger(verbose bool, logFilePath, name string, syslogNamespace string) *gosteno.Logger {
-	level := gosteno.LOG_INFO
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Logger is what the rest of the nozzle logs through, so that packages do
+// not depend on gosteno directly.
+type Logger interface {
+	Debug(message string)
+	Debugf(format string, args ...interface{})
+	Info(message string)
+	Infof(format string, args ...interface{})
+	Warn(message string)
+	Warnf(format string, args ...interface{})
+	Error(message string)
+	Errorf(format string, args ...interface{})
+	Fatal(message string)
+	Fatalf(format string, args ...interface{})
+
+	// With returns a logger that adds key and value to the data of every
+	// line it writes, on top of the fields already set on this logger.
+	With(key string, value interface{}) Logger
+}
 
-	if verbose {
-		level = gosteno.LOG_DEBUG
+type Config struct {
+	Name            string
+	Level           string
+	Format          string
+	FilePath        string
+	SyslogNamespace string
+}
+
+// StenoLogger writes through gosteno. Its level can be changed while the
+// nozzle is running and applies to every logger derived from it with With.
+type StenoLogger struct {
+	steno  *gosteno.Logger
+	level  *sharedLevel
+	fields map[string]interface{}
+}
+
+type sharedLevel struct {
+	sync.RWMutex
+	value gosteno.LogLevel
+}
+
+// NewLogger initializes gosteno from config and returns the root logger.
+func NewLogger(config Config) (*StenoLogger, error) {
+	level, err := parseLevel(config.Level)
+	if err != nil {
+		return nil, err
 	}
 
+	var codec gosteno.Codec
+	switch config.Format {
+	case "", FormatJSON:
+		codec = gosteno.NewJsonCodec()
+	case FormatText:
+		codec = gosteno.NewJsonPrettifier(gosteno.EXCLUDE_NONE)
+	default:
+		return nil, fmt.Errorf("unknown log format %q: must be %s or %s", config.Format, FormatJSON, FormatText)
+	}
+
+	// No EnableLOC: gosteno takes the location from a fixed depth in the
+	// stack, which is always StenoLogger.log.
 	loggingConfig := &gosteno.Config{
-		Sinks:     make([]gosteno.Sink, 1),
-		Level:     level,
-		Codec:     gosteno.NewJsonCodec(),
-		EnableLOC: true}
+		Sinks: make([]gosteno.Sink, 1),
+		Level: gosteno.LOG_ALL,
+		Codec: codec,
+	}
 
-	if strings.TrimSpace(logFilePath) == "" {
+	if strings.TrimSpace(config.FilePath) == "" {
 		loggingConfig.Sinks[0] = gosteno.NewIOSink(os.Stdout)
 	} else {
-		loggingConfig.Sinks[0] = gosteno.NewFileSink(logFilePath)
+		loggingConfig.Sinks[0] = gosteno.NewFileSink(config.FilePath)
 	}
 
-	if syslogNamespace != "" {
-		loggingConfig.Sinks = append(loggingConfig.Sinks, GetNewSyslogSink(syslogNamespace))
+	if config.SyslogNamespace != "" {
+		loggingConfig.Sinks = append(loggingConfig.Sinks, GetNewSyslogSink(config.SyslogNamespace))
 	}
 
 	gosteno.Init(loggingConfig)
-	logger := gosteno.NewLogger(name)
-	logger.Debugf("Component %s in debug mode!", name)
+	logger := newStenoLogger(gosteno.NewLogger(config.Name), level)
+	logger.Debugf("Component %s in debug mode!", config.Name)
 
-	return logger
+	return logger, nil
+}
+
+// FromSteno wraps a gosteno logger that has already been initialized, as
+// tests do with their own sinks. Everything down to debug is logged.
+func FromSteno(steno *gosteno.Logger) *StenoLogger {
+	return newStenoLogger(steno, gosteno.LOG_DEBUG)
+}
+
+func newStenoLogger(steno *gosteno.Logger, level gosteno.LogLevel) *StenoLogger {
+	return &StenoLogger{
+		steno:  steno,
+		level:  &sharedLevel{value: level},
+		fields: map[string]interface{}{},
+	}
+}
+
+// SetLevel changes the level of this logger and every logger derived from
+// it. Valid levels are debug, info, warn and error.
+func (l *StenoLogger) SetLevel(name string) error {
+	level, err := parseLevel(name)
+	if err != nil {
+		return err
+	}
+
+	l.level.Lock()
+	defer l.level.Unlock()
+	l.level.value = level
+	return nil
+}
+
+func (l *StenoLogger) Level() string {
+	l.level.RLock()
+	defer l.level.RUnlock()
+	return l.level.value.Name
+}
+
+func (l *StenoLogger) With(key string, value interface{}) Logger {
+	fields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+
+	return &StenoLogger{
+		steno:  l.steno,
+		level:  l.level,
+		fields: fields,
+	}
+}
+
+func (l *StenoLogger) Debug(message string) { l.log(gosteno.LOG_DEBUG, message) }
+func (l *StenoLogger) Info(message string)  { l.log(gosteno.LOG_INFO, message) }
+func (l *StenoLogger) Warn(message string)  { l.log(gosteno.LOG_WARN, message) }
+func (l *StenoLogger) Error(message string) { l.log(gosteno.LOG_ERROR, message) }
+func (l *StenoLogger) Fatal(message string) { l.log(gosteno.LOG_FATAL, message) }
+
+func (l *StenoLogger) Debugf(format string, args ...interface{}) {
+	l.log(gosteno.LOG_DEBUG, fmt.Sprintf(format, args...))
+}
+
+func (l *StenoLogger) Infof(format string, args ...interface{}) {
+	l.log(gosteno.LOG_INFO, fmt.Sprintf(format, args...))
+}
+
+func (l *StenoLogger) Warnf(format string, args ...interface{}) {
+	l.log(gosteno.LOG_WARN, fmt.Sprintf(format, args...))
+}
+
+func (l *StenoLogger) Errorf(format string, args ...interface{}) {
+	l.log(gosteno.LOG_ERROR, fmt.Sprintf(format, args...))
+}
+
+func (l *StenoLogger) Fatalf(format string, args ...interface{}) {
+	l.log(gosteno.LOG_FATAL, fmt.Sprintf(format, args...))
+}
+
+func (l *StenoLogger) log(level gosteno.LogLevel, message string) {
+	l.level.RLock()
+	enabled := level.Priority <= l.level.value.Priority
+	l.level.RUnlock()
+
+	// Fatal always goes through, gosteno panics after writing it.
+	if !enabled && level != gosteno.LOG_FATAL {
+		return
+	}
+
+	data := make(map[string]interface{}, len(l.fields))
+	for k, v := range l.fields {
+		data[k] = v
+	}
+	l.steno.Log(level, message, data)
+}
+
+func parseLevel(name string) (gosteno.LogLevel, error) {
+	switch name {
+	case "debug":
+		return gosteno.LOG_DEBUG, nil
+	case "", "info":
+		return gosteno.LOG_INFO, nil
+	case "warn":
+		return gosteno.LOG_WARN, nil
+	case "error":
+		return gosteno.LOG_ERROR, nil
+	default:
+		return gosteno.LOG_INFO, fmt.Errorf("unknown log level %q: must be one of debug, info, warn, error", name)
+	}
 }
@@ -0,0 +1,118 @@
+package logger_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logger", func() {
+	var logFile string
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "nozzle-log")
+		Expect(err).ToNot(HaveOccurred())
+		f.Close()
+		logFile = f.Name()
+	})
+
+	AfterEach(func() {
+		os.Remove(logFile)
+	})
+
+	logLines := func() []string {
+		contents, err := ioutil.ReadFile(logFile)
+		Expect(err).ToNot(HaveOccurred())
+		trimmed := strings.TrimSpace(string(contents))
+		if trimmed == "" {
+			return nil
+		}
+		return strings.Split(trimmed, "\n")
+	}
+
+	newLogger := func(level, format string) *logger.StenoLogger {
+		log, err := logger.NewLogger(logger.Config{
+			Name:     "test",
+			Level:    level,
+			Format:   format,
+			FilePath: logFile,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return log
+	}
+
+	It("writes JSON records with the fields of the logger", func() {
+		log := newLogger("info", "json")
+		log.With("subscription_id", "datadog-nozzle").With("destination", "https://app.datadoghq.com").Info("Posting 3 metrics")
+
+		lines := logLines()
+		Expect(lines).To(HaveLen(1))
+
+		var record struct {
+			Message string                 `json:"message"`
+			Data    map[string]interface{} `json:"data"`
+		}
+		Expect(json.Unmarshal([]byte(lines[0]), &record)).To(Succeed())
+		Expect(record.Message).To(Equal("Posting 3 metrics"))
+		Expect(record.Data).To(Equal(map[string]interface{}{
+			"subscription_id": "datadog-nozzle",
+			"destination":     "https://app.datadoghq.com",
+		}))
+	})
+
+	It("does not add fields to the parent logger", func() {
+		log := newLogger("info", "json")
+		log.With("destination", "uaa")
+		log.Info("no fields")
+
+		Expect(logLines()[0]).ToNot(ContainSubstring("destination"))
+	})
+
+	It("writes text records", func() {
+		log := newLogger("info", "text")
+		log.Info("human readable")
+
+		lines := logLines()
+		Expect(lines).To(HaveLen(1))
+		Expect(lines[0]).To(ContainSubstring("human readable"))
+		Expect(lines[0]).ToNot(HavePrefix("{"))
+	})
+
+	It("drops lines below the level", func() {
+		log := newLogger("warn", "json")
+		log.Info("dropped")
+		log.Warn("kept")
+
+		lines := logLines()
+		Expect(lines).To(HaveLen(1))
+		Expect(lines[0]).To(ContainSubstring("kept"))
+	})
+
+	It("changes the level at runtime for derived loggers too", func() {
+		log := newLogger("info", "json")
+		derived := log.With("destination", "datadog")
+
+		derived.Debug("dropped")
+		Expect(log.SetLevel("debug")).To(Succeed())
+		derived.Debug("kept")
+
+		lines := logLines()
+		Expect(lines).To(HaveLen(1))
+		Expect(lines[0]).To(ContainSubstring("kept"))
+		Expect(log.Level()).To(Equal("debug"))
+	})
+
+	It("rejects unknown levels and formats", func() {
+		log := newLogger("info", "json")
+		Expect(log.SetLevel("verbose")).To(MatchError(`unknown log level "verbose": must be one of debug, info, warn, error`))
+		Expect(log.Level()).To(Equal("info"))
+
+		_, err := logger.NewLogger(logger.Config{Name: "test", Format: "xml", FilePath: logFile})
+		Expect(err).To(MatchError(`unknown log format "xml": must be json or text`))
+	})
+})
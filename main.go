@@ -1,54 +1,336 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"syscall"
+	"time"
 
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/cloudcontroller"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogclient"
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogfirehosenozzle"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/debugserver"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/envelopefile"
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/nozzleconfig"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/secrets"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/transportconfig"
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/uaatokenfetcher"
 )
 
-const flushMinBytes uint32 = 1024
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
 var (
-	logFilePath = flag.String("logFile", "", "The agent log file, defaults to STDOUT")
-	logLevel    = flag.Bool("debug", false, "Debug logging")
-	configFile  = flag.String("config", "config/datadog-firehose-nozzle.json", "Location of the nozzle config json file")
+	logFilePath    = flag.String("logFile", "", "The agent log file, defaults to STDOUT")
+	debug          = flag.Bool("debug", false, "Debug logging, same as -LogLevel debug")
+	configFile     = flag.String("config", "config/datadog-firehose-nozzle.json", "Location of the nozzle config file (JSON or YAML)")
+	validateConfig = flag.Bool("validate-config", false, "Validate the config and exit without connecting")
+	printConfig    = flag.Bool("print-config", false, "Print the effective config, with secrets redacted, and exit")
+	recordFile     = flag.String("record", "", "Append every envelope received from the firehose to this file")
+	replayFile     = flag.String("replay", "", "Read envelopes from a file written with -record instead of the firehose, post them and exit")
+	dryRun         = flag.Bool("dry-run", false, "Write the metrics that would be posted to Datadog to stderr, or -dry-run-file, instead")
+	dryRunFormat   = flag.String("dry-run-format", datadogclient.DryRunFormatJSON, "Format of the -dry-run output: json or table")
+	dryRunFile     = flag.String("dry-run-file", "", "Write the -dry-run output to this file instead of stderr")
+
+	configFlags = nozzleconfig.RegisterFlags(flag.CommandLine)
 )
 
 func main() {
 	flag.Parse()
 
-	log := logger.NewLogger(*logLevel, *logFilePath, "datadog-firehose-nozzle", "")
+	if *validateConfig {
+		os.Exit(runValidateConfig(*configFile))
+	}
+	if *printConfig {
+		os.Exit(runPrintConfig(*configFile))
+	}
+	if *dryRunFormat != datadogclient.DryRunFormatJSON && *dryRunFormat != datadogclient.DryRunFormatTable {
+		fmt.Fprintf(os.Stderr, "-dry-run-format must be json or table, got %q\n", *dryRunFormat)
+		os.Exit(1)
+	}
 
-	config, err := nozzleconfig.Parse(*configFile)
+	config, rlpDiscoverer, err := loadConfig(nil)
 	if err != nil {
-		log.Fatalf("Error parsing config: %s", err.Error())
+		fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+		os.Exit(1)
 	}
-	if config.FlushMaxBytes < flushMinBytes {
-		log.Fatalf("Config FlushMaxBytes is too low (%d): must be at least %d", config.FlushMaxBytes, flushMinBytes)
+
+	log, err := logger.NewLogger(logger.Config{
+		Name:            "datadog-firehose-nozzle",
+		Level:           config.LogLevel,
+		Format:          config.LogFormat,
+		FilePath:        *logFilePath,
+		SyslogNamespace: config.SyslogNamespace,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating logger: %s\n", err)
+		os.Exit(1)
+	}
+
+	uaaTLSConfig, err := transportconfig.NewTLSConfig(
+		config.UAACACertPath,
+		config.UAAClientCertPath,
+		config.UAAClientKeyPath,
+		config.InsecureSSLSkipVerify,
+	)
+	if err != nil {
+		log.Fatalf("Error loading UAA TLS config: %s", err.Error())
 	}
 
 	tokenFetcher := uaatokenfetcher.New(
 		config.UAAURL,
 		config.Client,
 		config.ClientSecret,
-		config.InsecureSSLSkipVerify,
+		transportconfig.NewTransport(
+			uaaTLSConfig,
+			transportconfig.NewProxyFunc(config.HTTPProxy, config.HTTPSProxy, config.NoProxy),
+		),
 		log,
 	)
+	tokenFetcher.SetTimeout(time.Duration(config.UAATimeoutSeconds) * time.Second)
+	tokenFetcher.SetRetries(int(config.UAARetries), uaatokenfetcher.DefaultBackoff)
+	switch config.UAAGrantType {
+	case nozzleconfig.UAAGrantPassword:
+		tokenFetcher.SetPasswordGrant(config.UAAUsername, config.UAAPassword)
+	case nozzleconfig.UAAGrantRefreshToken:
+		tokenFetcher.SetRefreshTokenGrant(config.UAARefreshToken)
+	}
+	if config.EnvelopeSource == nozzleconfig.EnvelopeSourceRLP {
+		tokenFetcher.SetRequiredScopes(uaatokenfetcher.FirehoseScope, uaatokenfetcher.LogsAdminScope)
+	}
 
 	threadDumpChan := registerGoRoutineDumpSignalChannel()
 	defer close(threadDumpChan)
 	go dumpGoRoutine(threadDumpChan)
 
+	if config.DebugAddress != "" {
+		debugServer, err := debugserver.Start(config.DebugAddress, log)
+		if err != nil {
+			log.Fatalf("Error starting debug server: %s", err.Error())
+		}
+		defer debugServer.Close()
+	}
+
 	log.Infof("Targeting datadog API URL: %s \n", config.DataDogURL)
 	datadog_nozzle := datadogfirehosenozzle.NewDatadogFirehoseNozzle(config, tokenFetcher, log)
-	datadog_nozzle.Start()
+	datadog_nozzle.SetVersion(version)
+	if rlpDiscoverer != nil {
+		datadog_nozzle.SetRLPGatewayDiscoverer(rlpDiscoverer)
+	}
+	if *recordFile != "" {
+		file, err := os.OpenFile(*recordFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("Error opening record file: %s", err.Error())
+		}
+		defer file.Close()
+		log.Infof("Recording envelopes to %s", *recordFile)
+		datadog_nozzle.SetRecorder(envelopefile.NewWriter(file))
+	}
+	if *replayFile != "" {
+		file, err := os.Open(*replayFile)
+		if err != nil {
+			log.Fatalf("Error opening replay file: %s", err.Error())
+		}
+		defer file.Close()
+		log.Infof("Replaying envelopes from %s", *replayFile)
+		datadog_nozzle.SetReplay(envelopefile.NewReader(file))
+	}
+	if *dryRun {
+		// Not stdout, where the logs go unless -logFile is given.
+		out := io.Writer(os.Stderr)
+		if *dryRunFile != "" {
+			file, err := os.OpenFile(*dryRunFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				log.Fatalf("Error opening dry run file: %s", err.Error())
+			}
+			defer file.Close()
+			out = file
+		}
+		log.Info("Dry run: metrics will not be posted to Datadog")
+		datadog_nozzle.SetDryRun(out, *dryRunFormat)
+	}
+	go watchConfig(datadog_nozzle, tokenFetcher, config, log)
+	go stopOnSignal(datadog_nozzle, log)
+	if err := datadog_nozzle.Start(); err != nil {
+		log.Errorf("DataDog Firehose Nozzle stopped: %s", err)
+		os.Exit(1)
+	}
+}
+
+// loadConfig reads, validates and resolves the secrets and endpoints of the
+// config, both at startup and on every reload. -replay and -dry-run leave
+// out the settings of what they do not connect to. Endpoints left empty are
+// filled in from endpoints, or discovered from the Cloud Controller when it
+// is nil. It also returns the discoverer the RLP gateway URL was found with,
+// or nil if the nozzle does not read from a discovered gateway.
+func loadConfig(endpoints nozzleconfig.EndpointDiscoverer) (*nozzleconfig.NozzleConfig, nozzleconfig.EndpointDiscoverer, error) {
+	config, err := nozzleconfig.Load(*configFile, configFlags)
+	if err != nil {
+		return nil, nil, err
+	}
+	if *debug {
+		config.LogLevel = "debug"
+	}
+	if err := config.ValidateOffline(*replayFile != "", *dryRun); err != nil {
+		return nil, nil, err
+	}
+
+	store := secrets.NewRegistry()
+	if config.CredHubURL != "" {
+		tlsConfig, err := transportconfig.NewTLSConfig(
+			config.CredHubCACertPath,
+			config.CredHubClientCertPath,
+			config.CredHubClientKeyPath,
+			config.InsecureSSLSkipVerify,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		store["credhub"] = secrets.NewCredHubProvider(
+			config.CredHubURL,
+			transportconfig.NewTransport(
+				tlsConfig,
+				transportconfig.NewProxyFunc(config.HTTPProxy, config.HTTPSProxy, config.NoProxy),
+			),
+		)
+	}
+
+	if err := config.ResolveSecrets(store); err != nil {
+		return nil, nil, err
+	}
+
+	var rlpDiscoverer nozzleconfig.EndpointDiscoverer
+	if config.CloudControllerURL != "" && *replayFile == "" {
+		if endpoints == nil {
+			tlsConfig, err := transportconfig.NewTLSConfig(config.CloudControllerCACertPath, "", "", config.InsecureSSLSkipVerify)
+			if err != nil {
+				return nil, nil, err
+			}
+			endpoints = cloudcontroller.New(
+				config.CloudControllerURL,
+				transportconfig.NewTransport(
+					tlsConfig,
+					transportconfig.NewProxyFunc(config.HTTPProxy, config.HTTPSProxy, config.NoProxy),
+				),
+			)
+		}
+		if config.EnvelopeSource == nozzleconfig.EnvelopeSourceRLP && config.RLPGatewayURL == "" {
+			rlpDiscoverer = endpoints
+		}
+		if err := config.ResolveEndpoints(endpoints); err != nil {
+			return nil, nil, err
+		}
+	}
+	return config, rlpDiscoverer, nil
+}
+
+// watchConfig reloads the config on SIGHUP, whenever the config file changes
+// on disk if ReloadIntervalSeconds is set, and every SecretRefreshSeconds so
+// that rotated secrets are picked up.
+func watchConfig(nozzle *datadogfirehosenozzle.DatadogFirehoseNozzle, tokenFetcher *uaatokenfetcher.UAATokenFetcher, config *nozzleconfig.NozzleConfig, log *logger.StenoLogger) {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	var fileChanged <-chan struct{}
+	if config.ReloadIntervalSeconds > 0 {
+		interval := time.Duration(config.ReloadIntervalSeconds) * time.Second
+		fileChanged = nozzleconfig.WatchFile(*configFile, interval, nil)
+	}
+
+	var secretRefresh <-chan time.Time
+	if config.SecretRefreshSeconds > 0 {
+		secretRefresh = time.NewTicker(time.Duration(config.SecretRefreshSeconds) * time.Second).C
+	}
+	startupEndpoints := config.ResolvedEndpoints()
+	current := config
+
+	for {
+		select {
+		case <-hupChan:
+			log.Info("Received SIGHUP, reloading config")
+		case <-fileChanged:
+			log.Infof("Config file %s changed, reloading config", *configFile)
+		case <-secretRefresh:
+			log.Debug("Re-reading secrets")
+		}
+
+		// The Cloud Controller is only asked at startup, so that reloads
+		// and secret rotation do not depend on it being up.
+		config, _, err := loadConfig(startupEndpoints)
+		if err != nil {
+			log.Errorf("Rejected config reload: %s", err)
+			continue
+		}
+		if err := nozzle.Reload(config); err == nil {
+			applySecrets(tokenFetcher, current, config)
+			log.SetLevel(config.LogLevel)
+			current = config
+		}
+	}
+}
+
+// applySecrets passes the UAA credentials of a reloaded config to
+// tokenFetcher. A refresh token is only replaced when the configured one
+// changed, since the UAA may have issued a newer one since startup.
+func applySecrets(tokenFetcher *uaatokenfetcher.UAATokenFetcher, current, reloaded *nozzleconfig.NozzleConfig) {
+	tokenFetcher.SetPassword(reloaded.ClientSecret)
+	switch reloaded.UAAGrantType {
+	case nozzleconfig.UAAGrantPassword:
+		tokenFetcher.SetPasswordGrant(reloaded.UAAUsername, reloaded.UAAPassword)
+	case nozzleconfig.UAAGrantRefreshToken:
+		if reloaded.UAARefreshToken != current.UAARefreshToken {
+			tokenFetcher.SetRefreshTokenGrant(reloaded.UAARefreshToken)
+		}
+	}
+}
+
+// stopOnSignal stops the nozzle on SIGTERM or SIGINT, so that buffered
+// metrics and the shutdown event are posted before the process exits.
+func stopOnSignal(nozzle *datadogfirehosenozzle.DatadogFirehoseNozzle, log logger.Logger) {
+	stopChan := make(chan os.Signal, 1)
+	signal.Notify(stopChan, syscall.SIGTERM, os.Interrupt)
+
+	sig := <-stopChan
+	log.Infof("Received %s, stopping", sig)
+	nozzle.Stop()
+}
+
+func runValidateConfig(configFile string) int {
+	config, err := nozzleconfig.Load(configFile, configFlags)
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, err)
+		return 1
+	}
+
+	fmt.Printf("%s: config is valid\n", configFile)
+	return 0
+}
+
+func runPrintConfig(configFile string) int {
+	config, err := nozzleconfig.Load(configFile, configFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, err)
+		return 1
+	}
+
+	validationErr := config.Validate()
+	configJSON, _ := json.MarshalIndent(config.Redacted(), "", "  ")
+	fmt.Println(string(configJSON))
+
+	if validationErr != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, validationErr)
+		return 1
+	}
+	return 0
 }
 
 func registerGoRoutineDumpSignalChannel() chan os.Signal {
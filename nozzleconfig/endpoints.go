@@ -0,0 +1,73 @@
+package nozzleconfig
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/cloudcontroller"
+)
+
+// EndpointDiscoverer looks up the endpoints of a foundation, such as the
+// Cloud Controller client.
+type EndpointDiscoverer interface {
+	Endpoints() (cloudcontroller.Endpoints, error)
+}
+
+// StaticEndpoints is an EndpointDiscoverer that returns endpoints found
+// earlier, so that a reloaded config keeps the endpoints resolved at startup
+// instead of asking the Cloud Controller again.
+type StaticEndpoints cloudcontroller.Endpoints
+
+func (e StaticEndpoints) Endpoints() (cloudcontroller.Endpoints, error) {
+	return cloudcontroller.Endpoints(e), nil
+}
+
+// ResolvedEndpoints returns the endpoints of a config ResolveEndpoints has
+// been called on.
+func (c *NozzleConfig) ResolvedEndpoints() StaticEndpoints {
+	return StaticEndpoints{
+		UAAURL:               c.UAAURL,
+		TrafficControllerURL: c.TrafficControllerURL,
+		RLPGatewayURL:        c.RLPGatewayURL,
+	}
+}
+
+// ResolveEndpoints fills in the UAAURL, TrafficControllerURL and
+// RLPGatewayURL left empty with the ones discoverer advertises, and checks
+// that every endpoint the nozzle needs is now set. Explicit values are kept.
+// It should be called after Validate when CloudControllerURL is set.
+func (c *NozzleConfig) ResolveEndpoints(discoverer EndpointDiscoverer) error {
+	endpoints, err := discoverer.Endpoints()
+	if err != nil {
+		return fmt.Errorf("Can not discover endpoints from %s: %s", c.CloudControllerURL, err)
+	}
+
+	if c.UAAURL == "" {
+		c.UAAURL = endpoints.UAAURL
+	}
+	if c.TrafficControllerURL == "" {
+		c.TrafficControllerURL = endpoints.TrafficControllerURL
+	}
+	if c.RLPGatewayURL == "" {
+		c.RLPGatewayURL = endpoints.RLPGatewayURL
+	}
+
+	problems := &ValidationError{}
+	if !c.DisableAccessControl {
+		validateDiscoveredURL(problems, "UAAURL", c.UAAURL, "http", "https")
+	}
+	switch c.EnvelopeSource {
+	case EnvelopeSourceFirehose:
+		validateDiscoveredURL(problems, "TrafficControllerURL", c.TrafficControllerURL, "ws", "wss")
+	case EnvelopeSourceRLP:
+		validateDiscoveredURL(problems, "RLPGatewayURL", c.RLPGatewayURL, "http", "https")
+	}
+	return problems.errOrNil()
+}
+
+func validateDiscoveredURL(problems *ValidationError, name, value string, schemes ...string) {
+	if value == "" {
+		problems.add("%s is not set and the Cloud Controller does not advertise it", name)
+		return
+	}
+	validateURL(problems, name, value, schemes...)
+}
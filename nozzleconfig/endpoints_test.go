@@ -0,0 +1,90 @@
+package nozzleconfig_test
+
+import (
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/cloudcontroller"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/nozzleconfig"
+	. "github.com/cloudfoundry-incubator/datadog-firehose-nozzle/testhelpers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ResolveEndpoints", func() {
+	var (
+		fakeCC *FakeCloudController
+		config *nozzleconfig.NozzleConfig
+	)
+
+	BeforeEach(func() {
+		fakeCC = NewFakeCloudController(
+			"https://uaa.example.com",
+			"wss://doppler.example.com:443",
+			"https://log-stream.example.com",
+		)
+		fakeCC.Start()
+
+		config = &nozzleconfig.NozzleConfig{
+			CloudControllerURL: fakeCC.URL(),
+			Client:             "client",
+			ClientSecret:       "secret",
+			DataDogAPIKey:      "api-key",
+		}
+		Expect(config.Validate()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		fakeCC.Close()
+	})
+
+	It("fills in the endpoints left empty", func() {
+		Expect(config.ResolveEndpoints(cloudcontroller.New(config.CloudControllerURL, nil))).To(Succeed())
+
+		Expect(config.UAAURL).To(Equal("https://uaa.example.com"))
+		Expect(config.TrafficControllerURL).To(Equal("wss://doppler.example.com:443"))
+		Expect(config.RLPGatewayURL).To(Equal("https://log-stream.example.com"))
+	})
+
+	It("keeps the endpoints that are set", func() {
+		config.TrafficControllerURL = "wss://doppler.internal:8081"
+
+		Expect(config.ResolveEndpoints(cloudcontroller.New(config.CloudControllerURL, nil))).To(Succeed())
+
+		Expect(config.UAAURL).To(Equal("https://uaa.example.com"))
+		Expect(config.TrafficControllerURL).To(Equal("wss://doppler.internal:8081"))
+	})
+
+	It("reports endpoints the Cloud Controller does not advertise", func() {
+		fakeCC.Close()
+		fakeCC = NewFakeCloudController("https://uaa.example.com", "", "")
+		fakeCC.Start()
+
+		err := config.ResolveEndpoints(cloudcontroller.New(fakeCC.URL(), nil))
+		Expect(err).To(MatchError(ContainSubstring("TrafficControllerURL is not set and the Cloud Controller does not advertise it")))
+	})
+
+	It("reports a Cloud Controller that can not be reached", func() {
+		fakeCC.DisableV2Info()
+		fakeCC.DisableV3Root()
+
+		err := config.ResolveEndpoints(cloudcontroller.New(config.CloudControllerURL, nil))
+		Expect(err).To(MatchError(ContainSubstring("Can not discover endpoints from " + fakeCC.URL())))
+	})
+
+	It("reuses the endpoints resolved earlier without asking the Cloud Controller", func() {
+		Expect(config.ResolveEndpoints(cloudcontroller.New(config.CloudControllerURL, nil))).To(Succeed())
+		requests := fakeCC.Requests()
+
+		reloaded := &nozzleconfig.NozzleConfig{
+			CloudControllerURL: config.CloudControllerURL,
+			Client:             "client",
+			ClientSecret:       "rotated",
+			DataDogAPIKey:      "api-key",
+		}
+		Expect(reloaded.Validate()).To(Succeed())
+		Expect(reloaded.ResolveEndpoints(config.ResolvedEndpoints())).To(Succeed())
+
+		Expect(reloaded.UAAURL).To(Equal("https://uaa.example.com"))
+		Expect(reloaded.TrafficControllerURL).To(Equal("wss://doppler.example.com:443"))
+		Expect(reloaded.RLPGatewayURL).To(Equal("https://log-stream.example.com"))
+		Expect(fakeCC.Requests()).To(Equal(requests))
+	})
+})
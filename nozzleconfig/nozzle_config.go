@@ -4,87 +4,219 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
 )
 
+// Every field needs an env tag naming the variable that overrides it; fields
+// tagged secret are redacted when the config is printed, and fields tagged
+// reload can be changed at runtime without reconnecting. The secrets of
+// Foundations can be changed at runtime too.
 type NozzleConfig struct {
+	UAAURL                 string `env:"NOZZLE_UAAURL"`
+	Client                 string `env:"NOZZLE_CLIENT"`
+	ClientSecret           string `env:"NOZZLE_CLIENT_SECRET" secret:"true" reload:"true"`
+	TrafficControllerURL   string `env:"NOZZLE_TRAFFICCONTROLLERURL"`
+	FirehoseSubscriptionID string `env:"NOZZLE_FIREHOSESUBSCRIPTIONID"`
+	DataDogURL             string `env:"NOZZLE_DATADOGURL"`
+	DataDogAPIKey          string `env:"NOZZLE_DATADOGAPIKEY" secret:"true" reload:"true"`
+	DataDogTimeoutSeconds  uint32 `env:"NOZZLE_DATADOGTIMEOUTSECONDS"`
+	FlushDurationSeconds   uint32 `env:"NOZZLE_FLUSHDURATIONSECONDS" reload:"true"`
+	FlushMaxBytes          uint32 `env:"NOZZLE_FLUSHMAXBYTES"`
+	InsecureSSLSkipVerify  bool   `env:"NOZZLE_INSECURESSLSKIPVERIFY"`
+	MetricPrefix           string `env:"NOZZLE_METRICPREFIX" reload:"true"`
+	Deployment             string `env:"NOZZLE_DEPLOYMENT"`
+	DeploymentFilter       string `env:"NOZZLE_DEPLOYMENT_FILTER" reload:"true"`
+	DisableAccessControl   bool   `env:"NOZZLE_DISABLEACCESSCONTROL"`
+	IdleTimeoutSeconds     uint32 `env:"NOZZLE_IDLETIMEOUTSECONDS"`
+	FirehoseConnections    uint32 `env:"NOZZLE_FIREHOSECONNECTIONS"`
+
+	// UAAGrantType is how the token is requested: client_credentials for
+	// Client itself, password for UAAUsername, or refresh_token with
+	// UAARefreshToken. Failed requests are retried UAARetries times.
+	UAAGrantType      string `env:"NOZZLE_UAAGRANTTYPE"`
+	UAAUsername       string `env:"NOZZLE_UAAUSERNAME"`
+	UAAPassword       string `env:"NOZZLE_UAAPASSWORD" secret:"true" reload:"true"`
+	UAARefreshToken   string `env:"NOZZLE_UAAREFRESHTOKEN" secret:"true" reload:"true"`
+	UAATimeoutSeconds uint32 `env:"NOZZLE_UAATIMEOUTSECONDS"`
+	UAARetries        uint32 `env:"NOZZLE_UAARETRIES"`
+
+	// CloudControllerURL, if set, is where UAAURL, TrafficControllerURL and
+	// RLPGatewayURL are discovered from when they are left empty.
+	CloudControllerURL string `env:"NOZZLE_CLOUDCONTROLLERURL"`
+
+	// Foundations, if set, replaces UAAURL, Client, ClientSecret,
+	// TrafficControllerURL and FirehoseSubscriptionID with one set per
+	// foundation, all consumed by this nozzle. The environment variable takes
+	// a JSON list.
+	Foundations []FoundationConfig `env:"NOZZLE_FOUNDATIONS"`
+
+	// EnvelopeSource selects where envelopes are read from: the v1 firehose
+	// at TrafficControllerURL or the v2 RLP gateway at RLPGatewayURL.
+	EnvelopeSource string   `env:"NOZZLE_ENVELOPESOURCE"`
+	RLPGatewayURL  string   `env:"NOZZLE_RLPGATEWAYURL"`
+	RLPShardID     string   `env:"NOZZLE_RLPSHARDID"`
+	RLPSelectors   []string `env:"NOZZLE_RLPSELECTORS"`
+
+	MaxSeriesPerMetric       uint32 `env:"NOZZLE_MAXSERIESPERMETRIC"`
+	CardinalityWindowSeconds uint32 `env:"NOZZLE_CARDINALITYWINDOWSECONDS"`
+	CardinalityPolicy        string `env:"NOZZLE_CARDINALITYPOLICY"`
+
+	MaxBufferedPoints    uint32 `env:"NOZZLE_MAXBUFFEREDPOINTS"`
+	MaxBufferedBytes     uint32 `env:"NOZZLE_MAXBUFFEREDBYTES"`
+	BufferEvictionPolicy string `env:"NOZZLE_BUFFEREVICTIONPOLICY"`
+
+	// After CircuitBreakerFailures consecutive failed requests to Datadog,
+	// posting stops for CircuitBreakerCooldownSeconds and metrics are kept
+	// buffered. With DisableCircuitBreaker, the nozzle exits on the first
+	// failed request instead.
+	CircuitBreakerFailures        uint32 `env:"NOZZLE_CIRCUITBREAKERFAILURES"`
+	CircuitBreakerCooldownSeconds uint32 `env:"NOZZLE_CIRCUITBREAKERCOOLDOWNSECONDS"`
+	DisableCircuitBreaker         bool   `env:"NOZZLE_DISABLECIRCUITBREAKER"`
+
+	LogLevel        string `env:"NOZZLE_LOGLEVEL" reload:"true"`
+	LogFormat       string `env:"NOZZLE_LOGFORMAT"`
+	SyslogNamespace string `env:"NOZZLE_SYSLOGNAMESPACE"`
+
+	DebugAddress         string `env:"NOZZLE_DEBUGADDRESS"`
+	ReportRuntimeMetrics bool   `env:"NOZZLE_REPORTRUNTIMEMETRICS"`
+
+	CustomTags            []string `env:"NOZZLE_CUSTOMTAGS" reload:"true"`
+	ReloadIntervalSeconds uint32   `env:"NOZZLE_RELOADINTERVALSECONDS"`
+
+	// Secrets can be read from a file or from a "scheme:name" reference
+	// instead of being set inline, and are re-read every SecretRefreshSeconds.
+	ClientSecretFile     string `env:"NOZZLE_CLIENT_SECRET_FILE" reload:"true"`
+	ClientSecretRef      string `env:"NOZZLE_CLIENT_SECRET_REF" reload:"true"`
+	DataDogAPIKeyFile    string `env:"NOZZLE_DATADOGAPIKEY_FILE" reload:"true"`
+	DataDogAPIKeyRef     string `env:"NOZZLE_DATADOGAPIKEY_REF" reload:"true"`
+	SecretRefreshSeconds uint32 `env:"NOZZLE_SECRETREFRESHSECONDS"`
+
+	CredHubURL            string `env:"NOZZLE_CREDHUBURL"`
+	CredHubCACertPath     string `env:"NOZZLE_CREDHUBCACERTPATH"`
+	CredHubClientCertPath string `env:"NOZZLE_CREDHUBCLIENTCERTPATH"`
+	CredHubClientKeyPath  string `env:"NOZZLE_CREDHUBCLIENTKEYPATH"`
+
+	HTTPProxy  string `env:"NOZZLE_HTTP_PROXY"`
+	HTTPSProxy string `env:"NOZZLE_HTTPS_PROXY"`
+	NoProxy    string `env:"NOZZLE_NO_PROXY"`
+
+	UAACACertPath                   string `env:"NOZZLE_UAACACERTPATH"`
+	UAAClientCertPath               string `env:"NOZZLE_UAACLIENTCERTPATH"`
+	UAAClientKeyPath                string `env:"NOZZLE_UAACLIENTKEYPATH"`
+	TrafficControllerCACertPath     string `env:"NOZZLE_TRAFFICCONTROLLERCACERTPATH"`
+	TrafficControllerClientCertPath string `env:"NOZZLE_TRAFFICCONTROLLERCLIENTCERTPATH"`
+	TrafficControllerClientKeyPath  string `env:"NOZZLE_TRAFFICCONTROLLERCLIENTKEYPATH"`
+	DataDogCACertPath               string `env:"NOZZLE_DATADOGCACERTPATH"`
+	DataDogClientCertPath           string `env:"NOZZLE_DATADOGCLIENTCERTPATH"`
+	DataDogClientKeyPath            string `env:"NOZZLE_DATADOGCLIENTKEYPATH"`
+	CloudControllerCACertPath       string `env:"NOZZLE_CLOUDCONTROLLERCACERTPATH"`
+}
+
+// FoundationConfig is how the nozzle connects to one of several Cloud
+// Foundry foundations. Name is added to every series as the foundation tag.
+// Like the top-level one, ClientSecret can be read from ClientSecretFile or
+// ClientSecretRef instead.
+type FoundationConfig struct {
+	Name                   string
 	UAAURL                 string
 	Client                 string
-	ClientSecret           string
+	ClientSecret           string `secret:"true"`
+	ClientSecretFile       string
+	ClientSecretRef        string
 	TrafficControllerURL   string
 	FirehoseSubscriptionID string
-	DataDogURL             string
-	DataDogAPIKey          string
-	DataDogTimeoutSeconds  uint32
-	FlushDurationSeconds   uint32
-	FlushMaxBytes          uint32
-	InsecureSSLSkipVerify  bool
-	MetricPrefix           string
-	Deployment             string
-	DeploymentFilter       string
-	DisableAccessControl   bool
-	IdleTimeoutSeconds     uint32
 }
 
 func Parse(configPath string) (*NozzleConfig, error) {
+	return Load(configPath, nil)
+}
+
+// Load builds the config from, in increasing order of precedence, the JSON
+// or YAML file at configPath, NOZZLE_* environment variables and any
+// command line flags set in flags.
+func Load(configPath string, flags *Flags) (*NozzleConfig, error) {
 	configBytes, err := ioutil.ReadFile(configPath)
 	var config NozzleConfig
 	if err != nil {
 		return nil, fmt.Errorf("Can not read config file [%s]: %s", configPath, err)
 	}
 
+	if isYAML(configPath) {
+		configBytes, err = yamlToJSON(configBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Can not parse config file %s: %s", configPath, err)
+		}
+	}
+
 	err = json.Unmarshal(configBytes, &config)
 	if err != nil {
 		return nil, fmt.Errorf("Can not parse config file %s: %s", configPath, err)
 	}
 
-	overrideWithEnvVar("NOZZLE_UAAURL", &config.UAAURL)
-	overrideWithEnvVar("NOZZLE_CLIENT", &config.Client)
-	overrideWithEnvVar("NOZZLE_CLIENT_SECRET", &config.ClientSecret)
-	overrideWithEnvVar("NOZZLE_TRAFFICCONTROLLERURL", &config.TrafficControllerURL)
-	overrideWithEnvVar("NOZZLE_FIREHOSESUBSCRIPTIONID", &config.FirehoseSubscriptionID)
-	overrideWithEnvVar("NOZZLE_DATADOGURL", &config.DataDogURL)
-	overrideWithEnvVar("NOZZLE_DATADOGAPIKEY", &config.DataDogAPIKey)
-	overrideWithEnvUint32("NOZZLE_DATADOGTIMEOUTSECONDS", &config.DataDogTimeoutSeconds)
-	overrideWithEnvVar("NOZZLE_METRICPREFIX", &config.MetricPrefix)
-	overrideWithEnvVar("NOZZLE_DEPLOYMENT", &config.Deployment)
-	overrideWithEnvVar("NOZZLE_DEPLOYMENT_FILTER", &config.DeploymentFilter)
-
-	overrideWithEnvUint32("NOZZLE_FLUSHDURATIONSECONDS", &config.FlushDurationSeconds)
-	overrideWithEnvUint32("NOZZLE_FLUSHMAXBYTES", &config.FlushMaxBytes)
-
-	overrideWithEnvBool("NOZZLE_INSECURESSLSKIPVERIFY", &config.InsecureSSLSkipVerify)
-	overrideWithEnvBool("NOZZLE_DISABLEACCESSCONTROL", &config.DisableAccessControl)
-	overrideWithEnvUint32("NOZZLE_IDLETIMEOUTSECONDS", &config.IdleTimeoutSeconds)
+	problems := &ValidationError{}
+	overrideWithEnv(problems, &config)
+	if flags != nil {
+		flags.override(problems, &config)
+	}
+	if err := problems.errOrNil(); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
 
-func overrideWithEnvVar(name string, value *string) {
-	envValue := os.Getenv(name)
-	if envValue != "" {
-		*value = envValue
-	}
+func isYAML(configPath string) bool {
+	ext := strings.ToLower(filepath.Ext(configPath))
+	return ext == ".yml" || ext == ".yaml"
 }
 
-func overrideWithEnvUint32(name string, value *uint32) {
-	envValue := os.Getenv(name)
-	if envValue != "" {
-		tmpValue, err := strconv.Atoi(envValue)
-		if err != nil {
-			panic(err)
-		}
-		*value = uint32(tmpValue)
+// yamlToJSON re-encodes a YAML document as JSON so both formats share the
+// same field names and decoding rules.
+func yamlToJSON(in []byte) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(in, &doc); err != nil {
+		return nil, err
+	}
+
+	converted, err := convertYAMLValue(doc)
+	if err != nil {
+		return nil, err
+	}
+	if converted == nil {
+		converted = map[string]interface{}{}
 	}
+	return json.Marshal(converted)
 }
 
-func overrideWithEnvBool(name string, value *bool) {
-	envValue := os.Getenv(name)
-	if envValue != "" {
-		var err error
-		*value, err = strconv.ParseBool(envValue)
-		if err != nil {
-			panic(err)
+func convertYAMLValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", key)
+			}
+			converted, err := convertYAMLValue(val)
+			if err != nil {
+				return nil, err
+			}
+			m[keyString] = converted
+		}
+		return m, nil
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			converted, err := convertYAMLValue(val)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = converted
 		}
+		return s, nil
+	default:
+		return v, nil
 	}
 }
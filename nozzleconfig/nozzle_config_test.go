@@ -62,4 +62,34 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.DisableAccessControl).To(Equal(true))
 		Expect(conf.IdleTimeoutSeconds).To(BeEquivalentTo(30))
 	})
+
+	It("successfully overwrites proxy and TLS settings with environmental variables", func() {
+		os.Setenv("NOZZLE_HTTP_PROXY", "http://proxy.internal:8080")
+		os.Setenv("NOZZLE_HTTPS_PROXY", "http://proxy.internal:8443")
+		os.Setenv("NOZZLE_NO_PROXY", "uaa.internal,doppler.internal")
+		os.Setenv("NOZZLE_UAACACERTPATH", "/certs/uaa-ca.pem")
+		os.Setenv("NOZZLE_UAACLIENTCERTPATH", "/certs/uaa-client.pem")
+		os.Setenv("NOZZLE_UAACLIENTKEYPATH", "/certs/uaa-client.key")
+		os.Setenv("NOZZLE_TRAFFICCONTROLLERCACERTPATH", "/certs/tc-ca.pem")
+		os.Setenv("NOZZLE_TRAFFICCONTROLLERCLIENTCERTPATH", "/certs/tc-client.pem")
+		os.Setenv("NOZZLE_TRAFFICCONTROLLERCLIENTKEYPATH", "/certs/tc-client.key")
+		os.Setenv("NOZZLE_DATADOGCACERTPATH", "/certs/datadog-ca.pem")
+		os.Setenv("NOZZLE_DATADOGCLIENTCERTPATH", "/certs/datadog-client.pem")
+		os.Setenv("NOZZLE_DATADOGCLIENTKEYPATH", "/certs/datadog-client.key")
+
+		conf, err := nozzleconfig.Parse("../config/datadog-firehose-nozzle.json")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.HTTPProxy).To(Equal("http://proxy.internal:8080"))
+		Expect(conf.HTTPSProxy).To(Equal("http://proxy.internal:8443"))
+		Expect(conf.NoProxy).To(Equal("uaa.internal,doppler.internal"))
+		Expect(conf.UAACACertPath).To(Equal("/certs/uaa-ca.pem"))
+		Expect(conf.UAAClientCertPath).To(Equal("/certs/uaa-client.pem"))
+		Expect(conf.UAAClientKeyPath).To(Equal("/certs/uaa-client.key"))
+		Expect(conf.TrafficControllerCACertPath).To(Equal("/certs/tc-ca.pem"))
+		Expect(conf.TrafficControllerClientCertPath).To(Equal("/certs/tc-client.pem"))
+		Expect(conf.TrafficControllerClientKeyPath).To(Equal("/certs/tc-client.key"))
+		Expect(conf.DataDogCACertPath).To(Equal("/certs/datadog-ca.pem"))
+		Expect(conf.DataDogClientCertPath).To(Equal("/certs/datadog-client.pem"))
+		Expect(conf.DataDogClientKeyPath).To(Equal("/certs/datadog-client.key"))
+	})
 })
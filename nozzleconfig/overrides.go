@@ -0,0 +1,160 @@
+package nozzleconfig
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// Flags exposes every config field as a command line flag named after the
+// field, e.g. -DataDogURL. Only flags given on the command line override the
+// file and environment.
+type Flags struct {
+	flagSet *flag.FlagSet
+	values  map[string]*fieldFlag
+}
+
+type fieldFlag struct {
+	raw    string
+	isBool bool
+}
+
+func (f *fieldFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.raw
+}
+
+func (f *fieldFlag) Set(raw string) error {
+	f.raw = raw
+	return nil
+}
+
+func (f *fieldFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+func RegisterFlags(flagSet *flag.FlagSet) *Flags {
+	flags := &Flags{
+		flagSet: flagSet,
+		values:  make(map[string]*fieldFlag),
+	}
+
+	forEachField(&NozzleConfig{}, func(field reflect.StructField, value reflect.Value) {
+		fieldValue := &fieldFlag{isBool: value.Kind() == reflect.Bool}
+		usage := fmt.Sprintf("Overrides %s from the config file and %s", field.Name, field.Tag.Get("env"))
+		flagSet.Var(fieldValue, field.Name, usage)
+		flags.values[field.Name] = fieldValue
+	})
+	return flags
+}
+
+func (f *Flags) override(problems *ValidationError, config *NozzleConfig) {
+	set := make(map[string]bool)
+	f.flagSet.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+
+	forEachField(config, func(field reflect.StructField, value reflect.Value) {
+		if set[field.Name] {
+			setField(problems, "-"+field.Name, f.values[field.Name].raw, value)
+		}
+	})
+}
+
+func overrideWithEnv(problems *ValidationError, config *NozzleConfig) {
+	forEachField(config, func(field reflect.StructField, value reflect.Value) {
+		name := field.Tag.Get("env")
+		if envValue := os.Getenv(name); envValue != "" {
+			setField(problems, name, envValue, value)
+		}
+	})
+}
+
+// Redacted returns a copy of the config with secret fields masked, suitable
+// for printing or logging.
+func (c *NozzleConfig) Redacted() NozzleConfig {
+	copied := *c
+	redactFields(reflect.ValueOf(&copied).Elem())
+	return copied
+}
+
+// redactFields masks the secret fields of a struct, and of the structs in
+// its slices, which it copies first so the original is left untouched.
+func redactFields(structValue reflect.Value) {
+	structType := structValue.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		field, value := structType.Field(i), structValue.Field(i)
+		switch {
+		case field.Tag.Get("secret") == "true" && value.String() != "":
+			value.SetString(redacted)
+		case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Struct:
+			items := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+			reflect.Copy(items, value)
+			for j := 0; j < items.Len(); j++ {
+				redactFields(items.Index(j))
+			}
+			value.Set(items)
+		}
+	}
+}
+
+func forEachField(config *NozzleConfig, fn func(reflect.StructField, reflect.Value)) {
+	configValue := reflect.ValueOf(config).Elem()
+	configType := configValue.Type()
+	for i := 0; i < configType.NumField(); i++ {
+		fn(configType.Field(i), configValue.Field(i))
+	}
+}
+
+func setField(problems *ValidationError, name, raw string, value reflect.Value) {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Uint32:
+		parsed, err := strconv.ParseUint(raw, 10, 32)
+		if err != nil {
+			problems.add("%s must be a non-negative integer, got %q", name, raw)
+			return
+		}
+		value.SetUint(parsed)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			problems.add("%s must be true or false, got %q", name, raw)
+			return
+		}
+		value.SetBool(parsed)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Struct {
+			parsed := reflect.New(value.Type())
+			if err := json.Unmarshal([]byte(raw), parsed.Interface()); err != nil {
+				// raw is not quoted since the list may hold secrets.
+				problems.add("%s must be a JSON list: %s", name, err)
+				return
+			}
+			value.Set(parsed.Elem())
+			return
+		}
+		if value.Type().Elem().Kind() != reflect.String {
+			problems.add("%s can not be overridden: unsupported type %s", name, value.Type())
+			return
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		problems.add("%s can not be overridden: unsupported type %s", name, value.Type())
+	}
+}
@@ -0,0 +1,171 @@
+package nozzleconfig_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/nozzleconfig"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config sources", func() {
+	BeforeEach(func() {
+		os.Clearenv()
+	})
+
+	It("maps every field to a unique NOZZLE_ environment variable", func() {
+		seen := make(map[string]string)
+		configType := reflect.TypeOf(nozzleconfig.NozzleConfig{})
+		for i := 0; i < configType.NumField(); i++ {
+			field := configType.Field(i)
+			env := field.Tag.Get("env")
+
+			Expect(env).To(HavePrefix("NOZZLE_"), "field %s has no env tag", field.Name)
+			Expect(seen).ToNot(HaveKey(env), "field %s reuses %s", field.Name, env)
+			seen[env] = field.Name
+		}
+	})
+
+	It("parses YAML config files", func() {
+		yamlConf, err := nozzleconfig.Parse("../config/datadog-firehose-nozzle.yml")
+		Expect(err).ToNot(HaveOccurred())
+
+		jsonConf, err := nozzleconfig.Parse("../config/datadog-firehose-nozzle.json")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(yamlConf).To(Equal(jsonConf))
+	})
+
+	Context("with command line flags", func() {
+		var (
+			flagSet *flag.FlagSet
+			flags   *nozzleconfig.Flags
+		)
+
+		BeforeEach(func() {
+			flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+			flags = nozzleconfig.RegisterFlags(flagSet)
+		})
+
+		It("registers a flag for every field", func() {
+			configType := reflect.TypeOf(nozzleconfig.NozzleConfig{})
+			for i := 0; i < configType.NumField(); i++ {
+				Expect(flagSet.Lookup(configType.Field(i).Name)).ToNot(BeNil())
+			}
+		})
+
+		It("gives flags precedence over the environment and the file", func() {
+			os.Setenv("NOZZLE_METRICPREFIX", "env-prefix")
+			os.Setenv("NOZZLE_DEPLOYMENT", "env-deployment")
+			Expect(flagSet.Parse([]string{"-MetricPrefix", "flag-prefix", "-FlushDurationSeconds", "3", "-DisableAccessControl"})).To(Succeed())
+
+			conf, err := nozzleconfig.Load("../config/datadog-firehose-nozzle.json", flags)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(conf.MetricPrefix).To(Equal("flag-prefix"))
+			Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(3))
+			Expect(conf.DisableAccessControl).To(BeTrue())
+			Expect(conf.Deployment).To(Equal("env-deployment"))
+			Expect(conf.UAAURL).To(Equal("https://uaa.walnut.cf-app.com"))
+		})
+
+		It("does not override with flags that were not set", func() {
+			Expect(flagSet.Parse([]string{})).To(Succeed())
+
+			conf, err := nozzleconfig.Load("../config/datadog-firehose-nozzle.json", flags)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.MetricPrefix).To(Equal("datadogclient"))
+			Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(15))
+		})
+
+		It("reports malformed flag values", func() {
+			Expect(flagSet.Parse([]string{"-FlushMaxBytes", "lots"})).To(Succeed())
+
+			_, err := nozzleconfig.Load("../config/datadog-firehose-nozzle.json", flags)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`-FlushMaxBytes must be a non-negative integer, got "lots"`))
+		})
+	})
+
+	Describe("Redacted", func() {
+		It("masks secrets without modifying the config", func() {
+			conf, err := nozzleconfig.Parse("../config/datadog-firehose-nozzle.json")
+			Expect(err).ToNot(HaveOccurred())
+
+			redacted := conf.Redacted()
+			Expect(redacted.ClientSecret).To(Equal("REDACTED"))
+			Expect(redacted.DataDogAPIKey).To(Equal("REDACTED"))
+			Expect(redacted.Client).To(Equal("user"))
+
+			Expect(conf.ClientSecret).To(Equal("user_password"))
+		})
+
+		It("masks the secrets of every foundation", func() {
+			conf := &nozzleconfig.NozzleConfig{
+				Foundations: []nozzleconfig.FoundationConfig{
+					{Name: "east", Client: "nozzle", ClientSecret: "east-secret"},
+					{Name: "west", Client: "nozzle"},
+				},
+			}
+
+			redacted := conf.Redacted()
+			Expect(redacted.Foundations[0].ClientSecret).To(Equal("REDACTED"))
+			Expect(redacted.Foundations[0].Client).To(Equal("nozzle"))
+			Expect(redacted.Foundations[1].ClientSecret).To(BeEmpty())
+
+			Expect(conf.Foundations[0].ClientSecret).To(Equal("east-secret"))
+		})
+
+		It("leaves unset secrets empty", func() {
+			conf := &nozzleconfig.NozzleConfig{}
+			Expect(conf.Redacted().ClientSecret).To(BeEmpty())
+		})
+	})
+
+	It("reads foundations from the environment as JSON", func() {
+		os.Setenv("NOZZLE_FOUNDATIONS", `[{"Name":"east","TrafficControllerURL":"wss://doppler.east.example.com:443"}]`)
+
+		conf, err := nozzleconfig.Parse("../config/datadog-firehose-nozzle.json")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Foundations).To(Equal([]nozzleconfig.FoundationConfig{
+			{Name: "east", TrafficControllerURL: "wss://doppler.east.example.com:443"},
+		}))
+
+		os.Setenv("NOZZLE_FOUNDATIONS", "east,west")
+		_, err = nozzleconfig.Parse("../config/datadog-firehose-nozzle.json")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("NOZZLE_FOUNDATIONS must be a JSON list: "))
+	})
+
+	It("does not quote malformed foundations, which may hold secrets", func() {
+		os.Setenv("NOZZLE_FOUNDATIONS", `[{"Name":"east","ClientSecret":"east-secret"`)
+
+		_, err := nozzleconfig.Parse("../config/datadog-firehose-nozzle.json")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("NOZZLE_FOUNDATIONS must be a JSON list"))
+		Expect(err.Error()).NotTo(ContainSubstring("east-secret"))
+	})
+
+	It("reports the file name when YAML is malformed", func() {
+		path := writeTempFile("config-*.yml", "UAAURL: [unterminated")
+		defer os.Remove(path)
+
+		_, err := nozzleconfig.Parse(path)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Can not parse config file"))
+		Expect(strings.Contains(err.Error(), path)).To(BeTrue())
+	})
+})
+
+func writeTempFile(pattern, contents string) string {
+	f, err := ioutil.TempFile("", pattern)
+	Expect(err).ToNot(HaveOccurred())
+	defer f.Close()
+	_, err = f.WriteString(contents)
+	Expect(err).ToNot(HaveOccurred())
+	return f.Name()
+}
@@ -0,0 +1,98 @@
+package nozzleconfig
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ReloadChanges compares a reloaded config with the running one. It
+// describes each changed field, or returns an error if any changed field
+// can only take effect after a restart. A field such as Foundations, whose
+// items only differ in their secrets, counts as reloadable.
+func ReloadChanges(current, reloaded *NozzleConfig) ([]string, error) {
+	var changes []string
+	var restartRequired []string
+
+	currentValue := reflect.ValueOf(current).Elem()
+	reloadedValue := reflect.ValueOf(reloaded).Elem()
+	currentRedacted := reflect.ValueOf(current.Redacted())
+	reloadedRedacted := reflect.ValueOf(reloaded.Redacted())
+	configType := currentValue.Type()
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		before := currentValue.Field(i).Interface()
+		after := reloadedValue.Field(i).Interface()
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+
+		if field.Tag.Get("reload") != "true" {
+			if field.Type.Kind() == reflect.Slice && reflect.DeepEqual(currentRedacted.Field(i).Interface(), reloadedRedacted.Field(i).Interface()) {
+				changes = append(changes, fmt.Sprintf("%s secrets changed", field.Name))
+				continue
+			}
+			restartRequired = append(restartRequired, field.Name)
+			continue
+		}
+		if field.Tag.Get("secret") == "true" {
+			changes = append(changes, fmt.Sprintf("%s changed", field.Name))
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", field.Name, formatValue(before), formatValue(after)))
+	}
+
+	if len(restartRequired) > 0 {
+		return nil, fmt.Errorf("%s can not be changed without a restart", strings.Join(restartRequired, ", "))
+	}
+	return changes, nil
+}
+
+func formatValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// WatchFile polls configPath every interval and signals on the returned
+// channel whenever the file's modification time or size changes.
+func WatchFile(configPath string, interval time.Duration, stop <-chan struct{}) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	lastModTime, lastSize := fileStat(configPath)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				modTime, size := fileStat(configPath)
+				if modTime.Equal(lastModTime) && size == lastSize {
+					continue
+				}
+				lastModTime, lastSize = modTime, size
+
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return changed
+}
+
+func fileStat(path string) (time.Time, int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return info.ModTime(), info.Size()
+}
@@ -0,0 +1,121 @@
+package nozzleconfig_test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/nozzleconfig"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reload", func() {
+	var current *nozzleconfig.NozzleConfig
+
+	BeforeEach(func() {
+		current = &nozzleconfig.NozzleConfig{
+			TrafficControllerURL: "wss://doppler.example.com",
+			MetricPrefix:         "old.",
+			DeploymentFilter:     "cf",
+			FlushDurationSeconds: 15,
+		}
+	})
+
+	Describe("ReloadChanges", func() {
+		It("describes changes to reloadable fields", func() {
+			reloaded := *current
+			reloaded.MetricPrefix = "new."
+			reloaded.CustomTags = []string{"env:prod"}
+			reloaded.FlushDurationSeconds = 30
+
+			changes, err := nozzleconfig.ReloadChanges(current, &reloaded)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(ConsistOf(
+				`MetricPrefix: "old." -> "new."`,
+				`CustomTags: [] -> [env:prod]`,
+				`FlushDurationSeconds: 15 -> 30`,
+			))
+		})
+
+		It("returns no changes for an identical config", func() {
+			reloaded := *current
+			changes, err := nozzleconfig.ReloadChanges(current, &reloaded)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(BeEmpty())
+		})
+
+		It("rejects changes to connection settings", func() {
+			reloaded := *current
+			reloaded.MetricPrefix = "new."
+			reloaded.TrafficControllerURL = "wss://other.example.com"
+			reloaded.DataDogURL = "https://other.example.com/api/v1/series"
+
+			_, err := nozzleconfig.ReloadChanges(current, &reloaded)
+			Expect(err).To(MatchError("TrafficControllerURL, DataDogURL can not be changed without a restart"))
+		})
+
+		It("reports rotated secrets without their values", func() {
+			reloaded := *current
+			reloaded.DataDogAPIKey = "rotated-key"
+
+			changes, err := nozzleconfig.ReloadChanges(current, &reloaded)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(Equal([]string{"DataDogAPIKey changed"}))
+		})
+
+		It("accepts rotated UAA credentials", func() {
+			reloaded := *current
+			reloaded.UAAPassword = "rotated-password"
+			reloaded.UAARefreshToken = "rotated-token"
+
+			changes, err := nozzleconfig.ReloadChanges(current, &reloaded)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(ConsistOf("UAAPassword changed", "UAARefreshToken changed"))
+		})
+
+		It("accepts foundations whose secrets are the only change", func() {
+			current.Foundations = []nozzleconfig.FoundationConfig{
+				{Name: "east", Client: "nozzle", ClientSecret: "east-secret"},
+			}
+			reloaded := *current
+			reloaded.Foundations = []nozzleconfig.FoundationConfig{
+				{Name: "east", Client: "nozzle", ClientSecret: "rotated-secret"},
+			}
+
+			changes, err := nozzleconfig.ReloadChanges(current, &reloaded)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(Equal([]string{"Foundations secrets changed"}))
+
+			reloaded.Foundations[0].Client = "other"
+			_, err = nozzleconfig.ReloadChanges(current, &reloaded)
+			Expect(err).To(MatchError("Foundations can not be changed without a restart"))
+		})
+	})
+
+	Describe("WatchFile", func() {
+		var (
+			path string
+			stop chan struct{}
+		)
+
+		BeforeEach(func() {
+			path = writeTempFile("config-*.json", "{}")
+			stop = make(chan struct{})
+		})
+
+		AfterEach(func() {
+			close(stop)
+			os.Remove(path)
+		})
+
+		It("signals when the file changes", func() {
+			changed := nozzleconfig.WatchFile(path, 10*time.Millisecond, stop)
+			Consistently(changed, 50*time.Millisecond).ShouldNot(Receive())
+
+			Expect(ioutil.WriteFile(path, []byte(`{"MetricPrefix": "new."}`), 0600)).To(Succeed())
+			Eventually(changed).Should(Receive())
+			Consistently(changed, 50*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+})
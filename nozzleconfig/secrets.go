@@ -0,0 +1,38 @@
+package nozzleconfig
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/secrets"
+)
+
+// ResolveSecrets fills in ClientSecret, DataDogAPIKey and the ClientSecret
+// of each foundation from the file or secret store reference configured for
+// them, if any. It should be called after Validate.
+func (c *NozzleConfig) ResolveSecrets(store secrets.Provider) error {
+	problems := &ValidationError{}
+	c.ClientSecret = resolveSecret(problems, store, "ClientSecret", c.ClientSecret, c.ClientSecretFile, c.ClientSecretRef)
+	c.DataDogAPIKey = resolveSecret(problems, store, "DataDogAPIKey", c.DataDogAPIKey, c.DataDogAPIKeyFile, c.DataDogAPIKeyRef)
+	for i := range c.Foundations {
+		foundation := &c.Foundations[i]
+		name := fmt.Sprintf("Foundations[%d].ClientSecret", i)
+		foundation.ClientSecret = resolveSecret(problems, store, name, foundation.ClientSecret, foundation.ClientSecretFile, foundation.ClientSecretRef)
+	}
+	return problems.errOrNil()
+}
+
+func resolveSecret(problems *ValidationError, store secrets.Provider, name, value, file, ref string) string {
+	if file != "" {
+		ref = "file:" + file
+	}
+	if ref == "" {
+		return value
+	}
+
+	secret, err := store.Get(ref)
+	if err != nil {
+		problems.add("%s: %s", name, err)
+		return value
+	}
+	return secret
+}
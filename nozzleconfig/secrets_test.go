@@ -0,0 +1,95 @@
+package nozzleconfig_test
+
+import (
+	"os"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/nozzleconfig"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/secrets"
+	. "github.com/cloudfoundry-incubator/datadog-firehose-nozzle/testhelpers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ResolveSecrets", func() {
+	var (
+		fakeCredHub *FakeCredHub
+		store       secrets.Registry
+		config      *nozzleconfig.NozzleConfig
+	)
+
+	BeforeEach(func() {
+		os.Clearenv()
+		fakeCredHub = NewFakeCredHub()
+		fakeCredHub.Start()
+
+		store = secrets.NewRegistry()
+		store["credhub"] = secrets.NewCredHubProvider(fakeCredHub.URL(), nil)
+		config = &nozzleconfig.NozzleConfig{}
+	})
+
+	AfterEach(func() {
+		fakeCredHub.Close()
+	})
+
+	It("leaves inline secrets alone", func() {
+		config.ClientSecret = "inline-secret"
+		config.DataDogAPIKey = "inline-key"
+
+		Expect(config.ResolveSecrets(store)).To(Succeed())
+		Expect(config.ClientSecret).To(Equal("inline-secret"))
+		Expect(config.DataDogAPIKey).To(Equal("inline-key"))
+	})
+
+	It("reads secrets from files", func() {
+		path := writeTempFile("client-secret", "from-file\n")
+		defer os.Remove(path)
+		config.ClientSecretFile = path
+
+		Expect(config.ResolveSecrets(store)).To(Succeed())
+		Expect(config.ClientSecret).To(Equal("from-file"))
+	})
+
+	It("reads the secrets of each foundation", func() {
+		os.Setenv("WEST_SECRET", "west-from-env")
+		config.Foundations = []nozzleconfig.FoundationConfig{
+			{Name: "east", ClientSecret: "east-inline"},
+			{Name: "west", ClientSecretRef: "env:WEST_SECRET"},
+		}
+
+		Expect(config.ResolveSecrets(store)).To(Succeed())
+		Expect(config.Foundations[0].ClientSecret).To(Equal("east-inline"))
+		Expect(config.Foundations[1].ClientSecret).To(Equal("west-from-env"))
+	})
+
+	It("reads secrets from references", func() {
+		os.Setenv("MOUNTED_SECRET", "from-env")
+		fakeCredHub.SetCredential("/datadog/api-key", "value", "from-credhub")
+		config.ClientSecretRef = "env:MOUNTED_SECRET"
+		config.DataDogAPIKeyRef = "credhub:/datadog/api-key"
+
+		Expect(config.ResolveSecrets(store)).To(Succeed())
+		Expect(config.ClientSecret).To(Equal("from-env"))
+		Expect(config.DataDogAPIKey).To(Equal("from-credhub"))
+	})
+
+	It("picks up rotated secrets when resolved again", func() {
+		fakeCredHub.SetCredential("/datadog/api-key", "value", "old-key")
+		config.DataDogAPIKeyRef = "credhub:/datadog/api-key"
+		Expect(config.ResolveSecrets(store)).To(Succeed())
+		Expect(config.DataDogAPIKey).To(Equal("old-key"))
+
+		fakeCredHub.SetCredential("/datadog/api-key", "value", "new-key")
+		Expect(config.ResolveSecrets(store)).To(Succeed())
+		Expect(config.DataDogAPIKey).To(Equal("new-key"))
+	})
+
+	It("reports every secret that can not be read", func() {
+		config.ClientSecretFile = "/does/not/exist"
+		config.DataDogAPIKeyRef = "credhub:/missing"
+
+		err := config.ResolveSecrets(store)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("ClientSecret: can not read secret file:/does/not/exist"))
+		Expect(err.Error()).To(ContainSubstring("DataDogAPIKey: can not read secret credhub:/missing: CredHub returned HTTP response: 404 Not Found"))
+	})
+})
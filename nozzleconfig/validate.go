@@ -0,0 +1,357 @@
+package nozzleconfig
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/secrets"
+)
+
+const (
+	DefaultDataDogURL               = "https://app.datadoghq.com/api/v1/series"
+	DefaultFirehoseSubscriptionID   = "datadog-nozzle"
+	DefaultEnvelopeSource           = EnvelopeSourceFirehose
+	DefaultFirehoseConnections      = 1
+	DefaultUAAGrantType             = UAAGrantClientCredentials
+	DefaultUAATimeoutSeconds        = 10
+	DefaultUAARetries               = 3
+	DefaultDataDogTimeoutSeconds    = 5
+	DefaultFlushDurationSeconds     = 15
+	DefaultFlushMaxBytes            = 57671680
+	DefaultCardinalityWindowSeconds = 3600
+	DefaultCardinalityPolicy        = "collapse"
+	DefaultBufferEvictionPolicy     = "drop-oldest"
+	DefaultCircuitBreakerFailures   = 3
+	DefaultCircuitBreakerCooldown   = 30
+	DefaultLogLevel                 = "info"
+	DefaultLogFormat                = "json"
+	MinFlushMaxBytes                = 1024
+)
+
+const (
+	UAAGrantClientCredentials = "client_credentials"
+	UAAGrantPassword          = "password"
+	UAAGrantRefreshToken      = "refresh_token"
+)
+
+const (
+	EnvelopeSourceFirehose = "firehose"
+	EnvelopeSourceRLP      = "rlp"
+)
+
+// DefaultRLPSelectors asks the RLP gateway for every envelope type the
+// nozzle turns into metrics or events.
+var DefaultRLPSelectors = []string{"gauge", "counter", "timer", "event"}
+
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+func (e *ValidationError) errOrNil() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Validate fills in defaults for unset optional fields and checks that the
+// config is usable, reporting every problem found rather than just the first.
+func (c *NozzleConfig) Validate() error {
+	return c.ValidateOffline(false, false)
+}
+
+// ValidateOffline is Validate for a nozzle that does not connect to
+// everything. With replay it reads envelopes from a file, so the UAA,
+// foundations and envelope source endpoints are not required. With dryRun
+// it posts nothing, so neither is the Datadog API key.
+func (c *NozzleConfig) ValidateOffline(replay, dryRun bool) error {
+	c.applyDefaults()
+
+	problems := &ValidationError{}
+
+	switch {
+	case replay:
+	case len(c.Foundations) > 0:
+		c.validateFoundations(problems)
+		if c.CloudControllerURL != "" {
+			problems.add("CloudControllerURL can not be used with Foundations, which set their own endpoints")
+		}
+		if c.UAAGrantType != UAAGrantClientCredentials {
+			problems.add("Foundations can only use the %s grant, but UAAGrantType is %q", UAAGrantClientCredentials, c.UAAGrantType)
+		}
+	case !c.DisableAccessControl:
+		c.validateEndpoint(problems, "UAAURL", c.UAAURL, "http", "https")
+		if c.Client == "" {
+			problems.add("Client is required unless DisableAccessControl is true")
+		}
+		switch c.UAAGrantType {
+		case UAAGrantClientCredentials:
+			if c.ClientSecret == "" && c.ClientSecretFile == "" && c.ClientSecretRef == "" {
+				problems.add("ClientSecret, ClientSecretFile or ClientSecretRef is required unless DisableAccessControl is true")
+			}
+		case UAAGrantPassword:
+			if c.UAAUsername == "" || c.UAAPassword == "" {
+				problems.add("UAAUsername and UAAPassword are required for the %s grant", UAAGrantPassword)
+			}
+		case UAAGrantRefreshToken:
+			if c.UAARefreshToken == "" {
+				problems.add("UAARefreshToken is required for the %s grant", UAAGrantRefreshToken)
+			}
+		}
+	}
+	validateOneOf(problems, "UAAGrantType", c.UAAGrantType, UAAGrantClientCredentials, UAAGrantPassword, UAAGrantRefreshToken)
+	validateOneOf(problems, "EnvelopeSource", c.EnvelopeSource, EnvelopeSourceFirehose, EnvelopeSourceRLP)
+	switch {
+	case replay:
+	case len(c.Foundations) > 0:
+		if c.EnvelopeSource != EnvelopeSourceFirehose {
+			problems.add("Foundations can only be read from the firehose, but EnvelopeSource is %q", c.EnvelopeSource)
+		}
+	case c.EnvelopeSource == EnvelopeSourceFirehose:
+		c.validateEndpoint(problems, "TrafficControllerURL", c.TrafficControllerURL, "ws", "wss")
+	case c.EnvelopeSource == EnvelopeSourceRLP:
+		c.validateEndpoint(problems, "RLPGatewayURL", c.RLPGatewayURL, "http", "https")
+		for _, selector := range c.RLPSelectors {
+			validateOneOf(problems, "RLPSelectors", selector, "log", "gauge", "counter", "timer", "event")
+		}
+	}
+	validateURL(problems, "DataDogURL", c.DataDogURL, "http", "https")
+	if !dryRun && c.DataDogAPIKey == "" && c.DataDogAPIKeyFile == "" && c.DataDogAPIKeyRef == "" {
+		problems.add("DataDogAPIKey, DataDogAPIKeyFile or DataDogAPIKeyRef is required")
+	}
+
+	if c.FlushMaxBytes < MinFlushMaxBytes {
+		problems.add("FlushMaxBytes is too low (%d): must be at least %d", c.FlushMaxBytes, MinFlushMaxBytes)
+	}
+
+	validateOneOf(problems, "CardinalityPolicy", c.CardinalityPolicy, "collapse", "drop")
+	validateOneOf(problems, "BufferEvictionPolicy", c.BufferEvictionPolicy, "drop-oldest", "drop-newest", "downsample")
+	validateOneOf(problems, "LogLevel", c.LogLevel, "debug", "info", "warn", "error")
+	validateOneOf(problems, "LogFormat", c.LogFormat, "json", "text")
+
+	validateOptionalURL(problems, "HTTPProxy", c.HTTPProxy)
+	validateOptionalURL(problems, "HTTPSProxy", c.HTTPSProxy)
+	validateOptionalURL(problems, "CredHubURL", c.CredHubURL)
+	if c.CloudControllerURL != "" {
+		validateURL(problems, "CloudControllerURL", c.CloudControllerURL, "http", "https")
+	}
+	validateOptionalAddress(problems, "DebugAddress", c.DebugAddress)
+
+	validateFile(problems, "UAACACertPath", c.UAACACertPath)
+	validateFile(problems, "TrafficControllerCACertPath", c.TrafficControllerCACertPath)
+	validateFile(problems, "DataDogCACertPath", c.DataDogCACertPath)
+	validateFile(problems, "CredHubCACertPath", c.CredHubCACertPath)
+	validateFile(problems, "CloudControllerCACertPath", c.CloudControllerCACertPath)
+	validateKeyPair(problems, "UAAClient", c.UAAClientCertPath, c.UAAClientKeyPath)
+	validateKeyPair(problems, "TrafficControllerClient", c.TrafficControllerClientCertPath, c.TrafficControllerClientKeyPath)
+	validateKeyPair(problems, "DataDogClient", c.DataDogClientCertPath, c.DataDogClientKeyPath)
+	validateKeyPair(problems, "CredHubClient", c.CredHubClientCertPath, c.CredHubClientKeyPath)
+	validateSecret(problems, "ClientSecret", c.ClientSecret, c.ClientSecretFile, c.ClientSecretRef, c.CredHubURL != "")
+	validateSecret(problems, "DataDogAPIKey", c.DataDogAPIKey, c.DataDogAPIKeyFile, c.DataDogAPIKeyRef, c.CredHubURL != "")
+
+	return problems.errOrNil()
+}
+
+func (c *NozzleConfig) applyDefaults() {
+	if c.DataDogURL == "" {
+		c.DataDogURL = DefaultDataDogURL
+	}
+	if c.FirehoseSubscriptionID == "" {
+		c.FirehoseSubscriptionID = DefaultFirehoseSubscriptionID
+	}
+	if c.FirehoseConnections == 0 {
+		c.FirehoseConnections = DefaultFirehoseConnections
+	}
+	if c.UAAGrantType == "" {
+		c.UAAGrantType = DefaultUAAGrantType
+	}
+	if c.UAATimeoutSeconds == 0 {
+		c.UAATimeoutSeconds = DefaultUAATimeoutSeconds
+	}
+	if c.UAARetries == 0 {
+		c.UAARetries = DefaultUAARetries
+	}
+	if c.EnvelopeSource == "" {
+		c.EnvelopeSource = DefaultEnvelopeSource
+	}
+	if c.RLPShardID == "" {
+		c.RLPShardID = c.FirehoseSubscriptionID
+	}
+	if len(c.RLPSelectors) == 0 {
+		c.RLPSelectors = append([]string(nil), DefaultRLPSelectors...)
+	}
+	for i := range c.Foundations {
+		if c.Foundations[i].FirehoseSubscriptionID == "" {
+			c.Foundations[i].FirehoseSubscriptionID = c.FirehoseSubscriptionID
+		}
+	}
+	if c.DataDogTimeoutSeconds == 0 {
+		c.DataDogTimeoutSeconds = DefaultDataDogTimeoutSeconds
+	}
+	if c.FlushDurationSeconds == 0 {
+		c.FlushDurationSeconds = DefaultFlushDurationSeconds
+	}
+	if c.FlushMaxBytes == 0 {
+		c.FlushMaxBytes = DefaultFlushMaxBytes
+	}
+	if c.CardinalityWindowSeconds == 0 {
+		c.CardinalityWindowSeconds = DefaultCardinalityWindowSeconds
+	}
+	if c.CardinalityPolicy == "" {
+		c.CardinalityPolicy = DefaultCardinalityPolicy
+	}
+	if c.BufferEvictionPolicy == "" {
+		c.BufferEvictionPolicy = DefaultBufferEvictionPolicy
+	}
+	if c.CircuitBreakerFailures == 0 {
+		c.CircuitBreakerFailures = DefaultCircuitBreakerFailures
+	}
+	if c.CircuitBreakerCooldownSeconds == 0 {
+		c.CircuitBreakerCooldownSeconds = DefaultCircuitBreakerCooldown
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = DefaultLogLevel
+	}
+	if c.LogFormat == "" {
+		c.LogFormat = DefaultLogFormat
+	}
+}
+
+func (c *NozzleConfig) validateFoundations(problems *ValidationError) {
+	names := make(map[string]bool)
+	for i, foundation := range c.Foundations {
+		prefix := fmt.Sprintf("Foundations[%d].", i)
+		switch {
+		case foundation.Name == "":
+			problems.add("%sName is required", prefix)
+		case names[foundation.Name]:
+			problems.add("%sName %q is used by more than one foundation", prefix, foundation.Name)
+		}
+		names[foundation.Name] = true
+
+		if !c.DisableAccessControl {
+			validateURL(problems, prefix+"UAAURL", foundation.UAAURL, "http", "https")
+			if foundation.Client == "" {
+				problems.add("%sClient is required unless DisableAccessControl is true", prefix)
+			}
+			if foundation.ClientSecret == "" && foundation.ClientSecretFile == "" && foundation.ClientSecretRef == "" {
+				problems.add("%sClientSecret, %sClientSecretFile or %sClientSecretRef is required unless DisableAccessControl is true", prefix, prefix, prefix)
+			}
+		}
+		validateSecret(problems, prefix+"ClientSecret", foundation.ClientSecret, foundation.ClientSecretFile, foundation.ClientSecretRef, c.CredHubURL != "")
+		validateURL(problems, prefix+"TrafficControllerURL", foundation.TrafficControllerURL, "ws", "wss")
+	}
+}
+
+// validateEndpoint checks an endpoint that can be left empty for
+// ResolveEndpoints to discover when CloudControllerURL is set.
+func (c *NozzleConfig) validateEndpoint(problems *ValidationError, name, value string, schemes ...string) {
+	if value == "" && c.CloudControllerURL != "" {
+		return
+	}
+	validateURL(problems, name, value, schemes...)
+}
+
+func validateURL(problems *ValidationError, name, value string, schemes ...string) {
+	if value == "" {
+		problems.add("%s is required", name)
+		return
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		problems.add("%s is not a valid URL (%s): %s", name, value, err)
+		return
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return
+		}
+	}
+	problems.add("%s must use one of the schemes %s, got %q", name, strings.Join(schemes, ", "), value)
+}
+
+func validateOneOf(problems *ValidationError, name, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	problems.add("%s must be one of %s, got %q", name, strings.Join(allowed, ", "), value)
+}
+
+func validateOptionalURL(problems *ValidationError, name, value string) {
+	if value == "" {
+		return
+	}
+	if u, err := url.Parse(value); err != nil || u.Host == "" {
+		problems.add("%s is not a valid URL: %q", name, value)
+	}
+}
+
+func validateOptionalAddress(problems *ValidationError, name, value string) {
+	if value == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		problems.add("%s must be host:port, got %q", name, value)
+	}
+}
+
+func validateFile(problems *ValidationError, name, path string) {
+	if path == "" {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		problems.add("%s can not be read: %s", name, err)
+	}
+}
+
+// validateSecret checks that at most one of a secret's inline value, file
+// and reference is set, and that the one given can be read.
+func validateSecret(problems *ValidationError, name, value, file, ref string, credHubConfigured bool) {
+	set := 0
+	for _, source := range []string{value, file, ref} {
+		if source != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		problems.add("only one of %s, %sFile and %sRef may be set", name, name, name)
+		return
+	}
+
+	validateFile(problems, name+"File", file)
+	if ref == "" {
+		return
+	}
+	scheme, _, err := secrets.ParseRef(ref)
+	switch {
+	case err != nil:
+		problems.add("%sRef is invalid: %s", name, err)
+	case scheme == "credhub" && !credHubConfigured:
+		problems.add("%sRef reads from CredHub but CredHubURL is not set", name)
+	case scheme != "file" && scheme != "env" && scheme != "credhub":
+		problems.add("%sRef uses unknown secret provider %q: must be one of file, env, credhub", name, scheme)
+	}
+}
+
+func validateKeyPair(problems *ValidationError, prefix, certPath, keyPath string) {
+	if (certPath == "") != (keyPath == "") {
+		problems.add("%sCertPath and %sKeyPath must be set together", prefix, prefix)
+		return
+	}
+	validateFile(problems, prefix+"CertPath", certPath)
+	validateFile(problems, prefix+"KeyPath", keyPath)
+}
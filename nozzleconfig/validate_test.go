@@ -0,0 +1,291 @@
+package nozzleconfig_test
+
+import (
+	"os"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/nozzleconfig"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Validate", func() {
+	var config *nozzleconfig.NozzleConfig
+
+	BeforeEach(func() {
+		os.Clearenv()
+		config = &nozzleconfig.NozzleConfig{
+			UAAURL:               "https://uaa.example.com",
+			Client:               "client",
+			ClientSecret:         "secret",
+			TrafficControllerURL: "wss://doppler.example.com:4443",
+			DataDogAPIKey:        "api-key",
+		}
+	})
+
+	It("accepts a minimal config", func() {
+		Expect(config.Validate()).To(Succeed())
+	})
+
+	It("applies defaults", func() {
+		Expect(config.Validate()).To(Succeed())
+
+		Expect(config.DataDogURL).To(Equal(nozzleconfig.DefaultDataDogURL))
+		Expect(config.FirehoseSubscriptionID).To(Equal(nozzleconfig.DefaultFirehoseSubscriptionID))
+		Expect(config.FirehoseConnections).To(BeEquivalentTo(nozzleconfig.DefaultFirehoseConnections))
+		Expect(config.UAAGrantType).To(Equal(nozzleconfig.DefaultUAAGrantType))
+		Expect(config.UAATimeoutSeconds).To(BeEquivalentTo(nozzleconfig.DefaultUAATimeoutSeconds))
+		Expect(config.UAARetries).To(BeEquivalentTo(nozzleconfig.DefaultUAARetries))
+		Expect(config.DataDogTimeoutSeconds).To(BeEquivalentTo(nozzleconfig.DefaultDataDogTimeoutSeconds))
+		Expect(config.FlushDurationSeconds).To(BeEquivalentTo(nozzleconfig.DefaultFlushDurationSeconds))
+		Expect(config.FlushMaxBytes).To(BeEquivalentTo(nozzleconfig.DefaultFlushMaxBytes))
+		Expect(config.CardinalityWindowSeconds).To(BeEquivalentTo(nozzleconfig.DefaultCardinalityWindowSeconds))
+		Expect(config.CardinalityPolicy).To(Equal(nozzleconfig.DefaultCardinalityPolicy))
+		Expect(config.BufferEvictionPolicy).To(Equal(nozzleconfig.DefaultBufferEvictionPolicy))
+		Expect(config.CircuitBreakerFailures).To(BeEquivalentTo(nozzleconfig.DefaultCircuitBreakerFailures))
+		Expect(config.CircuitBreakerCooldownSeconds).To(BeEquivalentTo(nozzleconfig.DefaultCircuitBreakerCooldown))
+		Expect(config.LogLevel).To(Equal(nozzleconfig.DefaultLogLevel))
+		Expect(config.LogFormat).To(Equal(nozzleconfig.DefaultLogFormat))
+	})
+
+	It("does not overwrite values that are set", func() {
+		config.FlushDurationSeconds = 3
+		config.FirehoseSubscriptionID = "my-subscription"
+
+		Expect(config.Validate()).To(Succeed())
+
+		Expect(config.FlushDurationSeconds).To(BeEquivalentTo(3))
+		Expect(config.FirehoseSubscriptionID).To(Equal("my-subscription"))
+	})
+
+	It("reports every problem together", func() {
+		config = &nozzleconfig.NozzleConfig{
+			TrafficControllerURL: "https://doppler.example.com",
+			FlushMaxBytes:        10,
+		}
+
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+
+		validationErr, ok := err.(*nozzleconfig.ValidationError)
+		Expect(ok).To(BeTrue())
+		Expect(validationErr.Problems).To(ConsistOf(
+			"UAAURL is required",
+			"Client is required unless DisableAccessControl is true",
+			"ClientSecret, ClientSecretFile or ClientSecretRef is required unless DisableAccessControl is true",
+			`TrafficControllerURL must use one of the schemes ws, wss, got "https://doppler.example.com"`,
+			"DataDogAPIKey, DataDogAPIKeyFile or DataDogAPIKeyRef is required",
+			"FlushMaxBytes is too low (10): must be at least 1024",
+		))
+		Expect(err.Error()).To(ContainSubstring("DataDogAPIKeyRef is required"))
+	})
+
+	It("does not require UAA settings when access control is disabled", func() {
+		config.DisableAccessControl = true
+		config.UAAURL = ""
+		config.Client = ""
+		config.ClientSecret = ""
+
+		Expect(config.Validate()).To(Succeed())
+	})
+
+	It("does not require connection settings to replay envelopes", func() {
+		config.UAAURL = ""
+		config.Client = ""
+		config.ClientSecret = ""
+		config.TrafficControllerURL = ""
+
+		Expect(config.ValidateOffline(true, false)).To(Succeed())
+		Expect(config.Validate()).To(MatchError(ContainSubstring("UAAURL is required")))
+	})
+
+	It("does not require the Datadog API key for a dry run", func() {
+		config.DataDogAPIKey = ""
+
+		Expect(config.ValidateOffline(false, true)).To(Succeed())
+		Expect(config.ValidateOffline(true, false)).To(MatchError(ContainSubstring("DataDogAPIKey")))
+	})
+
+	It("leaves the endpoints to discovery when CloudControllerURL is set", func() {
+		config.CloudControllerURL = "https://api.example.com"
+		config.UAAURL = ""
+		config.TrafficControllerURL = ""
+
+		Expect(config.Validate()).To(Succeed())
+
+		config.CloudControllerURL = "api.example.com"
+		Expect(config.Validate()).To(MatchError(ContainSubstring(`CloudControllerURL must use one of the schemes http, https, got "api.example.com"`)))
+	})
+
+	It("requires the credentials of the UAA grant type", func() {
+		config.ClientSecret = ""
+		config.UAAGrantType = nozzleconfig.UAAGrantPassword
+		Expect(config.Validate()).To(MatchError(ContainSubstring("UAAUsername and UAAPassword are required for the password grant")))
+
+		config.UAAUsername = "admin"
+		config.UAAPassword = "admin-password"
+		Expect(config.Validate()).To(Succeed())
+
+		config.UAAGrantType = nozzleconfig.UAAGrantRefreshToken
+		Expect(config.Validate()).To(MatchError(ContainSubstring("UAARefreshToken is required for the refresh_token grant")))
+
+		config.UAAGrantType = "implicit"
+		Expect(config.Validate()).To(MatchError(ContainSubstring(`UAAGrantType must be one of client_credentials, password, refresh_token, got "implicit"`)))
+	})
+
+	It("rejects unknown log levels, formats and policies", func() {
+		config.CardinalityPolicy = "sample"
+		config.BufferEvictionPolicy = "drop-random"
+		config.LogLevel = "verbose"
+		config.LogFormat = "xml"
+
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`LogLevel must be one of debug, info, warn, error, got "verbose"`))
+		Expect(err.Error()).To(ContainSubstring(`LogFormat must be one of json, text, got "xml"`))
+		Expect(err.Error()).To(ContainSubstring(`CardinalityPolicy must be one of collapse, drop, got "sample"`))
+		Expect(err.Error()).To(ContainSubstring(`BufferEvictionPolicy must be one of drop-oldest, drop-newest, downsample, got "drop-random"`))
+	})
+
+	It("reads from the RLP gateway when selected", func() {
+		config.EnvelopeSource = nozzleconfig.EnvelopeSourceRLP
+		config.TrafficControllerURL = ""
+		config.RLPGatewayURL = "https://log-stream.example.com"
+
+		Expect(config.Validate()).To(Succeed())
+		Expect(config.RLPShardID).To(Equal(nozzleconfig.DefaultFirehoseSubscriptionID))
+		Expect(config.RLPSelectors).To(Equal(nozzleconfig.DefaultRLPSelectors))
+	})
+
+	It("rejects unknown envelope sources and RLP selectors", func() {
+		config.EnvelopeSource = "syslog"
+
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`EnvelopeSource must be one of firehose, rlp, got "syslog"`))
+
+		config.EnvelopeSource = nozzleconfig.EnvelopeSourceRLP
+		config.RLPSelectors = []string{"gauge", "metrics"}
+
+		err = config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("RLPGatewayURL is required"))
+		Expect(err.Error()).To(ContainSubstring(`RLPSelectors must be one of log, gauge, counter, timer, event, got "metrics"`))
+	})
+
+	It("reads foundations instead of the top level connection settings", func() {
+		config.UAAURL = ""
+		config.Client = ""
+		config.ClientSecret = ""
+		config.TrafficControllerURL = ""
+		config.Foundations = []nozzleconfig.FoundationConfig{
+			{Name: "east", UAAURL: "https://uaa.east.example.com", Client: "nozzle", ClientSecret: "secret", TrafficControllerURL: "wss://doppler.east.example.com:443"},
+			{Name: "west", UAAURL: "https://uaa.west.example.com", Client: "nozzle", ClientSecret: "secret", TrafficControllerURL: "wss://doppler.west.example.com:443", FirehoseSubscriptionID: "west-nozzle"},
+		}
+
+		Expect(config.Validate()).To(Succeed())
+		Expect(config.Foundations[0].FirehoseSubscriptionID).To(Equal(nozzleconfig.DefaultFirehoseSubscriptionID))
+		Expect(config.Foundations[1].FirehoseSubscriptionID).To(Equal("west-nozzle"))
+	})
+
+	It("reports problems with each foundation", func() {
+		config.Foundations = []nozzleconfig.FoundationConfig{
+			{Name: "east", UAAURL: "https://uaa.east.example.com", Client: "nozzle", TrafficControllerURL: "https://doppler.east.example.com"},
+			{Name: "east", UAAURL: "https://uaa.east.example.com", Client: "nozzle", ClientSecret: "secret"},
+		}
+
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+		validationErr := err.(*nozzleconfig.ValidationError)
+		Expect(validationErr.Problems).To(ConsistOf(
+			"Foundations[0].ClientSecret, Foundations[0].ClientSecretFile or Foundations[0].ClientSecretRef is required unless DisableAccessControl is true",
+			`Foundations[0].TrafficControllerURL must use one of the schemes ws, wss, got "https://doppler.east.example.com"`,
+			`Foundations[1].Name "east" is used by more than one foundation`,
+			"Foundations[1].TrafficControllerURL is required",
+		))
+	})
+
+	It("checks the secret sources of each foundation", func() {
+		config.ClientSecret = ""
+		config.TrafficControllerURL = ""
+		config.Foundations = []nozzleconfig.FoundationConfig{
+			{Name: "east", UAAURL: "https://uaa.east.example.com", Client: "nozzle", ClientSecret: "secret", ClientSecretRef: "env:EAST_SECRET", TrafficControllerURL: "wss://doppler.east.example.com:443"},
+			{Name: "west", UAAURL: "https://uaa.west.example.com", Client: "nozzle", ClientSecretRef: "credhub:/west", TrafficControllerURL: "wss://doppler.west.example.com:443"},
+		}
+
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+		validationErr := err.(*nozzleconfig.ValidationError)
+		Expect(validationErr.Problems).To(ConsistOf(
+			"only one of Foundations[0].ClientSecret, Foundations[0].ClientSecretFile and Foundations[0].ClientSecretRef may be set",
+			"Foundations[1].ClientSecretRef reads from CredHub but CredHubURL is not set",
+		))
+	})
+
+	It("rejects malformed proxy URLs", func() {
+		config.HTTPSProxy = "not a url"
+
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`HTTPSProxy is not a valid URL: "not a url"`))
+	})
+
+	It("rejects a debug address without a port", func() {
+		config.DebugAddress = "localhost"
+
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`DebugAddress must be host:port, got "localhost"`))
+	})
+
+	It("rejects missing certificate files and unpaired client keys", func() {
+		config.DataDogCACertPath = "/does/not/exist.pem"
+		config.UAAClientCertPath = "../config/datadog-firehose-nozzle.json"
+
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("DataDogCACertPath can not be read"))
+		Expect(err.Error()).To(ContainSubstring("UAAClientCertPath and UAAClientKeyPath must be set together"))
+	})
+
+	It("accepts secrets from files and references", func() {
+		config.ClientSecret = ""
+		config.ClientSecretFile = "../config/datadog-firehose-nozzle.json"
+		config.DataDogAPIKey = ""
+		config.DataDogAPIKeyRef = "credhub:/datadog/api-key"
+		config.CredHubURL = "https://credhub.example.com:8844"
+
+		Expect(config.Validate()).To(Succeed())
+	})
+
+	It("rejects conflicting and unusable secret sources", func() {
+		config.ClientSecretRef = "vault:/nozzle/secret"
+		config.DataDogAPIKey = ""
+		config.DataDogAPIKeyRef = "credhub:/datadog/api-key"
+
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("only one of ClientSecret, ClientSecretFile and ClientSecretRef may be set"))
+		Expect(err.Error()).To(ContainSubstring("DataDogAPIKeyRef reads from CredHub but CredHubURL is not set"))
+	})
+
+	It("rejects unknown secret providers", func() {
+		config.DataDogAPIKey = ""
+		config.DataDogAPIKeyRef = "vault:/datadog/api-key"
+
+		err := config.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`DataDogAPIKeyRef uses unknown secret provider "vault": must be one of file, env, credhub`))
+	})
+
+	It("reports malformed environment overrides instead of panicking", func() {
+		os.Setenv("NOZZLE_FLUSHDURATIONSECONDS", "fifteen")
+		os.Setenv("NOZZLE_DATADOGTIMEOUTSECONDS", "-1")
+		os.Setenv("NOZZLE_DISABLEACCESSCONTROL", "yes please")
+
+		_, err := nozzleconfig.Parse("../config/datadog-firehose-nozzle.json")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`NOZZLE_FLUSHDURATIONSECONDS must be a non-negative integer, got "fifteen"`))
+		Expect(err.Error()).To(ContainSubstring(`NOZZLE_DATADOGTIMEOUTSECONDS must be a non-negative integer, got "-1"`))
+		Expect(err.Error()).To(ContainSubstring(`NOZZLE_DISABLEACCESSCONTROL must be true or false, got "yes please"`))
+	})
+})
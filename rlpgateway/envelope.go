@@ -0,0 +1,194 @@
+package rlpgateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// batch is the JSON the gateway sends in each server-sent event.
+type batch struct {
+	Batch []envelope `json:"batch"`
+}
+
+type envelope struct {
+	Timestamp  jsonInt           `json:"timestamp"`
+	SourceID   string            `json:"source_id"`
+	InstanceID string            `json:"instance_id"`
+	Tags       map[string]string `json:"tags"`
+
+	Gauge   *gauge   `json:"gauge"`
+	Counter *counter `json:"counter"`
+	Timer   *timer   `json:"timer"`
+	Event   *event   `json:"event"`
+}
+
+type gauge struct {
+	Metrics map[string]gaugeValue `json:"metrics"`
+}
+
+type gaugeValue struct {
+	Unit  string  `json:"unit"`
+	Value float64 `json:"value"`
+}
+
+type counter struct {
+	Name  string  `json:"name"`
+	Delta jsonInt `json:"delta"`
+	// Total is nil when the gateway only sends the delta.
+	Total *jsonInt `json:"total"`
+}
+
+type timer struct {
+	Name  string  `json:"name"`
+	Start jsonInt `json:"start"`
+	Stop  jsonInt `json:"stop"`
+}
+
+type event struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// jsonInt accepts 64 bit integers both as JSON numbers and as the strings
+// the gateway encodes them as.
+type jsonInt int64
+
+func (i *jsonInt) UnmarshalJSON(data []byte) error {
+	data = bytes.Trim(data, `"`)
+	if len(data) == 0 {
+		*i = 0
+		return nil
+	}
+	n, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = jsonInt(n)
+	return nil
+}
+
+// Tags of a v2 envelope that map to fields of a v1 envelope rather than
+// to v1 tags.
+var envelopeFieldTags = map[string]bool{
+	"origin":     true,
+	"deployment": true,
+	"job":        true,
+	"index":      true,
+	"ip":         true,
+}
+
+// converter turns v2 envelopes into the v1 envelopes the rest of the nozzle
+// works with. It keeps running totals for counters that only carry deltas,
+// for as long as the connection it is used for.
+type converter struct {
+	totals map[string]uint64
+}
+
+func newConverter() *converter {
+	return &converter{totals: make(map[string]uint64)}
+}
+
+// convert returns one v1 envelope per gauge metric, one for a counter or
+// timer, and an Error envelope for an event. Log envelopes are ignored.
+func (c *converter) convert(v2 envelope) []*events.Envelope {
+	switch {
+	case v2.Gauge != nil:
+		names := make([]string, 0, len(v2.Gauge.Metrics))
+		for name := range v2.Gauge.Metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		converted := make([]*events.Envelope, 0, len(names))
+		for _, name := range names {
+			metric := v2.Gauge.Metrics[name]
+			e := c.base(v2, events.Envelope_ValueMetric)
+			e.ValueMetric = &events.ValueMetric{
+				Name:  proto.String(name),
+				Value: proto.Float64(metric.Value),
+				Unit:  proto.String(metric.Unit),
+			}
+			converted = append(converted, e)
+		}
+		return converted
+
+	case v2.Counter != nil:
+		var total uint64
+		if v2.Counter.Total != nil {
+			total = uint64(*v2.Counter.Total)
+		} else {
+			key := v2.SourceID + "/" + v2.InstanceID + "/" + v2.Counter.Name
+			c.totals[key] += uint64(v2.Counter.Delta)
+			total = c.totals[key]
+		}
+
+		e := c.base(v2, events.Envelope_CounterEvent)
+		e.CounterEvent = &events.CounterEvent{
+			Name:  proto.String(v2.Counter.Name),
+			Delta: proto.Uint64(uint64(v2.Counter.Delta)),
+			Total: proto.Uint64(total),
+		}
+		return []*events.Envelope{e}
+
+	case v2.Timer != nil:
+		e := c.base(v2, events.Envelope_ValueMetric)
+		e.ValueMetric = &events.ValueMetric{
+			Name:  proto.String(v2.Timer.Name),
+			Value: proto.Float64(float64(v2.Timer.Stop-v2.Timer.Start) / 1e6),
+			Unit:  proto.String("ms"),
+		}
+		return []*events.Envelope{e}
+
+	case v2.Event != nil:
+		e := c.base(v2, events.Envelope_Error)
+		e.Error = &events.Error{
+			Source:  proto.String(v2.Event.Title),
+			Code:    proto.Int32(0),
+			Message: proto.String(v2.Event.Body),
+		}
+		return []*events.Envelope{e}
+	}
+	return nil
+}
+
+func (c *converter) base(v2 envelope, eventType events.Envelope_EventType) *events.Envelope {
+	origin := v2.Tags["origin"]
+	if origin == "" {
+		origin = v2.SourceID
+	}
+	index := v2.Tags["index"]
+	if index == "" {
+		index = v2.InstanceID
+	}
+
+	tags := map[string]string{"source_id": v2.SourceID}
+	for key, value := range v2.Tags {
+		if !envelopeFieldTags[key] {
+			tags[key] = value
+		}
+	}
+
+	return &events.Envelope{
+		Origin:     proto.String(origin),
+		EventType:  eventType.Enum(),
+		Timestamp:  proto.Int64(int64(v2.Timestamp)),
+		Deployment: proto.String(v2.Tags["deployment"]),
+		Job:        proto.String(v2.Tags["job"]),
+		Index:      proto.String(index),
+		Ip:         proto.String(v2.Tags["ip"]),
+		Tags:       tags,
+	}
+}
+
+func decodeBatch(data []byte) ([]envelope, error) {
+	var b batch
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	return b.Batch, nil
+}
@@ -0,0 +1,228 @@
+package rlpgateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	// maxRetries is how many times in a row the client reconnects after a
+	// failed connection before giving up.
+	maxRetries     = 5
+	initialBackoff = 100 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+	maxEventBytes  = 16 * 1024 * 1024
+)
+
+// StatusError is returned when the gateway refuses the stream, for example
+// because the token is not allowed to read it.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("RLP gateway returned HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// Client streams v2 envelopes from the Reverse Log Proxy gateway and
+// converts them to the v1 envelopes the nozzle consumes from the firehose.
+type Client struct {
+	url        string
+	shardID    string
+	selectors  []string
+	httpClient *http.Client
+	log        logger.Logger
+	resolveURL func() (string, error)
+
+	lock   sync.Mutex
+	cancel context.CancelFunc
+}
+
+func New(gatewayURL, shardID string, selectors []string, transport http.RoundTripper, log logger.Logger) *Client {
+	return &Client{
+		url:        strings.TrimRight(gatewayURL, "/"),
+		shardID:    shardID,
+		selectors:  selectors,
+		httpClient: &http.Client{Transport: transport},
+		log:        log.With("destination", gatewayURL),
+	}
+}
+
+// SetURLResolver makes the client look the gateway URL up with resolve
+// before every reconnect, so that it follows a gateway that moved. It keeps
+// the URL it has when resolve fails.
+func (c *Client) SetURLResolver(resolve func() (string, error)) {
+	c.resolveURL = resolve
+}
+
+// Stream connects to the gateway and returns the envelopes it sends. It
+// reconnects when the stream ends or fails, and sends a single error and
+// stops when the gateway rejects the request or keeps failing. Close stops
+// the stream without sending an error.
+func (c *Client) Stream(authToken string) (<-chan *events.Envelope, <-chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.lock.Lock()
+	c.cancel = cancel
+	c.lock.Unlock()
+
+	messages := make(chan *events.Envelope)
+	errs := make(chan error, 1)
+	go c.run(ctx, authToken, messages, errs)
+	return messages, errs
+}
+
+func (c *Client) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+func (c *Client) run(ctx context.Context, authToken string, messages chan<- *events.Envelope, errs chan<- error) {
+	backoff := initialBackoff
+	failures := 0
+
+	for {
+		// Running totals start over with each connection, so that those of
+		// counters that went away are not kept forever.
+		received, err := c.stream(ctx, authToken, newConverter(), messages)
+		if ctx.Err() != nil {
+			return
+		}
+		if _, ok := err.(*StatusError); ok {
+			errs <- err
+			return
+		}
+		if received {
+			failures = 0
+			backoff = initialBackoff
+		}
+		if err != nil {
+			failures++
+			if failures > maxRetries {
+				errs <- err
+				return
+			}
+			c.log.Infof("Reconnecting to the RLP gateway in %s: %s", backoff, err)
+		} else {
+			c.log.Info("RLP gateway closed the stream, reconnecting")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		c.resolve()
+	}
+}
+
+func (c *Client) resolve() {
+	if c.resolveURL == nil {
+		return
+	}
+	gatewayURL, err := c.resolveURL()
+	if err != nil {
+		c.log.Warnf("Could not look up the RLP gateway again, reconnecting to %s: %s", c.url, err)
+		return
+	}
+	gatewayURL = strings.TrimRight(gatewayURL, "/")
+	if gatewayURL != c.url {
+		c.log.Infof("RLP gateway moved from %s to %s", c.url, gatewayURL)
+		c.url = gatewayURL
+	}
+}
+
+// stream reads one connection until it ends. It reports whether any
+// envelopes were received, so that a connection that worked for a while
+// resets the backoff.
+func (c *Client) stream(ctx context.Context, authToken string, conv *converter, messages chan<- *events.Envelope) (bool, error) {
+	req, err := http.NewRequest("GET", c.streamURL(), nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	if authToken != "" {
+		req.Header.Set("Authorization", authToken)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		statusErr := &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+		if resp.StatusCode >= 500 {
+			return false, fmt.Errorf("%s", statusErr)
+		}
+		return false, statusErr
+	}
+
+	received := false
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventBytes)
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		switch {
+		case len(line) == 0:
+			if data.Len() == 0 {
+				continue
+			}
+			batch, err := decodeBatch(data.Bytes())
+			data.Reset()
+			if err != nil {
+				c.log.Errorf("Skipping malformed batch from the RLP gateway: %s", err)
+				continue
+			}
+			for _, v2 := range batch {
+				for _, envelope := range conv.convert(v2) {
+					select {
+					case messages <- envelope:
+						received = true
+					case <-ctx.Done():
+						return received, nil
+					}
+				}
+			}
+		case bytes.HasPrefix(line, []byte("data:")):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" ")))
+		}
+		// Comments, heartbeats and other fields such as event: and id:
+		// carry nothing the nozzle needs.
+	}
+	return received, scanner.Err()
+}
+
+func (c *Client) streamURL() string {
+	query := "shard_id=" + url.QueryEscape(c.shardID)
+	for _, selector := range c.selectors {
+		query += "&" + url.QueryEscape(selector)
+	}
+	return c.url + "/v2/read?" + query
+}
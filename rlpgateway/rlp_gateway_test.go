@@ -0,0 +1,198 @@
+package rlpgateway_test
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/rlpgateway"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/testhelpers"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RLP gateway client", func() {
+	var (
+		gateway  *testhelpers.FakeRLPGateway
+		client   *rlpgateway.Client
+		messages <-chan *events.Envelope
+		errs     <-chan error
+	)
+
+	BeforeEach(func() {
+		gateway = testhelpers.NewFakeRLPGateway()
+		gateway.Start()
+		client = rlpgateway.New(gateway.URL(), "my-shard", []string{"gauge", "counter"}, nil, testhelpers.Logger())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		gateway.Close()
+	})
+
+	receive := func() *events.Envelope {
+		var envelope *events.Envelope
+		Eventually(messages).Should(Receive(&envelope))
+		return envelope
+	}
+
+	It("requests the shard and selectors with the auth token", func() {
+		messages, errs = client.Stream("bearer my-token")
+
+		Eventually(gateway.Requests).Should(HaveLen(1))
+		req := gateway.Requests()[0]
+		Expect(req.URL.Path).To(Equal("/v2/read"))
+		Expect(req.URL.RawQuery).To(Equal("shard_id=my-shard&gauge&counter"))
+		Expect(req.Header.Get("Authorization")).To(Equal("bearer my-token"))
+	})
+
+	It("converts every metric of a gauge", func() {
+		gateway.AddBatch(`{"batch":[{"timestamp":"1500000000000000000","source_id":"doppler","instance_id":"2","tags":{"deployment":"cf","job":"doppler","ip":"10.0.0.1","zone":"z1"},"gauge":{"metrics":{"memory":{"unit":"bytes","value":1024},"cpu":{"unit":"percentage","value":12.5}}}}]}`)
+		messages, errs = client.Stream("")
+
+		cpu := receive()
+		Expect(cpu.GetEventType()).To(Equal(events.Envelope_ValueMetric))
+		Expect(cpu.GetOrigin()).To(Equal("doppler"))
+		Expect(cpu.GetTimestamp()).To(BeEquivalentTo(1500000000000000000))
+		Expect(cpu.GetDeployment()).To(Equal("cf"))
+		Expect(cpu.GetJob()).To(Equal("doppler"))
+		Expect(cpu.GetIndex()).To(Equal("2"))
+		Expect(cpu.GetIp()).To(Equal("10.0.0.1"))
+		Expect(cpu.GetTags()).To(Equal(map[string]string{"source_id": "doppler", "zone": "z1"}))
+		Expect(cpu.GetValueMetric().GetName()).To(Equal("cpu"))
+		Expect(cpu.GetValueMetric().GetValue()).To(Equal(12.5))
+		Expect(cpu.GetValueMetric().GetUnit()).To(Equal("percentage"))
+
+		memory := receive()
+		Expect(memory.GetValueMetric().GetName()).To(Equal("memory"))
+		Expect(memory.GetValueMetric().GetValue()).To(Equal(1024.0))
+	})
+
+	It("keeps a running total for counters that only send deltas", func() {
+		gateway.AddBatch(`{"batch":[{"source_id":"router","tags":{"origin":"gorouter"},"counter":{"name":"requests","delta":"3"}},{"source_id":"router","counter":{"name":"requests","delta":"4"}}]}`)
+		gateway.AddBatch(`{"batch":[{"source_id":"router","counter":{"name":"bytes","delta":10,"total":500}}]}`)
+		messages, errs = client.Stream("")
+
+		first := receive()
+		Expect(first.GetEventType()).To(Equal(events.Envelope_CounterEvent))
+		Expect(first.GetOrigin()).To(Equal("gorouter"))
+		Expect(first.GetCounterEvent().GetName()).To(Equal("requests"))
+		Expect(first.GetCounterEvent().GetDelta()).To(BeEquivalentTo(3))
+		Expect(first.GetCounterEvent().GetTotal()).To(BeEquivalentTo(3))
+
+		second := receive()
+		Expect(second.GetOrigin()).To(Equal("router"))
+		Expect(second.GetCounterEvent().GetTotal()).To(BeEquivalentTo(7))
+
+		third := receive()
+		Expect(third.GetCounterEvent().GetName()).To(Equal("bytes"))
+		Expect(third.GetCounterEvent().GetTotal()).To(BeEquivalentTo(500))
+	})
+
+	It("keeps a total of zero sent by the gateway", func() {
+		gateway.AddBatch(`{"batch":[{"source_id":"router","counter":{"name":"requests","delta":"3","total":"0"}}]}`)
+		messages, errs = client.Stream("")
+
+		counter := receive()
+		Expect(counter.GetCounterEvent().GetDelta()).To(BeEquivalentTo(3))
+		Expect(counter.GetCounterEvent().GetTotal()).To(BeEquivalentTo(0))
+	})
+
+	It("starts running totals over when it reconnects", func() {
+		gateway.AddBatch(`{"batch":[{"source_id":"router","counter":{"name":"requests","delta":"3"}}]}`)
+		messages, errs = client.Stream("")
+		Expect(receive().GetCounterEvent().GetTotal()).To(BeEquivalentTo(3))
+
+		gateway.AddBatch(`{"batch":[{"source_id":"router","counter":{"name":"requests","delta":"4"}}]}`)
+		gateway.EndStreams()
+
+		Expect(receive().GetCounterEvent().GetTotal()).To(BeEquivalentTo(4))
+	})
+
+	It("converts timers to durations in milliseconds and events to errors", func() {
+		gateway.AddBatch(`{"batch":[{"source_id":"cc","timer":{"name":"http","start":"1000000","stop":"3500000"}},{"source_id":"cc","event":{"title":"deploy","body":"app restarted"}},{"source_id":"app","log":{"payload":"aGVsbG8="}}]}`)
+		messages, errs = client.Stream("")
+
+		timer := receive()
+		Expect(timer.GetEventType()).To(Equal(events.Envelope_ValueMetric))
+		Expect(timer.GetValueMetric().GetName()).To(Equal("http"))
+		Expect(timer.GetValueMetric().GetValue()).To(Equal(2.5))
+		Expect(timer.GetValueMetric().GetUnit()).To(Equal("ms"))
+
+		event := receive()
+		Expect(event.GetEventType()).To(Equal(events.Envelope_Error))
+		Expect(event.GetError().GetSource()).To(Equal("deploy"))
+		Expect(event.GetError().GetMessage()).To(Equal("app restarted"))
+
+		Consistently(messages).ShouldNot(Receive())
+	})
+
+	It("skips malformed batches", func() {
+		gateway.AddBatch(`{"batch":[`)
+		gateway.AddBatch(`{"batch":[{"source_id":"cc","gauge":{"metrics":{"up":{"value":1}}}}]}`)
+		messages, errs = client.Stream("")
+
+		Expect(receive().GetValueMetric().GetName()).To(Equal("up"))
+		Expect(errs).NotTo(Receive())
+	})
+
+	It("reconnects when the stream ends", func() {
+		messages, errs = client.Stream("")
+		Eventually(gateway.Requests).Should(HaveLen(1))
+
+		gateway.AddBatch(`{"batch":[{"source_id":"cc","gauge":{"metrics":{"up":{"value":1}}}}]}`)
+		gateway.EndStreams()
+
+		Expect(receive().GetValueMetric().GetName()).To(Equal("up"))
+		Expect(len(gateway.Requests())).To(BeNumerically(">=", 2))
+	})
+
+	Context("with a URL resolver", func() {
+		var moved *testhelpers.FakeRLPGateway
+
+		BeforeEach(func() {
+			moved = testhelpers.NewFakeRLPGateway()
+			moved.Start()
+		})
+
+		AfterEach(func() {
+			moved.Close()
+		})
+
+		It("reconnects to the URL it resolves", func() {
+			client.SetURLResolver(func() (string, error) { return moved.URL(), nil })
+			messages, errs = client.Stream("")
+			Eventually(gateway.Requests).Should(HaveLen(1))
+
+			moved.AddBatch(`{"batch":[{"source_id":"cc","gauge":{"metrics":{"up":{"value":1}}}}]}`)
+			gateway.EndStreams()
+
+			Expect(receive().GetValueMetric().GetName()).To(Equal("up"))
+			Expect(gateway.Requests()).To(HaveLen(1))
+		})
+
+		It("keeps the URL it has when resolving fails", func() {
+			client.SetURLResolver(func() (string, error) { return "", errors.New("cloud controller is down") })
+			messages, errs = client.Stream("")
+			Eventually(gateway.Requests).Should(HaveLen(1))
+
+			gateway.EndStreams()
+
+			Eventually(gateway.Requests).Should(HaveLen(2))
+			Expect(moved.Requests()).To(BeEmpty())
+		})
+	})
+
+	It("stops with an error when the gateway rejects the request", func() {
+		gateway.SetStatusCode(http.StatusForbidden)
+		messages, errs = client.Stream("bearer bad-token")
+
+		var err error
+		Eventually(errs).Should(Receive(&err))
+		statusErr, ok := err.(*rlpgateway.StatusError)
+		Expect(ok).To(BeTrue())
+		Expect(statusErr.StatusCode).To(Equal(http.StatusForbidden))
+		Expect(statusErr.Error()).To(ContainSubstring("Forbidden"))
+		Consistently(gateway.Requests).Should(HaveLen(1))
+	})
+})
@@ -0,0 +1,13 @@
+package rlpgateway_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRLPGateway(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "RLPGateway Suite")
+}
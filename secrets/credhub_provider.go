@@ -0,0 +1,71 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CredHubProvider reads the current value of value and password
+// credentials from a CredHub-style HTTP API. Authentication is left to the
+// transport, typically with a client certificate.
+type CredHubProvider struct {
+	url        string
+	httpClient *http.Client
+}
+
+type credHubResponse struct {
+	Data []struct {
+		Type  string          `json:"type"`
+		Value json.RawMessage `json:"value"`
+	} `json:"data"`
+}
+
+func NewCredHubProvider(credHubURL string, transport http.RoundTripper) *CredHubProvider {
+	return &CredHubProvider{
+		url:        strings.TrimRight(credHubURL, "/"),
+		httpClient: &http.Client{Transport: transport},
+	}
+}
+
+func (c *CredHubProvider) Get(name string) (string, error) {
+	query := url.Values{
+		"name":    {name},
+		"current": {"true"},
+	}
+	resp, err := c.httpClient.Get(c.url + "/api/v1/data?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("CredHub returned HTTP response: %s", resp.Status)
+	}
+
+	var credentials credHubResponse
+	if err := json.Unmarshal(body, &credentials); err != nil {
+		return "", fmt.Errorf("can not parse CredHub response: %s", err)
+	}
+	if len(credentials.Data) == 0 {
+		return "", fmt.Errorf("credential %s not found", name)
+	}
+
+	credential := credentials.Data[0]
+	if credential.Type != "value" && credential.Type != "password" {
+		return "", fmt.Errorf("credential %s has unsupported type %q", name, credential.Type)
+	}
+
+	var value string
+	if err := json.Unmarshal(credential.Value, &value); err != nil {
+		return "", fmt.Errorf("credential %s does not hold a string: %s", name, err)
+	}
+	return value, nil
+}
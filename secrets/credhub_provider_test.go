@@ -0,0 +1,60 @@
+package secrets_test
+
+import (
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/secrets"
+	. "github.com/cloudfoundry-incubator/datadog-firehose-nozzle/testhelpers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CredHubProvider", func() {
+	var (
+		fakeCredHub *FakeCredHub
+		provider    *secrets.CredHubProvider
+	)
+
+	BeforeEach(func() {
+		fakeCredHub = NewFakeCredHub()
+		fakeCredHub.Start()
+		provider = secrets.NewCredHubProvider(fakeCredHub.URL()+"/", nil)
+	})
+
+	AfterEach(func() {
+		fakeCredHub.Close()
+	})
+
+	It("reads value credentials", func() {
+		fakeCredHub.SetCredential("/datadog/api-key", "value", "abc123")
+
+		value, err := provider.Get("/datadog/api-key")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(value).To(Equal("abc123"))
+	})
+
+	It("reads password credentials", func() {
+		fakeCredHub.SetCredential("/uaa/nozzle-secret", "password", "hunter2")
+
+		value, err := provider.Get("/uaa/nozzle-secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(value).To(Equal("hunter2"))
+	})
+
+	It("returns the current value after a rotation", func() {
+		fakeCredHub.SetCredential("/datadog/api-key", "value", "old")
+		fakeCredHub.SetCredential("/datadog/api-key", "value", "new")
+
+		Expect(provider.Get("/datadog/api-key")).To(Equal("new"))
+	})
+
+	It("returns an error for unknown credentials", func() {
+		_, err := provider.Get("/missing")
+		Expect(err).To(MatchError("CredHub returned HTTP response: 404 Not Found"))
+	})
+
+	It("returns an error for credentials that are not strings", func() {
+		fakeCredHub.SetCredential("/datadog/cert", "certificate", map[string]string{"certificate": "..."})
+
+		_, err := provider.Get("/datadog/cert")
+		Expect(err).To(MatchError(`credential /datadog/cert has unsupported type "certificate"`))
+	})
+})
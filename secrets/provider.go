@@ -0,0 +1,76 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Provider looks up the current value of a secret by name.
+type Provider interface {
+	Get(name string) (string, error)
+}
+
+// FileProvider treats secret names as paths, as used for secrets mounted by
+// Kubernetes or BOSH. Surrounding whitespace, such as a trailing newline, is
+// stripped.
+type FileProvider struct{}
+
+func (FileProvider) Get(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// EnvProvider treats secret names as environment variables.
+type EnvProvider struct{}
+
+func (EnvProvider) Get(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// Registry dispatches references of the form "scheme:name", such as
+// "file:/var/run/secrets/api-key" or "credhub:/datadog/api-key", to the
+// provider registered for the scheme.
+type Registry map[string]Provider
+
+func NewRegistry() Registry {
+	return Registry{
+		"file": FileProvider{},
+		"env":  EnvProvider{},
+	}
+}
+
+func (r Registry) Get(ref string) (string, error) {
+	scheme, name, err := ParseRef(ref)
+	if err != nil {
+		return "", err
+	}
+
+	provider, ok := r[scheme]
+	if !ok {
+		return "", fmt.Errorf("no secret provider configured for %q", scheme)
+	}
+
+	value, err := provider.Get(name)
+	if err != nil {
+		return "", fmt.Errorf("can not read secret %s: %s", ref, err)
+	}
+	return value, nil
+}
+
+// ParseRef splits a secret reference into its scheme and name.
+func ParseRef(ref string) (scheme, name string, err error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("secret reference %q must have the form scheme:name", ref)
+	}
+	return parts[0], parts[1], nil
+}
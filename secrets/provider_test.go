@@ -0,0 +1,81 @@
+package secrets_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/secrets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Providers", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "secrets")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("FileProvider", func() {
+		It("reads the secret without surrounding whitespace", func() {
+			path := filepath.Join(dir, "api-key")
+			Expect(ioutil.WriteFile(path, []byte("abc123\n"), 0600)).To(Succeed())
+
+			value, err := secrets.FileProvider{}.Get(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value).To(Equal("abc123"))
+		})
+
+		It("returns an error when the file is missing", func() {
+			_, err := secrets.FileProvider{}.Get(filepath.Join(dir, "missing"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("EnvProvider", func() {
+		AfterEach(func() {
+			os.Unsetenv("SECRETS_TEST_VALUE")
+		})
+
+		It("reads the environment variable", func() {
+			os.Setenv("SECRETS_TEST_VALUE", "from-env")
+
+			value, err := secrets.EnvProvider{}.Get("SECRETS_TEST_VALUE")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value).To(Equal("from-env"))
+		})
+
+		It("returns an error when the variable is not set", func() {
+			_, err := secrets.EnvProvider{}.Get("SECRETS_TEST_VALUE")
+			Expect(err).To(MatchError("environment variable SECRETS_TEST_VALUE is not set"))
+		})
+	})
+
+	Describe("Registry", func() {
+		It("dispatches on the reference scheme", func() {
+			path := filepath.Join(dir, "secret")
+			Expect(ioutil.WriteFile(path, []byte("from-file"), 0600)).To(Succeed())
+
+			value, err := secrets.NewRegistry().Get("file:" + path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value).To(Equal("from-file"))
+		})
+
+		It("rejects schemes without a provider", func() {
+			_, err := secrets.NewRegistry().Get("credhub:/datadog/api-key")
+			Expect(err).To(MatchError(`no secret provider configured for "credhub"`))
+		})
+
+		It("rejects malformed references", func() {
+			_, err := secrets.NewRegistry().Get("api-key")
+			Expect(err).To(MatchError(`secret reference "api-key" must have the form scheme:name`))
+		})
+	})
+})
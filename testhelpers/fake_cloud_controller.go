@@ -0,0 +1,90 @@
+package testhelpers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// FakeCloudController serves /v2/info and the v3 root with the endpoints it
+// is given. Either can be turned off to mimic older or newer Cloud
+// Controllers.
+type FakeCloudController struct {
+	server *httptest.Server
+	lock   sync.Mutex
+
+	uaaURL               string
+	trafficControllerURL string
+	rlpGatewayURL        string
+	disableV2Info        bool
+	disableV3Root        bool
+	requests             int
+}
+
+func NewFakeCloudController(uaaURL, trafficControllerURL, rlpGatewayURL string) *FakeCloudController {
+	return &FakeCloudController{
+		uaaURL:               uaaURL,
+		trafficControllerURL: trafficControllerURL,
+		rlpGatewayURL:        rlpGatewayURL,
+	}
+}
+
+func (f *FakeCloudController) Start() {
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.Start()
+}
+
+func (f *FakeCloudController) Close() {
+	f.server.Close()
+}
+
+func (f *FakeCloudController) URL() string {
+	return f.server.URL
+}
+
+func (f *FakeCloudController) DisableV2Info() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.disableV2Info = true
+}
+
+func (f *FakeCloudController) DisableV3Root() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.disableV3Root = true
+}
+
+func (f *FakeCloudController) Requests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func (f *FakeCloudController) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests++
+
+	switch {
+	case r.URL.Path == "/v2/info" && !f.disableV2Info:
+		fmt.Fprintf(rw, `{
+			"name": "",
+			"api_version": "2.150.0",
+			"authorization_endpoint": "https://login.example.com",
+			"token_endpoint": %q,
+			"doppler_logging_endpoint": %q
+		}`, f.uaaURL, f.trafficControllerURL)
+	case r.URL.Path == "/" && !f.disableV3Root:
+		fmt.Fprintf(rw, `{
+			"links": {
+				"self": {"href": %q},
+				"uaa": {"href": %q},
+				"logging": {"href": %q},
+				"log_stream": {"href": %q}
+			}
+		}`, f.server.URL, f.uaaURL, f.trafficControllerURL, f.rlpGatewayURL)
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,82 @@
+package testhelpers
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+type FakeCredHub struct {
+	server *httptest.Server
+	lock   sync.Mutex
+
+	credentials map[string]fakeCredential
+	requests    int
+}
+
+type fakeCredential struct {
+	Type  string      `json:"type"`
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+func NewFakeCredHub() *FakeCredHub {
+	return &FakeCredHub{
+		credentials: make(map[string]fakeCredential),
+	}
+}
+
+func (f *FakeCredHub) Start() {
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.Start()
+}
+
+func (f *FakeCredHub) StartTLS(config *tls.Config) {
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.TLS = config
+	f.server.StartTLS()
+}
+
+func (f *FakeCredHub) Close() {
+	f.server.Close()
+}
+
+func (f *FakeCredHub) URL() string {
+	return f.server.URL
+}
+
+func (f *FakeCredHub) SetCredential(name, credentialType string, value interface{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.credentials[name] = fakeCredential{Type: credentialType, Name: name, Value: value}
+}
+
+func (f *FakeCredHub) Requests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func (f *FakeCredHub) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests++
+
+	if r.URL.Path != "/api/v1/data" || r.URL.Query().Get("current") != "true" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	credential, ok := f.credentials[r.URL.Query().Get("name")]
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(`{"error":"The request could not be completed because the credential does not exist or you do not have sufficient authorization."}`))
+		return
+	}
+
+	json.NewEncoder(rw).Encode(map[string][]fakeCredential{
+		"data": {credential},
+	})
+}
@@ -4,16 +4,21 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 )
 
 type FakeDatadogAPI struct {
 	server           *httptest.Server
 	ReceivedContents chan []byte
+	ReceivedChecks   chan []byte
+	ReceivedEvents   chan []byte
 }
 
 func NewFakeDatadogAPI() *FakeDatadogAPI {
 	return &FakeDatadogAPI{
 		ReceivedContents: make(chan []byte, 100),
+		ReceivedChecks:   make(chan []byte, 100),
+		ReceivedEvents:   make(chan []byte, 100),
 	}
 }
 
@@ -34,7 +39,15 @@ func (f *FakeDatadogAPI) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	contents, _ := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 
+	received := f.ReceivedContents
+	if strings.HasSuffix(r.URL.Path, "/check_run") {
+		received = f.ReceivedChecks
+	}
+	if strings.HasSuffix(r.URL.Path, "/events") {
+		received = f.ReceivedEvents
+	}
+
 	go func() {
-		f.ReceivedContents <- contents
+		received <- contents
 	}()
 }
@@ -0,0 +1,76 @@
+package testhelpers
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/datadogfirehosenozzle"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// FakeEnvelopeSource is a remote envelope source fed by the test. Errors
+// sent to Errors are classified with Classification.
+type FakeEnvelopeSource struct {
+	Envelopes      chan *events.Envelope
+	Errors         chan error
+	Classification datadogfirehosenozzle.SourceError
+
+	lock      sync.Mutex
+	authToken string
+	started   bool
+	closed    bool
+}
+
+func NewFakeEnvelopeSource() *FakeEnvelopeSource {
+	return &FakeEnvelopeSource{
+		Envelopes: make(chan *events.Envelope, 100),
+		Errors:    make(chan error, 1),
+	}
+}
+
+func (f *FakeEnvelopeSource) Start(authToken string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.authToken = authToken
+	f.started = true
+	return nil
+}
+
+func (f *FakeEnvelopeSource) Stream() (<-chan *events.Envelope, <-chan error) {
+	return f.Envelopes, f.Errors
+}
+
+func (f *FakeEnvelopeSource) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+}
+
+func (f *FakeEnvelopeSource) Classify(err error) datadogfirehosenozzle.SourceError {
+	return f.Classification
+}
+
+func (f *FakeEnvelopeSource) Remote() bool {
+	return true
+}
+
+func (f *FakeEnvelopeSource) String() string {
+	return "fake source"
+}
+
+func (f *FakeEnvelopeSource) AuthToken() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.authToken
+}
+
+func (f *FakeEnvelopeSource) Started() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.started
+}
+
+func (f *FakeEnvelopeSource) Closed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closed
+}
@@ -1,6 +1,7 @@
 package testhelpers
 
 import (
+	"crypto/tls"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -23,12 +24,15 @@ type FakeFirehose struct {
 
 	events       []events.Envelope
 	closeMessage []byte
+	holdOpen     bool
+	done         chan struct{}
 }
 
 func NewFakeFirehose(validToken string) *FakeFirehose {
 	return &FakeFirehose{
 		validToken:   validToken,
 		closeMessage: websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		done:         make(chan struct{}),
 	}
 }
 
@@ -37,7 +41,18 @@ func (f *FakeFirehose) Start() {
 	f.server.Start()
 }
 
+func (f *FakeFirehose) StartTLS(config *tls.Config) {
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.TLS = config
+	f.server.StartTLS()
+}
+
 func (f *FakeFirehose) Close() {
+	select {
+	case <-f.done:
+	default:
+		close(f.done)
+	}
 	f.server.Close()
 }
 
@@ -70,15 +85,26 @@ func (f *FakeFirehose) SetCloseMessage(message []byte) {
 	copy(f.closeMessage, message)
 }
 
-func (f *FakeFirehose) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+// SetHoldOpen keeps connections open after the events are sent, until the
+// firehose is closed, instead of closing them with the close message.
+func (f *FakeFirehose) SetHoldOpen() {
 	f.lock.Lock()
 	defer f.lock.Unlock()
+	f.holdOpen = true
+}
 
+func (f *FakeFirehose) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
 	f.lastAuthorization = r.Header.Get("Authorization")
 	f.requested = true
-
-	if f.lastAuthorization != f.validToken {
-		log.Printf("Bad token passed to firehose: %s", f.lastAuthorization)
+	authorized := f.lastAuthorization == f.validToken
+	envelopes := f.events
+	closeMessage := f.closeMessage
+	holdOpen := f.holdOpen
+	f.lock.Unlock()
+
+	if !authorized {
+		log.Printf("Bad token passed to firehose: %s", r.Header.Get("Authorization"))
 		rw.WriteHeader(403)
 		r.Body.Close()
 		return
@@ -91,13 +117,17 @@ func (f *FakeFirehose) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	ws, _ := upgrader.Upgrade(rw, r, nil)
 
 	defer ws.Close()
-	defer ws.WriteControl(websocket.CloseMessage, f.closeMessage, time.Time{})
+	defer ws.WriteControl(websocket.CloseMessage, closeMessage, time.Time{})
 
-	for _, envelope := range f.events {
+	for _, envelope := range envelopes {
 		buffer, _ := proto.Marshal(&envelope)
 		err := ws.WriteMessage(websocket.BinaryMessage, buffer)
 		if err != nil {
 			panic(err)
 		}
 	}
+
+	if holdOpen {
+		<-f.done
+	}
 }
@@ -5,29 +5,29 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
 	"github.com/cloudfoundry/gosteno"
 )
 
 var TestLoggerSink = new(TestStenoSink)
-var logger = getLogger(false)
+var testLogger = getLogger(false)
 
-func StdOutLogger() *gosteno.Logger {
+func StdOutLogger() logger.Logger {
 	return getLogger(true)
 }
 
-func Logger() *gosteno.Logger {
-	return logger
+func Logger() logger.Logger {
+	return testLogger
 }
 
-func getLogger(debug bool) *gosteno.Logger {
+func getLogger(debug bool) logger.Logger {
 
 	level := gosteno.LOG_DEBUG
 
 	loggingConfig := &gosteno.Config{
-		Sinks:     []gosteno.Sink{TestLoggerSink},
-		Level:     level,
-		Codec:     gosteno.NewJsonCodec(),
-		EnableLOC: true,
+		Sinks: []gosteno.Sink{TestLoggerSink},
+		Level: level,
+		Codec: gosteno.NewJsonCodec(),
 	}
 
 	if debug {
@@ -36,7 +36,7 @@ func getLogger(debug bool) *gosteno.Logger {
 
 	gosteno.Init(loggingConfig)
 
-	return gosteno.NewLogger("TestLogger")
+	return logger.FromSteno(gosteno.NewLogger("TestLogger"))
 }
 
 type TestStenoSink struct {
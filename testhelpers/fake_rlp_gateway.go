@@ -0,0 +1,97 @@
+package testhelpers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// FakeRLPGateway serves each queued batch once as a server-sent event, then
+// holds the stream open until it is closed or EndStreams is called.
+type FakeRLPGateway struct {
+	server *httptest.Server
+	lock   sync.Mutex
+
+	statusCode int
+	batches    []string
+	requests   []*http.Request
+	end        chan struct{}
+}
+
+func NewFakeRLPGateway() *FakeRLPGateway {
+	return &FakeRLPGateway{
+		statusCode: http.StatusOK,
+		end:        make(chan struct{}),
+	}
+}
+
+func (f *FakeRLPGateway) Start() {
+	f.server = httptest.NewServer(f)
+}
+
+func (f *FakeRLPGateway) Close() {
+	f.EndStreams()
+	f.server.Close()
+}
+
+// EndStreams cleanly ends every open stream.
+func (f *FakeRLPGateway) EndStreams() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	close(f.end)
+	f.end = make(chan struct{})
+}
+
+func (f *FakeRLPGateway) URL() string {
+	return f.server.URL
+}
+
+// AddBatch queues the JSON of a v2 envelope batch, such as
+// `{"batch":[...]}`, to be sent on the next stream.
+func (f *FakeRLPGateway) AddBatch(batch string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.batches = append(f.batches, batch)
+}
+
+func (f *FakeRLPGateway) SetStatusCode(statusCode int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.statusCode = statusCode
+}
+
+func (f *FakeRLPGateway) Requests() []*http.Request {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*http.Request(nil), f.requests...)
+}
+
+func (f *FakeRLPGateway) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	f.requests = append(f.requests, r)
+	statusCode := f.statusCode
+	batches := f.batches
+	f.batches = nil
+	end := f.end
+	f.lock.Unlock()
+
+	if statusCode != http.StatusOK {
+		rw.WriteHeader(statusCode)
+		fmt.Fprint(rw, http.StatusText(statusCode))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprint(rw, ": heartbeat\n\n")
+	for _, batch := range batches {
+		fmt.Fprintf(rw, "data: %s\n\n", batch)
+	}
+	rw.(http.Flusher).Flush()
+
+	select {
+	case <-end:
+	case <-r.Context().Done():
+	}
+}
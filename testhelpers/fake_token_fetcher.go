@@ -2,9 +2,14 @@ package testhelpers
 
 type FakeTokenFetcher struct {
 	NumCalls int
+	// Err, if set, is returned instead of a token.
+	Err error
 }
 
-func (tokenFetcher *FakeTokenFetcher) FetchAuthToken() string {
+func (tokenFetcher *FakeTokenFetcher) FetchAuthToken() (string, error) {
 	tokenFetcher.NumCalls++
-	return "auth token"
+	if tokenFetcher.Err != nil {
+		return "", tokenFetcher.Err
+	}
+	return "auth token", nil
 }
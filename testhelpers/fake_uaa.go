@@ -1,6 +1,8 @@
 package testhelpers
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -11,24 +13,66 @@ type FakeUAA struct {
 	server *httptest.Server
 	lock   sync.Mutex
 
-	tokenType   string
-	accessToken string
+	tokenType    string
+	accessToken  string
+	scope        string
+	refreshToken string
 
-	requested bool
+	failures    int
+	failStatus  int
+	requests    int
+	requested   bool
+	lastRequest *http.Request
 }
 
 func NewFakeUAA(tokenType string, accessToken string) *FakeUAA {
 	return &FakeUAA{
 		tokenType:   tokenType,
 		accessToken: accessToken,
+		scope:       "doppler.firehose",
 	}
 }
 
+// SetScope sets the scope field of the token responses. An empty scope is
+// left out of the response.
+func (f *FakeUAA) SetScope(scope string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.scope = scope
+}
+
+// SetRefreshToken makes token responses carry refreshToken.
+func (f *FakeUAA) SetRefreshToken(refreshToken string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.refreshToken = refreshToken
+}
+
+// Fail answers the next count requests with status.
+func (f *FakeUAA) Fail(count int, status int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = count
+	f.failStatus = status
+}
+
+func (f *FakeUAA) Requests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
 func (f *FakeUAA) Start() {
 	f.server = httptest.NewUnstartedServer(f)
 	f.server.Start()
 }
 
+func (f *FakeUAA) StartTLS(config *tls.Config) {
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.TLS = config
+	f.server.StartTLS()
+}
+
 func (f *FakeUAA) Close() {
 	f.server.Close()
 }
@@ -43,17 +87,39 @@ func (f *FakeUAA) Requested() bool {
 	return f.requested
 }
 
+func (f *FakeUAA) LastRequest() *http.Request {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lastRequest
+}
+
 func (f *FakeUAA) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	rw.Write([]byte(fmt.Sprintf(`
-		{
-			"token_type": "%s",
-			"access_token": "%s"
-		}
-	`, f.tokenType, f.accessToken)))
+	r.ParseForm()
 	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests++
 	f.requested = true
-	f.lock.Unlock()
+	f.lastRequest = r
+
+	if f.failures > 0 {
+		f.failures--
+		rw.WriteHeader(f.failStatus)
+		rw.Write([]byte(`{"error": "unauthorized", "error_description": "Bad credentials"}`))
+		return
+	}
+
+	response := map[string]string{
+		"token_type":   f.tokenType,
+		"access_token": f.accessToken,
+	}
+	if f.scope != "" {
+		response["scope"] = f.scope
+	}
+	if f.refreshToken != "" {
+		response["refresh_token"] = f.refreshToken
+	}
+	json.NewEncoder(rw).Encode(response)
 }
 
 func (f *FakeUAA) AuthToken() string {
@@ -0,0 +1,85 @@
+package transportconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+type ProxyFunc func(*http.Request) (*url.URL, error)
+
+func NewTLSConfig(caCertPath, certPath, keyPath string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caCertPath != "" {
+		caCertPool, err := loadCertPool(caCertPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if certPath != "" || keyPath != "" {
+		if certPath == "" || keyPath == "" {
+			return nil, fmt.Errorf("Both a client certificate and key are required, got certificate [%s] and key [%s]", certPath, keyPath)
+		}
+
+		reloader, err := newCertificateReloader(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	return tlsConfig, nil
+}
+
+func NewProxyFunc(httpProxy, httpsProxy, noProxy string) ProxyFunc {
+	proxyConfig := httpproxy.FromEnvironment()
+	if httpProxy != "" {
+		proxyConfig.HTTPProxy = httpProxy
+	}
+	if httpsProxy != "" {
+		proxyConfig.HTTPSProxy = httpsProxy
+	}
+	if noProxy != "" {
+		proxyConfig.NoProxy = noProxy
+	}
+
+	proxyForURL := proxyConfig.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyForURL(req.URL)
+	}
+}
+
+func NewTransport(tlsConfig *tls.Config, proxy ProxyFunc) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = tlsConfig
+	return transport
+}
+
+func loadCertPool(caCertPath string) (*x509.CertPool, error) {
+	caCertPool, err := x509.SystemCertPool()
+	if err != nil || caCertPool == nil {
+		caCertPool = x509.NewCertPool()
+	}
+
+	caCert, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("Can not read CA certificate file [%s]: %s", caCertPath, err)
+	}
+
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("No certificates found in CA certificate file [%s]", caCertPath)
+	}
+
+	return caCertPool, nil
+}
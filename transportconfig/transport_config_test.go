@@ -0,0 +1,227 @@
+package transportconfig_test
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/testhelpers"
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/transportconfig"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TransportConfig", func() {
+	var (
+		tmpDir string
+		ca     *testhelpers.FakeCertificateAuthority
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "transportconfig")
+		Expect(err).ToNot(HaveOccurred())
+
+		ca = testhelpers.NewFakeCertificateAuthority()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	writeFile := func(name string, contents []byte) string {
+		path := filepath.Join(tmpDir, name)
+		Expect(ioutil.WriteFile(path, contents, 0600)).To(Succeed())
+		return path
+	}
+
+	Describe("NewTLSConfig", func() {
+		It("trusts servers signed by the configured CA", func() {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+			server.TLS = ca.ServerTLSConfig()
+			server.StartTLS()
+			defer server.Close()
+
+			tlsConfig, err := transportconfig.NewTLSConfig(writeFile("ca.pem", ca.CertPEM()), "", "", false)
+			Expect(err).ToNot(HaveOccurred())
+
+			client := &http.Client{Transport: transportconfig.NewTransport(tlsConfig, nil)}
+			resp, err := client.Get(server.URL)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+
+			client = &http.Client{Transport: transportconfig.NewTransport(nil, nil)}
+			_, err = client.Get(server.URL)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("sets InsecureSkipVerify", func() {
+			tlsConfig, err := transportconfig.NewTLSConfig("", "", "", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tlsConfig.InsecureSkipVerify).To(BeTrue())
+			Expect(tlsConfig.RootCAs).To(BeNil())
+		})
+
+		It("loads the client certificate", func() {
+			certPEM, keyPEM := ca.IssueCertificate("client")
+			tlsConfig, err := transportconfig.NewTLSConfig("", writeFile("cert.pem", certPEM), writeFile("key.pem", keyPEM), false)
+			Expect(err).ToNot(HaveOccurred())
+
+			cert, err := tlsConfig.GetClientCertificate(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cert.Certificate).To(HaveLen(1))
+		})
+
+		It("returns an error when the client certificate can not be loaded", func() {
+			_, err := transportconfig.NewTLSConfig("", writeFile("cert.pem", []byte("garbage")), writeFile("key.pem", []byte("garbage")), false)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Can not load client certificate"))
+		})
+
+		Context("with a server requiring client certificates", func() {
+			var (
+				server       *httptest.Server
+				clientNames  chan string
+				certPath     string
+				keyPath      string
+				rotateClient func(name string, modTime time.Time)
+			)
+
+			BeforeEach(func() {
+				clientNames = make(chan string, 10)
+				server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+					clientNames <- r.TLS.PeerCertificates[0].Subject.CommonName
+				}))
+				server.TLS = ca.ServerTLSConfig()
+				server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+				server.TLS.ClientCAs = ca.CertPool()
+				server.StartTLS()
+
+				rotateClient = func(name string, modTime time.Time) {
+					certPEM, keyPEM := ca.IssueCertificate(name)
+					certPath = writeFile("cert.pem", certPEM)
+					keyPath = writeFile("key.pem", keyPEM)
+					Expect(os.Chtimes(certPath, modTime, modTime)).To(Succeed())
+					Expect(os.Chtimes(keyPath, modTime, modTime)).To(Succeed())
+				}
+				rotateClient("client-a", time.Now().Add(-time.Minute))
+			})
+
+			AfterEach(func() {
+				server.Close()
+			})
+
+			get := func(tlsConfig *tls.Config) error {
+				transport := transportconfig.NewTransport(tlsConfig, nil)
+				transport.DisableKeepAlives = true
+				resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+				if err == nil {
+					resp.Body.Close()
+				}
+				return err
+			}
+
+			It("presents the client certificate", func() {
+				tlsConfig, err := transportconfig.NewTLSConfig(writeFile("ca.pem", ca.CertPEM()), certPath, keyPath, false)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(get(tlsConfig)).To(Succeed())
+				Expect(clientNames).To(Receive(Equal("client-a")))
+			})
+
+			It("reloads the client certificate when the files change", func() {
+				tlsConfig, err := transportconfig.NewTLSConfig(writeFile("ca.pem", ca.CertPEM()), certPath, keyPath, false)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(get(tlsConfig)).To(Succeed())
+				Expect(clientNames).To(Receive(Equal("client-a")))
+
+				rotateClient("client-b", time.Now())
+
+				Expect(get(tlsConfig)).To(Succeed())
+				Expect(clientNames).To(Receive(Equal("client-b")))
+			})
+
+			It("keeps the previous certificate while the new files are incomplete", func() {
+				tlsConfig, err := transportconfig.NewTLSConfig(writeFile("ca.pem", ca.CertPEM()), certPath, keyPath, false)
+				Expect(err).ToNot(HaveOccurred())
+
+				certPEM, _ := ca.IssueCertificate("client-b")
+				writeFile("cert.pem", certPEM)
+				Expect(os.Chtimes(certPath, time.Now(), time.Now())).To(Succeed())
+
+				Expect(get(tlsConfig)).To(Succeed())
+				Expect(clientNames).To(Receive(Equal("client-a")))
+			})
+		})
+
+		It("returns an error when the CA file is missing", func() {
+			_, err := transportconfig.NewTLSConfig(filepath.Join(tmpDir, "missing.pem"), "", "", false)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Can not read CA certificate file"))
+		})
+
+		It("returns an error when the CA file has no certificates", func() {
+			_, err := transportconfig.NewTLSConfig(writeFile("ca.pem", []byte("garbage")), "", "", false)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("No certificates found"))
+		})
+
+		It("returns an error when only one of client certificate and key is set", func() {
+			certPEM, _ := ca.IssueCertificate("client")
+			_, err := transportconfig.NewTLSConfig("", writeFile("cert.pem", certPEM), "", false)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Both a client certificate and key are required"))
+		})
+	})
+
+	Describe("NewProxyFunc", func() {
+		proxyFor := func(proxy transportconfig.ProxyFunc, rawURL string) *url.URL {
+			u, err := url.Parse(rawURL)
+			Expect(err).ToNot(HaveOccurred())
+			proxyURL, err := proxy(&http.Request{URL: u})
+			Expect(err).ToNot(HaveOccurred())
+			return proxyURL
+		}
+
+		BeforeEach(func() {
+			os.Clearenv()
+		})
+
+		It("selects the proxy by scheme", func() {
+			proxy := transportconfig.NewProxyFunc("http://http-proxy:8080", "http://https-proxy:8080", "")
+
+			Expect(proxyFor(proxy, "http://app.datadoghq.com").Host).To(Equal("http-proxy:8080"))
+			Expect(proxyFor(proxy, "https://app.datadoghq.com").Host).To(Equal("https-proxy:8080"))
+		})
+
+		It("bypasses the proxy for hosts in noProxy", func() {
+			proxy := transportconfig.NewProxyFunc("", "http://https-proxy:8080", "uaa.internal,.cf.internal")
+
+			Expect(proxyFor(proxy, "https://uaa.internal")).To(BeNil())
+			Expect(proxyFor(proxy, "https://doppler.cf.internal")).To(BeNil())
+			Expect(proxyFor(proxy, "https://app.datadoghq.com")).ToNot(BeNil())
+		})
+
+		It("falls back to the environment", func() {
+			os.Setenv("HTTPS_PROXY", "http://env-proxy:3128")
+			os.Setenv("NO_PROXY", "uaa.internal")
+			proxy := transportconfig.NewProxyFunc("", "", "")
+
+			Expect(proxyFor(proxy, "https://app.datadoghq.com").Host).To(Equal("env-proxy:3128"))
+			Expect(proxyFor(proxy, "https://uaa.internal")).To(BeNil())
+		})
+
+		It("prefers configured values over the environment", func() {
+			os.Setenv("HTTPS_PROXY", "http://env-proxy:3128")
+			proxy := transportconfig.NewProxyFunc("", "http://config-proxy:3128", "")
+
+			Expect(proxyFor(proxy, "https://app.datadoghq.com").Host).To(Equal("config-proxy:3128"))
+		})
+	})
+})
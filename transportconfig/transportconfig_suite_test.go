@@ -0,0 +1,13 @@
+package transportconfig_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestTransportConfig(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "TransportConfig Suite")
+}
@@ -1,38 +1,304 @@
 package uaatokenfetcher
 
 import (
-	"github.com/cloudfoundry-incubator/uaago"
-	"github.com/cloudfoundry/gosteno"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
+)
+
+const (
+	grantClientCredentials = "client_credentials"
+	grantPassword          = "password"
+	grantRefreshToken      = "refresh_token"
+)
+
+const (
+	DefaultTimeout = 10 * time.Second
+	DefaultRetries = 3
+	DefaultBackoff = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// Scopes that allow reading the firehose, and the RLP gateway for
+// LogsAdminScope.
+const (
+	FirehoseScope  = "doppler.firehose"
+	LogsAdminScope = "logs.admin"
 )
 
 type UAATokenFetcher struct {
-	uaaUrl                string
-	username              string
-	password              string
-	insecureSSLSkipVerify bool
-	log                   *gosteno.Logger
+	uaaUrl     string
+	username   string
+	httpClient *http.Client
+	log        logger.Logger
+	retries    int
+	backoff    time.Duration
+	scopes     []string
+
+	lock         sync.Mutex
+	password     string
+	grantType    string
+	userName     string
+	userPassword string
+	refreshToken string
+}
+
+type tokenResponse struct {
+	TokenType    string `json:"token_type"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// StatusError is a token request the UAA rejected.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
 }
 
-func New(uaaUrl string, username string, password string, sslSkipVerify bool, logger *gosteno.Logger) *UAATokenFetcher {
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("UAA returned HTTP response: %s", e.Status)
+	}
+	return fmt.Sprintf("UAA returned HTTP response: %s: %s", e.Status, e.Body)
+}
+
+// ScopeError is a token that lacks the scopes the nozzle needs.
+type ScopeError struct {
+	Required []string
+	Granted  []string
+}
+
+func (e *ScopeError) Error() string {
+	return fmt.Sprintf("token has scopes [%s], needs one of [%s]", strings.Join(e.Granted, " "), strings.Join(e.Required, " "))
+}
+
+// New returns a fetcher that requests client credentials grants for the
+// client username, authenticating with password.
+func New(uaaUrl string, username string, password string, transport http.RoundTripper, log logger.Logger) *UAATokenFetcher {
 	return &UAATokenFetcher{
-		uaaUrl:                uaaUrl,
-		username:              username,
-		password:              password,
-		insecureSSLSkipVerify: sslSkipVerify,
-		log: logger,
+		uaaUrl:     uaaUrl,
+		username:   username,
+		password:   password,
+		httpClient: &http.Client{Transport: transport, Timeout: DefaultTimeout},
+		log:        log.With("destination", uaaUrl),
+		retries:    DefaultRetries,
+		backoff:    DefaultBackoff,
+		scopes:     []string{FirehoseScope},
+		grantType:  grantClientCredentials,
+	}
+}
+
+// SetPassword replaces the client secret used for subsequent token requests,
+// for example after it has been rotated.
+func (uaa *UAATokenFetcher) SetPassword(password string) {
+	uaa.lock.Lock()
+	defer uaa.lock.Unlock()
+	uaa.password = password
+}
+
+// SetTimeout limits how long a single token request may take.
+func (uaa *UAATokenFetcher) SetTimeout(timeout time.Duration) {
+	uaa.httpClient.Timeout = timeout
+}
+
+// SetRetries sets how many times a token request that failed to reach the
+// UAA, or that the UAA failed to answer, is retried, waiting backoff before
+// the first retry and twice as long before each of the next.
+func (uaa *UAATokenFetcher) SetRetries(retries int, backoff time.Duration) {
+	uaa.retries = retries
+	uaa.backoff = backoff
+}
+
+// SetPasswordGrant requests tokens for the user username instead of the
+// client itself.
+func (uaa *UAATokenFetcher) SetPasswordGrant(username, password string) {
+	uaa.lock.Lock()
+	defer uaa.lock.Unlock()
+	uaa.grantType = grantPassword
+	uaa.userName = username
+	uaa.userPassword = password
+}
+
+// SetRefreshTokenGrant requests tokens with refreshToken. When the UAA
+// issues a new refresh token along with a token, it is used from then on.
+func (uaa *UAATokenFetcher) SetRefreshTokenGrant(refreshToken string) {
+	uaa.lock.Lock()
+	defer uaa.lock.Unlock()
+	uaa.grantType = grantRefreshToken
+	uaa.refreshToken = refreshToken
+}
+
+// SetRequiredScopes makes FetchAuthToken reject tokens granted none of
+// scopes. Tokens need FirehoseScope by default; no scopes disables the check.
+func (uaa *UAATokenFetcher) SetRequiredScopes(scopes ...string) {
+	uaa.scopes = scopes
+}
+
+// FetchAuthToken requests a token from the UAA, retrying when it can not be
+// reached, and returns it with its type, ready for an Authorization header.
+// Rejected requests return a *StatusError and tokens without the required
+// scopes a *ScopeError.
+func (uaa *UAATokenFetcher) FetchAuthToken() (string, error) {
+	backoff := uaa.backoff
+	for attempt := 0; ; attempt++ {
+		authToken, err := uaa.requestToken()
+		if err == nil {
+			return authToken, nil
+		}
+		if !retryable(err) || attempt >= uaa.retries {
+			return "", err
+		}
+
+		uaa.log.Infof("Error getting oauth token, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
 	}
 }
 
-func (uaa *UAATokenFetcher) FetchAuthToken() string {
-	uaaClient, err := uaago.NewClient(uaa.uaaUrl)
+// retryable reports whether err may go away on its own, unlike rejected
+// credentials or a missing scope.
+func retryable(err error) bool {
+	switch typed := err.(type) {
+	case *StatusError:
+		return typed.StatusCode >= 500 || typed.StatusCode == http.StatusTooManyRequests
+	case *ScopeError:
+		return false
+	}
+	return true
+}
+
+func (uaa *UAATokenFetcher) requestToken() (string, error) {
+	if uaa.uaaUrl == "" {
+		return "", errors.New("missing UAA URL")
+	}
+
+	uaa.lock.Lock()
+	form := url.Values{
+		"grant_type": {uaa.grantType},
+		"client_id":  {uaa.username},
+	}
+	switch uaa.grantType {
+	case grantPassword:
+		form.Set("username", uaa.userName)
+		form.Set("password", uaa.userPassword)
+	case grantRefreshToken:
+		form.Set("refresh_token", uaa.refreshToken)
+	}
+	password := uaa.password
+	uaa.lock.Unlock()
+
+	req, err := http.NewRequest("POST", strings.TrimRight(uaa.uaaUrl, "/")+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(uaa.username, password)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := uaa.httpClient.Do(req)
 	if err != nil {
-		uaa.log.Fatalf("Error creating uaa client: %s", err.Error())
+		return "", err
 	}
+	defer resp.Body.Close()
 
-	var authToken string
-	authToken, err = uaaClient.GetAuthToken(uaa.username, uaa.password, uaa.insecureSSLSkipVerify)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		uaa.log.Fatalf("Error getting oauth token: %s. Please check your username and password.", err.Error())
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: uaaErrorDescription(body)}
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("can not parse UAA response: %s", err)
+	}
+	if err := uaa.checkScopes(token); err != nil {
+		return "", err
+	}
+	if token.RefreshToken != "" {
+		uaa.lock.Lock()
+		if uaa.grantType == grantRefreshToken {
+			uaa.refreshToken = token.RefreshToken
+		}
+		uaa.lock.Unlock()
+	}
+	return fmt.Sprintf("%s %s", token.TokenType, token.AccessToken), nil
+}
+
+// checkScopes looks for the required scopes in the scope field of the
+// response, or else in the claims of the token. Tokens that carry neither
+// can not be checked and are accepted.
+func (uaa *UAATokenFetcher) checkScopes(token tokenResponse) error {
+	if len(uaa.scopes) == 0 {
+		return nil
+	}
+
+	var granted []string
+	if token.Scope != "" {
+		granted = strings.Fields(token.Scope)
+	} else if claims, ok := jwtScopes(token.AccessToken); ok {
+		granted = claims
+	} else {
+		uaa.log.Warnf("Can not verify that the UAA token has one of the scopes %s", strings.Join(uaa.scopes, ", "))
+		return nil
+	}
+
+	for _, scope := range granted {
+		for _, required := range uaa.scopes {
+			if scope == required {
+				return nil
+			}
+		}
+	}
+	return &ScopeError{Required: uaa.scopes, Granted: granted}
+}
+
+// jwtScopes reads the scope claim of a JWT without verifying its signature,
+// which is left to the Traffic Controller.
+func jwtScopes(accessToken string) ([]string, bool) {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, false
+	}
+	var claims struct {
+		Scope []string `json:"scope"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Scope == nil {
+		return nil, false
+	}
+	return claims.Scope, true
+}
+
+// uaaErrorDescription extracts the reason from a UAA error response.
+func uaaErrorDescription(body []byte) string {
+	var uaaErr struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &uaaErr); err != nil {
+		return ""
+	}
+	if uaaErr.Description != "" {
+		return uaaErr.Description
 	}
-	return authToken
+	return uaaErr.Error
 }
@@ -1,8 +1,14 @@
 package uaatokenfetcher_test
 
 import (
+	"crypto/tls"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/logger"
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/uaatokenfetcher"
-	"github.com/cloudfoundry/gosteno"
 
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/testhelpers"
 	. "github.com/onsi/ginkgo"
@@ -14,21 +20,184 @@ var _ = Describe("UaaTokenFetcher", func() {
 		tokenFetcher *uaatokenfetcher.UAATokenFetcher
 		fakeUAA      *testhelpers.FakeUAA
 		fakeToken    string
-		fakeLogger   *gosteno.Logger
+		fakeLogger   logger.Logger
 	)
 
 	BeforeEach(func() {
 		fakeLogger = testhelpers.Logger()
 		fakeUAA = testhelpers.NewFakeUAA("bearer", "123456789")
 		fakeToken = fakeUAA.AuthToken()
-		fakeUAA.Start()
+	})
+
+	AfterEach(func() {
+		fakeUAA.Close()
+	})
+
+	Context("over plain HTTP", func() {
+		BeforeEach(func() {
+			fakeUAA.Start()
+			tokenFetcher = uaatokenfetcher.New(fakeUAA.URL(), "username", "password", nil, fakeLogger)
+		})
+
+		It("fetches a token from the UAA", func() {
+			receivedAuthToken, err := tokenFetcher.FetchAuthToken()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeUAA.Requested()).To(BeTrue())
+			Expect(receivedAuthToken).To(Equal(fakeToken))
+		})
+
+		It("requests a client credentials grant with basic auth", func() {
+			tokenFetcher.FetchAuthToken()
+
+			req := fakeUAA.LastRequest()
+			Expect(req.URL.Path).To(Equal("/oauth/token"))
+			Expect(req.Form.Get("grant_type")).To(Equal("client_credentials"))
+			username, password, ok := req.BasicAuth()
+			Expect(ok).To(BeTrue())
+			Expect(username).To(Equal("username"))
+			Expect(password).To(Equal("password"))
+		})
+
+		It("uses a rotated password for later requests", func() {
+			tokenFetcher.SetPassword("rotated-password")
+			tokenFetcher.FetchAuthToken()
+
+			_, password, ok := fakeUAA.LastRequest().BasicAuth()
+			Expect(ok).To(BeTrue())
+			Expect(password).To(Equal("rotated-password"))
+		})
+	})
+
+	Context("when requests fail", func() {
+		BeforeEach(func() {
+			fakeUAA.Start()
+			tokenFetcher = uaatokenfetcher.New(fakeUAA.URL(), "username", "password", nil, fakeLogger)
+			tokenFetcher.SetRetries(2, time.Millisecond)
+		})
+
+		It("retries server errors", func() {
+			fakeUAA.Fail(2, http.StatusBadGateway)
+
+			Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+			Expect(fakeUAA.Requests()).To(Equal(3))
+		})
+
+		It("gives up after the last retry", func() {
+			fakeUAA.Fail(3, http.StatusServiceUnavailable)
 
-		tokenFetcher = uaatokenfetcher.New(fakeUAA.URL(), "username", "password", true, fakeLogger)
+			_, err := tokenFetcher.FetchAuthToken()
+			Expect(err).To(MatchError(ContainSubstring("503 Service Unavailable")))
+			Expect(fakeUAA.Requests()).To(Equal(3))
+		})
+
+		It("does not retry rejected credentials", func() {
+			fakeUAA.Fail(1, http.StatusUnauthorized)
+
+			_, err := tokenFetcher.FetchAuthToken()
+			Expect(err).To(MatchError(ContainSubstring("401 Unauthorized: Bad credentials")))
+			Expect(fakeUAA.Requests()).To(Equal(1))
+		})
+
+		It("times out slow requests", func() {
+			hung := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-hung }))
+			defer server.Close()
+			defer close(hung)
+			tokenFetcher = uaatokenfetcher.New(server.URL, "username", "password", nil, fakeLogger)
+			tokenFetcher.SetRetries(0, 0)
+			tokenFetcher.SetTimeout(50 * time.Millisecond)
+
+			_, err := tokenFetcher.FetchAuthToken()
+			Expect(err).To(MatchError(ContainSubstring("Client.Timeout")))
+		})
 	})
 
-	It("fetches a token from the UAA", func() {
-		receivedAuthToken := tokenFetcher.FetchAuthToken()
-		Expect(fakeUAA.Requested()).To(BeTrue())
-		Expect(receivedAuthToken).To(Equal(fakeToken))
+	Context("with other grant types", func() {
+		BeforeEach(func() {
+			fakeUAA.Start()
+			tokenFetcher = uaatokenfetcher.New(fakeUAA.URL(), "cf", "", nil, fakeLogger)
+		})
+
+		It("requests a password grant for the user", func() {
+			tokenFetcher.SetPasswordGrant("admin", "admin-password")
+
+			Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+			req := fakeUAA.LastRequest()
+			Expect(req.Form.Get("grant_type")).To(Equal("password"))
+			Expect(req.Form.Get("username")).To(Equal("admin"))
+			Expect(req.Form.Get("password")).To(Equal("admin-password"))
+			username, _, _ := req.BasicAuth()
+			Expect(username).To(Equal("cf"))
+		})
+
+		It("uses the refresh token the UAA issues next", func() {
+			tokenFetcher.SetRefreshTokenGrant("first-refresh-token")
+			fakeUAA.SetRefreshToken("second-refresh-token")
+
+			Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+			Expect(fakeUAA.LastRequest().Form.Get("grant_type")).To(Equal("refresh_token"))
+			Expect(fakeUAA.LastRequest().Form.Get("refresh_token")).To(Equal("first-refresh-token"))
+
+			Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+			Expect(fakeUAA.LastRequest().Form.Get("refresh_token")).To(Equal("second-refresh-token"))
+		})
+	})
+
+	Context("checking scopes", func() {
+		BeforeEach(func() {
+			fakeUAA.Start()
+			tokenFetcher = uaatokenfetcher.New(fakeUAA.URL(), "username", "password", nil, fakeLogger)
+		})
+
+		It("rejects tokens without the doppler.firehose scope", func() {
+			fakeUAA.SetScope("cloud_controller.read openid")
+
+			_, err := tokenFetcher.FetchAuthToken()
+			Expect(err).To(MatchError(ContainSubstring("token has scopes [cloud_controller.read openid], needs one of [doppler.firehose]")))
+			Expect(fakeUAA.Requests()).To(Equal(1))
+		})
+
+		It("accepts any of the required scopes", func() {
+			fakeUAA.SetScope("logs.admin")
+			tokenFetcher.SetRequiredScopes(uaatokenfetcher.FirehoseScope, uaatokenfetcher.LogsAdminScope)
+
+			Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+		})
+
+		It("reads the scopes of the token when the response has none", func() {
+			claims := base64.RawURLEncoding.EncodeToString([]byte(`{"scope": ["openid"]}`))
+			fakeUAA.Close()
+			fakeUAA = testhelpers.NewFakeUAA("bearer", "header."+claims+".signature")
+			fakeUAA.SetScope("")
+			fakeUAA.Start()
+			tokenFetcher = uaatokenfetcher.New(fakeUAA.URL(), "username", "password", nil, fakeLogger)
+
+			_, err := tokenFetcher.FetchAuthToken()
+			Expect(err).To(BeAssignableToTypeOf(&uaatokenfetcher.ScopeError{}))
+		})
+	})
+
+	Context("over TLS with a private CA", func() {
+		var ca *testhelpers.FakeCertificateAuthority
+
+		BeforeEach(func() {
+			ca = testhelpers.NewFakeCertificateAuthority()
+			fakeUAA.StartTLS(ca.ServerTLSConfig())
+		})
+
+		It("fetches a token using the provided transport", func() {
+			transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.CertPool()}}
+			tokenFetcher = uaatokenfetcher.New(fakeUAA.URL(), "username", "password", transport, fakeLogger)
+
+			Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+		})
+
+		It("fails when the CA is not trusted", func() {
+			tokenFetcher = uaatokenfetcher.New(fakeUAA.URL(), "username", "password", nil, fakeLogger)
+			tokenFetcher.SetRetries(0, 0)
+
+			_, err := tokenFetcher.FetchAuthToken()
+			Expect(err).To(MatchError(ContainSubstring("certificate")))
+		})
 	})
 })